@@ -0,0 +1,197 @@
+package tukint
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+const (
+	TUK_TASK_ANALYTICS                = "analytics"
+	TUK_TEMPLATE_ANALYTICS_WIDGET     = "analyticswidget"
+	TUK_EVENT_QUERY_PARAM_DATE_FROM   = "from"
+	TUK_EVENT_QUERY_PARAM_DATE_TO     = "to"
+	TUK_EVENT_QUERY_PARAM_AUTHOR_ORG  = "authororg"
+	ANALYTICS_DATE_FORMAT             = "2006-01-02"
+	ANALYTICS_MAX_BOTTLENECKS         = 5
+	ANALYTICS_DURATION_HOURS_DECIMALS = 100
+	ANALYTICS_MAX_WORKFLOWS           = 5000
+)
+
+// DurationStats is the distribution of a set of durations in hours
+type DurationStats struct {
+	Count  int     `json:"count"`
+	Mean   float64 `json:"mean"`
+	Median float64 `json:"median"`
+	P90    float64 `json:"p90"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+}
+
+// TaskAnalytics is the distribution of the time taken to start a pathway task, measured from the workflow start, and the time taken to
+// complete it once started
+type TaskAnalytics struct {
+	Pathway    string        `json:"pathway"`
+	ID         string        `json:"id"`
+	Name       string        `json:"name"`
+	Wait       DurationStats `json:"wait"`
+	Duration   DurationStats `json:"duration"`
+	InProgress int           `json:"inprogress"`
+	waits      []float64
+	durations  []float64
+}
+
+// WorkflowAnalytics is the analytics of up to ANALYTICS_MAX_WORKFLOWS workflows. Truncated is true if more workflows were selected
+type WorkflowAnalytics struct {
+	Pathway     string          `json:"pathway"`
+	From        string          `json:"from"`
+	To          string          `json:"to"`
+	Org         string          `json:"org"`
+	Workflows   int             `json:"workflows"`
+	Truncated   bool            `json:"truncated"`
+	Open        int             `json:"open"`
+	Closed      int             `json:"closed"`
+	Cancelled   int             `json:"cancelled"`
+	CycleTime   DurationStats   `json:"cycletime"`
+	Tasks       []TaskAnalytics `json:"tasks"`
+	Bottlenecks []TaskAnalytics `json:"bottlenecks"`
+}
+
+// AnalyticsWidget returns the workflow and task duration distributions of the pathway workflows created in the date range as json or html
+func (i *TukEvent) AnalyticsWidget() []byte {
+	wfs := selectWorkflows(WorkflowFilter{Pathway: i.Pathway, Version: -1, CreatedFrom: i.DateFrom, CreatedTo: i.DateTo, AuthorOrg: i.AuthorOrg, Limit: ANALYTICS_MAX_WORKFLOWS + 1})
+	truncated := wfs.Count > ANALYTICS_MAX_WORKFLOWS
+	if truncated {
+		log.Printf("Selected more than %v Workflows. Analysing the first %v Workflows", ANALYTICS_MAX_WORKFLOWS, ANALYTICS_MAX_WORKFLOWS)
+		// as with tukdbint selects the first workflow is the selection
+		wfs.Workflows = wfs.Workflows[:ANALYTICS_MAX_WORKFLOWS+1]
+	}
+	analytics := newWorkflowAnalytics(wfs.Workflows, i.Pathway, i.DateFrom, i.DateTo, i.AuthorOrg)
+	analytics.Truncated = truncated
+	if i.ReturnJSON {
+		if i.HttpResponse != nil {
+			i.HttpResponse.Header().Add(tukcnst.CONTENT_TYPE, tukcnst.APPLICATION_JSON)
+		}
+		b, err := json.MarshalIndent(analytics, "", "  ")
+		if err != nil {
+			log.Println(err.Error())
+			return []byte(err.Error())
+		}
+		return b
+	}
+	var b bytes.Buffer
+	if err := i.EventServices.HTMLTemplates.ExecuteTemplate(&b, TUK_TEMPLATE_ANALYTICS_WIDGET, analytics); err != nil {
+		log.Println(err.Error())
+		return []byte(err.Error())
+	}
+	return b.Bytes()
+}
+
+// newWorkflowAnalytics returns the analytics of the workflows. The workflows are selected by the date range and org filters. Task analytics
+// are per pathway task as task ids are only unique within a pathway. Tasks that were completed when the workflow closed, rather than by
+// their events, are excluded from the task durations
+func newWorkflowAnalytics(wfs []tukdbint.Workflow, pathway string, from string, to string, org string) WorkflowAnalytics {
+	analytics := WorkflowAnalytics{Pathway: pathway, From: from, To: to, Org: org}
+	var cycletimes []float64
+	tasks := make(map[string]*TaskAnalytics)
+	var taskkeys []string
+	for _, wf := range wfs {
+		if wf.Id == 0 {
+			continue
+		}
+		e, err := newWorkflowEngine(wf)
+		if err != nil {
+			continue
+		}
+		start := e.startTime()
+		analytics.Workflows++
+		if end := e.workflowCompletionTime(); !end.IsZero() {
+			analytics.Closed++
+			cycletimes = append(cycletimes, hours(end.Sub(start)-e.suspendedDuration()))
+		} else if e.Document.WorkflowStatus == WORKFLOW_STATUS_CANCELLED {
+			analytics.Cancelled++
+		} else {
+			analytics.Open++
+		}
+		for k, task := range e.Document.TaskList.XDWTask {
+			details := task.TaskData.TaskDetails
+			key := wf.Pathway + "|" + details.ID
+			ta, ok := tasks[key]
+			if !ok {
+				ta = &TaskAnalytics{Pathway: wf.Pathway, ID: details.ID, Name: details.Name}
+				tasks[key] = ta
+				taskkeys = append(taskkeys, key)
+			}
+			if details.ActivationTime == "" {
+				continue
+			}
+			activated := Calendar().parseTime(details.ActivationTime)
+			ta.waits = append(ta.waits, hours(activated.Sub(start)))
+			if e.isTaskCompletedByEvents(k) {
+				ta.durations = append(ta.durations, hours(e.taskCompletionTime(details.ID).Sub(activated)))
+			} else if details.Status != tukcnst.COMPLETE && e.Document.WorkflowStatus == tukcnst.OPEN {
+				ta.InProgress++
+			}
+		}
+	}
+	analytics.CycleTime = newDurationStats(cycletimes)
+	sort.SliceStable(taskkeys, func(a, b int) bool {
+		ta, tb := tasks[taskkeys[a]], tasks[taskkeys[b]]
+		if ta.Pathway != tb.Pathway {
+			return ta.Pathway < tb.Pathway
+		}
+		return len(ta.ID) < len(tb.ID) || (len(ta.ID) == len(tb.ID) && ta.ID < tb.ID)
+	})
+	for _, key := range taskkeys {
+		ta := tasks[key]
+		ta.Wait = newDurationStats(ta.waits)
+		ta.Duration = newDurationStats(ta.durations)
+		analytics.Tasks = append(analytics.Tasks, *ta)
+	}
+	analytics.Bottlenecks = append(analytics.Bottlenecks, analytics.Tasks...)
+	sort.SliceStable(analytics.Bottlenecks, func(a, b int) bool {
+		return analytics.Bottlenecks[a].Duration.P90 > analytics.Bottlenecks[b].Duration.P90
+	})
+	if len(analytics.Bottlenecks) > ANALYTICS_MAX_BOTTLENECKS {
+		analytics.Bottlenecks = analytics.Bottlenecks[:ANALYTICS_MAX_BOTTLENECKS]
+	}
+	return analytics
+}
+func newDurationStats(durations []float64) DurationStats {
+	stats := DurationStats{Count: len(durations)}
+	if stats.Count == 0 {
+		return stats
+	}
+	sort.Float64s(durations)
+	var total float64
+	for _, d := range durations {
+		total = total + d
+	}
+	stats.Mean = round(total / float64(stats.Count))
+	stats.Median = percentile(durations, 50)
+	stats.P90 = percentile(durations, 90)
+	stats.Min = durations[0]
+	stats.Max = durations[stats.Count-1]
+	return stats
+}
+
+// percentile returns the nearest rank percentile of sorted durations
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+func hours(d time.Duration) float64 {
+	return round(d.Hours())
+}
+func round(f float64) float64 {
+	return math.Round(f*ANALYTICS_DURATION_HOURS_DECIMALS) / ANALYTICS_DURATION_HOURS_DECIMALS
+}
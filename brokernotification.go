@@ -0,0 +1,138 @@
+package tukint
+
+import (
+	"context"
+	"encoding/xml"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukdsub"
+)
+
+const (
+	DEFAULT_DUPLICATE_WINDOW = 60
+	NOTIFICATION_TIME_FORMAT = "2006-01-02 15:04:05"
+)
+
+// duplicateNotifications counts the broker notifications dropped as duplicates
+var duplicateNotifications atomic.Int64
+
+// brokerNotification is the identity of a broker Notify message. A notification is a duplicate if it has already been claimed for
+// each pathway subscribed to the broker ref within the duplicate window
+type brokerNotification struct {
+	BrokerRef      string
+	XdsDocEntryUid string
+	Pathways       []string
+}
+
+// newBrokerNotification parses the broker ref and document entry uid of the Notify message and selects the pathways subscribed to the broker ref
+func newBrokerNotification(msg string) (brokerNotification, error) {
+	n := brokerNotification{}
+	notify := tukdsub.DSUBNotifyMessage{}
+	if err := xml.Unmarshal([]byte(msg), &notify); err != nil {
+		return n, err
+	}
+	n.BrokerRef = notify.NotificationMessage.SubscriptionReference.Address.Text
+	for _, exid := range notify.NotificationMessage.Message.SubmitObjectsRequest.RegistryObjectList.ExtrinsicObject.ExternalIdentifier {
+		if exid.IdentificationScheme == tukcnst.URN_XDS_DOCUID {
+			n.XdsDocEntryUid = exid.Value
+		}
+	}
+	if n.BrokerRef == "" || n.XdsDocEntryUid == "" {
+		return n, nil
+	}
+	subs := tukdbint.GetSubscriptions(n.BrokerRef, "", "")
+	for _, sub := range subs.Subscriptions {
+		if sub.Id > 0 && !containsString(n.Pathways, sub.Pathway) {
+			n.Pathways = append(n.Pathways, sub.Pathway)
+		}
+	}
+	return n, nil
+}
+
+// claim claims the notification for each subscribed pathway and returns the pathways it claimed. A notification already claimed for a
+// pathway within the window is counted as a duplicate of that pathway. The notification is a duplicate if no pathway was claimed.
+// Notifications without a broker ref, document entry uid or subscription are never duplicates
+func (n brokerNotification) claim(window time.Duration) ([]string, bool) {
+	if n.BrokerRef == "" || n.XdsDocEntryUid == "" || len(n.Pathways) == 0 || tukdbint.DBConn == nil {
+		return nil, false
+	}
+	var claimed []string
+	for _, pathway := range n.Pathways {
+		isClaimed, err := claimNotification(n.BrokerRef, n.XdsDocEntryUid, pathway, window)
+		if err != nil {
+			return claimed, false
+		}
+		if isClaimed {
+			claimed = append(claimed, pathway)
+		}
+	}
+	return claimed, len(claimed) == 0
+}
+
+// release releases the claims on the pathways, so a notification that could not be handled is not dropped as a duplicate when the
+// broker retries it
+func (n brokerNotification) release(pathways []string) {
+	for _, pathway := range pathways {
+		releaseNotification(n.BrokerRef, n.XdsDocEntryUid, pathway)
+	}
+}
+
+// duplicateWindow returns the configured duplicate notification window
+func (i *TukEvent) duplicateWindow() time.Duration {
+	window := i.EventServices.EventService.DuplicateWindow
+	if window <= 0 {
+		window = DEFAULT_DUPLICATE_WINDOW
+	}
+	return time.Duration(window) * time.Minute
+}
+
+// claimNotification claims the Notify message in the request body and returns the pathways claimed. It returns true if the notification is
+// a duplicate of a notification already claimed
+func (i *TukEvent) claimNotification(n brokerNotification) ([]string, bool) {
+	claimed, isDuplicate := n.claim(i.duplicateWindow())
+	if !isDuplicate {
+		return claimed, false
+	}
+	dropped := duplicateNotifications.Add(1)
+	log.Printf("Dropping duplicate Notification for Broker Ref %s XDS Doc UID %s. %v duplicate notifications dropped", n.BrokerRef, n.XdsDocEntryUid, dropped)
+	return nil, true
+}
+
+// claimNotification returns true if the notification is claimed for the pathway. A claim older than the window is removed first. The insert
+// of the claim is atomic on the unique key of the notification, MySQL returning 1 row affected for a new claim and 2 rows affected when the
+// duplicate count of an existing claim is incremented
+func claimNotification(brokerref string, docuid string, pathway string, window time.Duration) (bool, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	now := time.Now().UTC()
+	if _, err := tukdbint.DBConn.ExecContext(ctx, "DELETE FROM processednotifications WHERE brokerref = ? AND xdsdocentryuid = ? AND pathway = ? AND received < ?", brokerref, docuid, pathway, now.Add(-window).Format(NOTIFICATION_TIME_FORMAT)); err != nil {
+		log.Println(err.Error())
+		return false, err
+	}
+	res, err := tukdbint.DBConn.ExecContext(ctx, "INSERT INTO processednotifications (brokerref, xdsdocentryuid, pathway, received, duplicates) VALUES (?, ?, ?, ?, 0) ON DUPLICATE KEY UPDATE duplicates = duplicates + 1", brokerref, docuid, pathway, now.Format(NOTIFICATION_TIME_FORMAT))
+	if err != nil {
+		log.Println(err.Error())
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		log.Println(err.Error())
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+// releaseNotification removes the claim of the notification for the pathway
+func releaseNotification(brokerref string, docuid string, pathway string) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	_, err := tukdbint.DBConn.ExecContext(ctx, "DELETE FROM processednotifications WHERE brokerref = ? AND xdsdocentryuid = ? AND pathway = ?", brokerref, docuid, pathway)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
@@ -0,0 +1,142 @@
+//go:build integration
+
+package tukint
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukdsub"
+	"github.com/ipthomas/tukutil"
+)
+
+const (
+	testRegOid    = "2.16.840.1.113883.2.1.3.31.2.1.1"
+	testBrokerRef = "urn:uuid:testbrokerref"
+)
+
+// testNotify returns a SOAP 1.2 DSUB Notify request for a document with the type code and class code registered for the test broker ref
+func testNotify(docuid string, typecode string, classcode string) string {
+	return `<env:Envelope xmlns:env="` + SOAP_12_NAMESPACE + `" xmlns:wsa="` + WSA_NAMESPACE + `">` +
+		`<env:Header><wsa:Action>` + WSA_ACTION_NOTIFY + `</wsa:Action><wsa:MessageID>urn:uuid:` + docuid + `</wsa:MessageID></env:Header>` +
+		`<env:Body><wsnt:Notify xmlns:wsnt="` + WSN_NAMESPACE + `"><wsnt:NotificationMessage>` +
+		`<wsnt:SubscriptionReference><wsa:Address>` + testBrokerRef + `</wsa:Address></wsnt:SubscriptionReference>` +
+		`<wsnt:Message><lcm:SubmitObjectsRequest xmlns:lcm="urn:oasis:names:tc:ebxml-regrep:xsd:lcm:3.0"><rim:RegistryObjectList xmlns:rim="urn:oasis:names:tc:ebxml-regrep:xsd:rim:3.0">` +
+		`<rim:ExtrinsicObject id="Document01"><rim:Name><rim:LocalizedString value="Test Document"/></rim:Name>` +
+		`<rim:Classification classificationScheme="` + tukcnst.URN_TYPE_CODE + `"><rim:Name><rim:LocalizedString value="` + typecode + `"/></rim:Name></rim:Classification>` +
+		`<rim:Classification classificationScheme="` + tukcnst.URN_CLASS_CODE + `"><rim:Name><rim:LocalizedString value="` + classcode + `"/></rim:Name></rim:Classification>` +
+		`<rim:ExternalIdentifier identificationScheme="` + tukcnst.URN_XDS_PID + `" value="REG1234^^^&amp;` + testRegOid + `&amp;ISO"/>` +
+		`<rim:ExternalIdentifier identificationScheme="` + tukcnst.URN_XDS_DOCUID + `" value="` + docuid + `"/>` +
+		`</rim:ExtrinsicObject></rim:RegistryObjectList></lcm:SubmitObjectsRequest></wsnt:Message>` +
+		`</wsnt:NotificationMessage></wsnt:Notify></env:Body></env:Envelope>`
+}
+
+// postTestNotify posts the Notify request to the event service and returns the response status
+func postTestNotify(t *testing.T, notify string) int {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/eventservice/event", strings.NewReader(notify))
+	req.Header.Set(tukcnst.CONTENT_TYPE, tukcnst.SOAP_XML)
+	rsp := httptest.NewRecorder()
+	i := TukEvent{REGOid: Regoid, EventServices: Services, HttpRequest: req, HttpResponse: rsp}
+	i.parsePostEvent()
+	return rsp.Code
+}
+
+// newTestBroker subscribes the test pathway to the test broker ref and replaces the tukdsub transaction with one creating the events tukdsub
+// creates for a notification, for the test patient, as the tukhttp patient service request fails without a patient service
+func newTestBroker(t *testing.T) {
+	t.Helper()
+	transaction := dsubTransaction
+	t.Cleanup(func() { dsubTransaction = transaction })
+	dsubTransaction = func(i tukdsub.DSUB_Interface) error {
+		dsub := i.(*tukdsub.DSUBEvent)
+		notify := tukdsub.DSUBNotifyMessage{}
+		if err := xml.Unmarshal([]byte(dsub.EventMessage), &notify); err != nil {
+			return err
+		}
+		ev := tukdbint.Event{Creationtime: tukutil.Time_Now(), EventType: tukcnst.XDW_TASKEVENTTYPE_ATTACHMENT, NhsId: "9999999468"}
+		ev.BrokerRef = notify.NotificationMessage.SubscriptionReference.Address.Text
+		obj := notify.NotificationMessage.Message.SubmitObjectsRequest.RegistryObjectList.ExtrinsicObject
+		for _, c := range obj.Classification {
+			switch c.ClassificationScheme {
+			case tukcnst.URN_TYPE_CODE:
+				ev.Expression = c.Name.LocalizedString.Value
+			case tukcnst.URN_CLASS_CODE:
+				ev.ClassCode = c.Name.LocalizedString.Value
+			}
+		}
+		for _, exid := range obj.ExternalIdentifier {
+			if exid.IdentificationScheme == tukcnst.URN_XDS_DOCUID {
+				ev.XdsDocEntryUid = exid.Value
+			}
+		}
+		for _, sub := range tukdbint.GetSubscriptions(ev.BrokerRef, "", "").Subscriptions {
+			if sub.Id > 0 {
+				ev.Pathway, ev.Topic = sub.Pathway, sub.Topic
+				newEvent(ev)
+			}
+		}
+		return nil
+	}
+	if _, err := tukdbint.DBConn.Exec("INSERT INTO subscriptions (brokerref, pathway, topic, expression) VALUES (?, ?, ?, ?)", testBrokerRef, testPathway, tukcnst.DSUB_TOPIC_TYPE_CODE, "REFERRAL"); err != nil {
+		t.Fatal(err)
+	}
+}
+func TestBrokerNotificationUpdatesWorkflow(t *testing.T) {
+	db := newTestDB(t)
+	newTestBroker(t)
+	wf := newTestWorkflow(t, "9999999468")
+
+	if code := postTestNotify(t, testNotify("1.2.3.4.1", "REFERRAL", "REF")); code != http.StatusOK {
+		t.Fatalf("notify returned %v, expected %v", code, http.StatusOK)
+	}
+	if err := ProcessNotificationInbox(); err != nil {
+		t.Fatal(err)
+	}
+	inbox := db.Rows(t, "notificationinbox")
+	if len(inbox) != 1 || inbox[0]["status"] != NOTIFICATION_STATUS_PROCESSED {
+		t.Fatalf("notification was not processed %v", inbox)
+	}
+	evs := db.Rows(t, "events")
+	if len(evs) != 1 || evs[0]["brokerref"] != testBrokerRef || evs[0]["nhsid"] != "9999999468" || evs[0]["xdsdocentryuid"] != "1.2.3.4.1" {
+		t.Fatalf("notification event was not created %v", evs)
+	}
+	doc := testDocument(t, wf.Id)
+	if status := testTaskStatus(doc, "1"); status != tukcnst.COMPLETE {
+		t.Errorf("task 1 status is %s, expected %s", status, tukcnst.COMPLETE)
+	}
+
+	if code := postTestNotify(t, testNotify("1.2.3.4.1", "REFERRAL", "REF")); code != http.StatusOK {
+		t.Errorf("duplicate notify returned %v, expected %v", code, http.StatusOK)
+	}
+	if inbox := db.Rows(t, "notificationinbox"); len(inbox) != 1 {
+		t.Errorf("duplicate notification was added to the inbox %v", inbox)
+	}
+}
+
+func TestBrokerNotificationFilter(t *testing.T) {
+	newTestDB(t)
+	newTestBroker(t)
+	wf := newTestWorkflow(t, "9999999468")
+
+	postTestNotify(t, testNotify("1.2.3.4.2", "REVIEW", "Discharge"))
+	if err := ProcessNotificationInbox(); err != nil {
+		t.Fatal(err)
+	}
+	if status := testTaskStatus(testDocument(t, wf.Id), "2"); status == tukcnst.COMPLETE {
+		t.Errorf("task 2 was completed by a notification with a class code not matching the task filter")
+	}
+
+	postTestNotify(t, testNotify("1.2.3.4.3", "REVIEW", "Review"))
+	if err := ProcessNotificationInbox(); err != nil {
+		t.Fatal(err)
+	}
+	if status := testTaskStatus(testDocument(t, wf.Id), "2"); status != tukcnst.COMPLETE {
+		t.Errorf("task 2 status is %s, expected %s", status, tukcnst.COMPLETE)
+	}
+}
@@ -0,0 +1,346 @@
+package tukint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"text/template"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukdsub"
+	"github.com/ipthomas/tukpdq"
+	"github.com/ipthomas/tukutil"
+)
+
+const (
+	TUK_TASK_RENEW                         = "renew"
+	TUK_TASK_PAUSE                         = "pause"
+	TUK_TASK_BROKER_REF                    = "brokerref"
+	TUK_TEMPLATE_BROKER_REF_WIDGET         = "brokerrefwidget"
+	TUK_EVENT_QUERY_PARAM_TERMINATION_TIME = "terminationtime"
+	SUBSCRIPTION_STATUS_ACTIVE             = "ACTIVE"
+	SUBSCRIPTION_STATUS_PAUSED             = "PAUSED"
+	SUBSCRIPTION_ORIGIN_WORKFLOW           = "WORKFLOW"
+	SUBSCRIPTION_ORIGIN_USER               = "USER"
+	NOTIFICATION_STATUS_PAUSED             = "PAUSED"
+	DEFAULT_SUBSCRIPTION_TERM              = 365
+	SOAP_ACTION_RENEW_REQUEST              = "http://docs.oasis-open.org/wsn/bw-2/SubscriptionManager/RenewRequest"
+	TERMINATION_TIME_FORMAT                = "2006-01-02T15:04:05Z"
+)
+
+// brokerTemplates are the DSUB Subscribe, Renew and Unsubscribe requests. The Subscribe request filters on the topic expression, the
+// filter criteria and, for patient subscriptions, the XDS patient id
+var brokerTemplates = template.Must(template.New("broker").Funcs(template.FuncMap{"newuuid": tukutil.NewUuid, "xml": xmlEscape}).Parse(`{{define "subscribe"}}<SOAP-ENV:Envelope xmlns:SOAP-ENV='http://www.w3.org/2003/05/soap-envelope' xmlns:wsa='http://www.w3.org/2005/08/addressing'><SOAP-ENV:Header><wsa:Action SOAP-ENV:mustUnderstand='true'>http://docs.oasis-open.org/wsn/bw-2/NotificationProducer/SubscribeRequest</wsa:Action><wsa:MessageID>urn:uuid:{{newuuid}}</wsa:MessageID><wsa:ReplyTo SOAP-ENV:mustUnderstand='true'><wsa:Address>http://www.w3.org/2005/08/addressing/anonymous</wsa:Address></wsa:ReplyTo><wsa:To>{{xml .BrokerURL}}</wsa:To></SOAP-ENV:Header><SOAP-ENV:Body><wsnt:Subscribe xmlns:wsnt='http://docs.oasis-open.org/wsn/b-2' xmlns:rim='urn:oasis:names:tc:ebxml-regrep:xsd:rim:3.0'><wsnt:ConsumerReference><wsa:Address>{{xml .ConsumerURL}}</wsa:Address></wsnt:ConsumerReference><wsnt:Filter><wsnt:TopicExpression Dialect='http://docs.oasis-open.org/wsn/t-1/TopicExpression/Simple'>ihe:FullDocumentEntry</wsnt:TopicExpression><rim:AdhocQuery id='urn:uuid:742790e0-aba6-43d6-9f1f-e43ed9790b79'>{{if .PatientId}}<rim:Slot name='$XDSDocumentEntryPatientId'><rim:ValueList><rim:Value>'{{xml .PatientId}}'</rim:Value></rim:ValueList></rim:Slot>{{end}}{{if .Expression}}<rim:Slot name='{{xml .Topic}}'><rim:ValueList><rim:Value>('{{xml .Expression}}')</rim:Value></rim:ValueList></rim:Slot>{{end}}{{range .Slots}}<rim:Slot name='{{xml .Name}}'><rim:ValueList><rim:Value>{{xml .Value}}</rim:Value></rim:ValueList></rim:Slot>{{end}}</rim:AdhocQuery></wsnt:Filter><wsnt:InitialTerminationTime>{{.TerminationTime}}</wsnt:InitialTerminationTime></wsnt:Subscribe></SOAP-ENV:Body></SOAP-ENV:Envelope>{{end}}` +
+	`{{define "renew"}}<SOAP-ENV:Envelope xmlns:SOAP-ENV='http://www.w3.org/2003/05/soap-envelope' xmlns:wsa='http://www.w3.org/2005/08/addressing'><SOAP-ENV:Header><wsa:Action SOAP-ENV:mustUnderstand='true'>http://docs.oasis-open.org/wsn/bw-2/SubscriptionManager/RenewRequest</wsa:Action><wsa:MessageID>urn:uuid:{{newuuid}}</wsa:MessageID><wsa:ReplyTo SOAP-ENV:mustUnderstand='true'><wsa:Address>http://www.w3.org/2005/08/addressing/anonymous</wsa:Address></wsa:ReplyTo><wsa:To>{{xml .BrokerRef}}</wsa:To></SOAP-ENV:Header><SOAP-ENV:Body><wsnt:Renew xmlns:wsnt='http://docs.oasis-open.org/wsn/b-2'><wsnt:TerminationTime>{{.TerminationTime}}</wsnt:TerminationTime></wsnt:Renew></SOAP-ENV:Body></SOAP-ENV:Envelope>{{end}}` +
+	`{{define "unsubscribe"}}<SOAP-ENV:Envelope xmlns:SOAP-ENV='http://www.w3.org/2003/05/soap-envelope' xmlns:wsa='http://www.w3.org/2005/08/addressing'><SOAP-ENV:Header><wsa:Action SOAP-ENV:mustUnderstand='true'>http://docs.oasis-open.org/wsn/bw-2/SubscriptionManager/UnsubscribeRequest</wsa:Action><wsa:MessageID>urn:uuid:{{newuuid}}</wsa:MessageID><wsa:ReplyTo SOAP-ENV:mustUnderstand='true'><wsa:Address>http://www.w3.org/2005/08/addressing/anonymous</wsa:Address></wsa:ReplyTo><wsa:To>{{xml .BrokerRef}}</wsa:To></SOAP-ENV:Header><SOAP-ENV:Body><wsnt:Unsubscribe xmlns:wsnt='http://docs.oasis-open.org/wsn/b-2'/></SOAP-ENV:Body></SOAP-ENV:Envelope>{{end}}`))
+
+// SubscriptionState is the delivery status and broker termination time of a broker subscription. Broker subscriptions are shared by the
+// pathways subscribed to the same expression, so pausing a subscription pauses delivery to every pathway with the broker ref. Origin is
+// USER for subscriptions created explicitly with the subscription create operation and WORKFLOW for subscriptions created for workflows
+type SubscriptionState struct {
+	BrokerRef       string `json:"brokerref"`
+	Status          string `json:"status"`
+	TerminationTime string `json:"terminationtime"`
+	Origin          string `json:"origin"`
+	Updated         string `json:"updated"`
+}
+
+// BrokerRefDetails are the state, subscriptions and notifications of a broker ref
+type BrokerRefDetails struct {
+	State            SubscriptionState       `json:"state"`
+	Subscriptions    []tukdbint.Subscription `json:"subscriptions"`
+	Notifications    int                     `json:"notifications"`
+	LastNotification string                  `json:"lastnotification"`
+}
+
+// brokerSubscription is a DSUB Subscribe, Renew or Unsubscribe request
+type brokerSubscription struct {
+	BrokerURL       string
+	ConsumerURL     string
+	BrokerRef       string
+	Topic           string
+	Expression      string
+	PatientId       string
+	Slots           []dsubSlot
+	TerminationTime string
+}
+
+// createSubscription subscribes the pathway to documents matching the topic expression and, if an nhs id is provided, the patient. The
+// topic defaults to the document type code
+func (i *TukEvent) createSubscription() error {
+	if i.Pathway == "" || (i.Expression == "" && i.NHSId == "") {
+		i.ReturnCode = http.StatusBadRequest
+		return errors.New("pathway and an expression or nhs id are required to create a subscription")
+	}
+	terminationtime, err := i.terminationTime()
+	if err != nil {
+		return err
+	}
+	sub := tukdbint.Subscription{
+		Pathway:    i.Pathway,
+		Topic:      i.Topic,
+		Expression: i.Expression,
+		NhsId:      i.NHSId,
+		User:       i.EventServices.EventService.User,
+		Org:        i.EventServices.EventService.Org,
+		Role:       i.EventServices.EventService.Role,
+	}
+	if _, err = registerSubscription(sub, DSUBFilter{}, terminationtime, SUBSCRIPTION_ORIGIN_USER); err != nil {
+		i.ReturnCode = http.StatusBadGateway
+	}
+	return err
+}
+
+// registerSubscription subscribes to the topic expression, the filter criteria and, if the subscription has an nhs id, the patient with the
+// DSUB broker and registers the subscription with the origin. The broker ref is returned
+func registerSubscription(sub tukdbint.Subscription, filter DSUBFilter, terminationtime string, origin string) (string, error) {
+	if sub.Topic == "" {
+		sub.Topic = tukcnst.DSUB_TOPIC_TYPE_CODE
+	}
+	req := brokerSubscription{Topic: sub.Topic, Expression: sub.Expression, Slots: filter.slots(), TerminationTime: terminationtime}
+	var err error
+	if sub.NhsId != "" {
+		if req.PatientId, err = xdsPatientId(sub.NhsId); err != nil {
+			return "", err
+		}
+	}
+	if sub.BrokerRef, err = req.subscribe(); err != nil {
+		return "", err
+	}
+	subs := tukdbint.Subscriptions{Action: tukcnst.INSERT}
+	subs.Subscriptions = append(subs.Subscriptions, sub)
+	if err = tukdbint.NewDBEvent(&subs); err != nil {
+		return sub.BrokerRef, err
+	}
+	log.Printf("Created %s Subscription to %s %s NHS ID %s with Broker Ref %s", sub.Pathway, sub.Topic, sub.Expression, sub.NhsId, sub.BrokerRef)
+	if !filter.isEmpty() {
+		if err = setSubscriptionFilter(sub.BrokerRef, filter); err != nil {
+			return sub.BrokerRef, err
+		}
+	}
+	return sub.BrokerRef, setSubscriptionState(SubscriptionState{BrokerRef: sub.BrokerRef, Status: SUBSCRIPTION_STATUS_ACTIVE, TerminationTime: terminationtime, Origin: origin})
+}
+
+// renewSubscription renews the broker subscription of the subscription row id with the termination time
+func (i *TukEvent) renewSubscription() error {
+	state, err := i.subscriptionState()
+	if err != nil {
+		return err
+	}
+	if state.TerminationTime, err = i.terminationTime(); err != nil {
+		return err
+	}
+	req := brokerSubscription{BrokerRef: state.BrokerRef, TerminationTime: state.TerminationTime}
+	if err = req.renew(); err != nil {
+		i.ReturnCode = http.StatusBadGateway
+		return err
+	}
+	log.Printf("Renewed Broker Ref %s until %s", state.BrokerRef, state.TerminationTime)
+	return setSubscriptionState(state)
+}
+
+// setSubscriptionDelivery pauses or resumes delivery of notifications for the broker ref of the subscription row id. Notifications received
+// while delivery is paused are held in the notification inbox and are released when delivery is resumed
+func (i *TukEvent) setSubscriptionDelivery(status string) error {
+	state, err := i.subscriptionState()
+	if err != nil {
+		return err
+	}
+	state.Status = status
+	if err = setSubscriptionState(state); err != nil {
+		return err
+	}
+	log.Printf("Set Broker Ref %s delivery %s", state.BrokerRef, status)
+	if status == SUBSCRIPTION_STATUS_ACTIVE {
+		cnt, err := releaseInboxNotifications(state.BrokerRef)
+		if err != nil {
+			return err
+		}
+		log.Printf("Released %v paused Notifications for Broker Ref %s", cnt, state.BrokerRef)
+		if inboxWorkers == 0 {
+			return ProcessNotificationInbox()
+		}
+		select {
+		case inboxSignal <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// BrokerRefWidget returns the state, subscriptions and notifications of the broker ref, or of the broker ref of the subscription row id
+func (i *TukEvent) BrokerRefWidget() []byte {
+	state, err := i.subscriptionState()
+	if err != nil {
+		log.Println(err.Error())
+		return []byte(err.Error())
+	}
+	i.BrokerRefDetails = BrokerRefDetails{State: state}
+	for _, sub := range tukdbint.GetSubscriptions(state.BrokerRef, "", "").Subscriptions {
+		if sub.Id > 0 {
+			i.BrokerRefDetails.Subscriptions = append(i.BrokerRefDetails.Subscriptions, sub)
+		}
+	}
+	if i.BrokerRefDetails.Notifications, i.BrokerRefDetails.LastNotification, err = getBrokerRefNotifications(state.BrokerRef); err != nil {
+		log.Println(err.Error())
+	}
+	if i.ReturnJSON {
+		if i.HttpResponse != nil {
+			i.HttpResponse.Header().Add(tukcnst.CONTENT_TYPE, tukcnst.APPLICATION_JSON)
+		}
+		b, err := json.MarshalIndent(i.BrokerRefDetails, "", "  ")
+		if err != nil {
+			log.Println(err.Error())
+			return []byte(err.Error())
+		}
+		return b
+	}
+	var b bytes.Buffer
+	if err := i.EventServices.HTMLTemplates.ExecuteTemplate(&b, TUK_TEMPLATE_BROKER_REF_WIDGET, i); err != nil {
+		log.Println(err.Error())
+		return []byte(err.Error())
+	}
+	return b.Bytes()
+}
+
+// subscriptionState returns the state of the request broker ref, or of the broker ref of the subscription row id. Subscriptions created
+// before subscription states were recorded are active with no known termination time
+func (i *TukEvent) subscriptionState() (SubscriptionState, error) {
+	brokerref := i.BrokerRef
+	if brokerref == "" && i.RowId > 0 {
+		subs := tukdbint.Subscriptions{Action: tukcnst.SELECT}
+		subs.Subscriptions = append(subs.Subscriptions, tukdbint.Subscription{Id: i.RowId})
+		if err := tukdbint.NewDBEvent(&subs); err != nil {
+			i.ReturnCode = http.StatusInternalServerError
+			return SubscriptionState{}, err
+		}
+		if subs.Count == 1 {
+			brokerref = subs.Subscriptions[1].BrokerRef
+		}
+	}
+	if brokerref == "" {
+		i.ReturnCode = http.StatusNotFound
+		return SubscriptionState{}, errors.New("no broker ref found for subscription")
+	}
+	state, err := getSubscriptionState(brokerref)
+	if err != nil {
+		i.ReturnCode = http.StatusInternalServerError
+	}
+	return state, err
+}
+
+// terminationTime returns the requested termination time, or the default subscription term from now, as an xs:dateTime
+func (i *TukEvent) terminationTime() (string, error) {
+	if i.TerminationTime == "" {
+		return defaultTerminationTime(i.EventServices.EventService.SubscriptionTerm), nil
+	}
+	t, err := time.Parse(time.RFC3339, i.TerminationTime)
+	if err != nil || !t.After(time.Now()) {
+		i.ReturnCode = http.StatusBadRequest
+		return "", errors.New("termination time must be a future rfc3339 date time")
+	}
+	return t.UTC().Format(TERMINATION_TIME_FORMAT), nil
+}
+
+// defaultTerminationTime returns the termination time of a subscription term in days from now
+func defaultTerminationTime(term int) string {
+	if term <= 0 {
+		term = DEFAULT_SUBSCRIPTION_TERM
+	}
+	return time.Now().UTC().AddDate(0, 0, term).Format(TERMINATION_TIME_FORMAT)
+}
+
+// xdsPatientId returns the XDS patient id of the nhs id in the XDS affinity domain
+func xdsPatientId(nhsid string) (string, error) {
+	pdq := tukpdq.PDQQuery{
+		Server_Mode: Services.EventService.PatientSrvc,
+		NHS_ID:      nhsid,
+		REG_OID:     Regoid,
+	}
+	switch pdq.Server_Mode {
+	case tukcnst.PDQ_SERVER_TYPE_IHE_PDQV3:
+		pdq.Server_URL = Services.PDQv3Service.WSE
+	case tukcnst.PDQ_SERVER_TYPE_IHE_PIXM:
+		pdq.Server_URL = Services.PIXmService.WSE
+	}
+	if err := tukpdq.New_Transaction(&pdq); err != nil {
+		return "", err
+	}
+	if pdq.Count == 0 || pdq.REG_ID == "" {
+		return "", errors.New("no xds patient id found for nhs id " + nhsid)
+	}
+	return pdq.REG_ID + "^^^&" + Regoid + "&ISO", nil
+}
+
+// subscribe sends the Subscribe request to the DSUB broker and returns the broker ref
+func (s brokerSubscription) subscribe() (string, error) {
+	s.BrokerURL = Services.BrokerService.WSE
+	s.ConsumerURL = os.Getenv(tukcnst.ENV_DSUB_CONSUMER_URL)
+	if s.ConsumerURL == "" {
+		s.ConsumerURL = Services.EventService.WSE
+	}
+	rsp, err := s.send("subscribe", tukcnst.SOAP_ACTION_SUBSCRIBE_REQUEST)
+	if err != nil {
+		return "", err
+	}
+	subrsp := tukdsub.DSUBSubscribeResponse{}
+	if err = xml.Unmarshal(rsp, &subrsp); err != nil {
+		return "", err
+	}
+	if subrsp.Body.SubscribeResponse.SubscriptionReference.Address == "" {
+		return "", errors.New("no broker ref returned by the dsub broker")
+	}
+	return subrsp.Body.SubscribeResponse.SubscriptionReference.Address, nil
+}
+
+// renew sends the Renew request for the broker ref to the DSUB broker
+func (s brokerSubscription) renew() error {
+	s.BrokerURL = Services.BrokerService.WSE
+	_, err := s.send("renew", SOAP_ACTION_RENEW_REQUEST)
+	return err
+}
+
+// unsubscribe sends the Unsubscribe request for the broker ref to the DSUB broker
+func (s brokerSubscription) unsubscribe() error {
+	s.BrokerURL = Services.BrokerService.WSE
+	_, err := s.send("unsubscribe", tukcnst.SOAP_ACTION_UNSUBSCRIBE_REQUEST)
+	return err
+}
+func (s brokerSubscription) send(tmplt string, action string) ([]byte, error) {
+	if s.BrokerURL == "" {
+		return nil, errors.New("no dsub broker service is configured")
+	}
+	var b bytes.Buffer
+	if err := brokerTemplates.ExecuteTemplate(&b, tmplt, s); err != nil {
+		return nil, err
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancelCtx()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.BrokerURL, &b)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(tukcnst.CONTENT_TYPE, tukcnst.SOAP_XML+"; action=\""+action+"\"")
+	req.Header.Set(tukcnst.SOAP_ACTION, action)
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != http.StatusOK || tukutil.ContainsError(string(body)) {
+		return nil, errors.New("dsub broker rejected the " + tmplt + " request. " + tukutil.GetErrorMessage(string(body)))
+	}
+	return body, nil
+}
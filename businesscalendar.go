@@ -0,0 +1,214 @@
+package tukint
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipthomas/tukutil"
+)
+
+const (
+	DEFAULT_TIMEZONE      = "Europe/London"
+	DEFAULT_WORKDAY_START = 9
+	DEFAULT_WORKDAY_END   = 17
+	HOLIDAY_DATE_FORMAT   = "2006-01-02"
+)
+
+// BusinessCalendar defines the working days and hours used to calculate workday(n) and workhour(n) deadlines
+type BusinessCalendar struct {
+	Location *time.Location
+	DayStart int
+	DayEnd   int
+	Holidays map[string]string
+	Source   string
+}
+
+var (
+	calendar   = newBusinessCalendar(DEFAULT_TIMEZONE, DEFAULT_WORKDAY_START, DEFAULT_WORKDAY_END)
+	calendarMu sync.RWMutex
+)
+
+// Calendar returns the Event Service business calendar. A loaded calendar is not modified, initBusinessCalendar replaces it
+func Calendar() *BusinessCalendar {
+	calendarMu.RLock()
+	defer calendarMu.RUnlock()
+	return calendar
+}
+
+func newBusinessCalendar(timezone string, start int, end int) *BusinessCalendar {
+	cal := BusinessCalendar{DayStart: start, DayEnd: end, Holidays: make(map[string]string)}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		log.Println(err.Error())
+		loc = time.UTC
+	}
+	cal.Location = loc
+	return &cal
+}
+
+// initBusinessCalendar loads the Event Service business calendar. Holidays are loaded from the Holidays file if configured, otherwise from the holidays table
+func initBusinessCalendar() {
+	srvc := Services.EventService
+	timezone := srvc.Timezone
+	if timezone == "" {
+		timezone = DEFAULT_TIMEZONE
+	}
+	start, end := srvc.WorkdayStart, srvc.WorkdayEnd
+	if start == 0 && end == 0 {
+		start, end = DEFAULT_WORKDAY_START, DEFAULT_WORKDAY_END
+	}
+	if start < 0 || end > 24 || end <= start {
+		log.Printf("Invalid working hours %v to %v. Using default working hours", start, end)
+		start, end = DEFAULT_WORKDAY_START, DEFAULT_WORKDAY_END
+	}
+	cal := newBusinessCalendar(timezone, start, end)
+	var err error
+	if srvc.Holidays != "" {
+		cal.Source = srvc.Holidays
+		err = cal.loadHolidayFile(srvc.Holidays)
+	} else {
+		cal.Source = "holidays"
+		cal.Holidays, err = getHolidays()
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	log.Printf("Loaded Business Calendar. Timezone %s Working Hours %v to %v. %v Holidays loaded from %s", cal.Location.String(), cal.DayStart, cal.DayEnd, len(cal.Holidays), cal.Source)
+	calendarMu.Lock()
+	calendar = cal
+	calendarMu.Unlock()
+}
+
+// loadHolidayFile loads holidays from a file with one yyyy-MM-dd date per line, optionally followed by a description. Lines starting with # are ignored
+func (c *BusinessCalendar) loadHolidayFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		date := strings.TrimSuffix(fields[0], ",")
+		if _, err := time.Parse(HOLIDAY_DATE_FORMAT, date); err != nil {
+			log.Printf("Ignoring invalid holiday date %s", date)
+			continue
+		}
+		desc := ""
+		if len(fields) > 1 {
+			desc = strings.TrimSpace(fields[1])
+		}
+		c.Holidays[date] = desc
+	}
+	return scanner.Err()
+}
+
+// IsWorkingDay returns true if the date is not a weekend or holiday in the calendar time zone
+func (c *BusinessCalendar) IsWorkingDay(t time.Time) bool {
+	t = t.In(c.Location)
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		return false
+	}
+	_, holiday := c.Holidays[t.Format(HOLIDAY_DATE_FORMAT)]
+	return !holiday
+}
+
+// FutureDate returns the date of the period from startdate. Periods workday(n) and workhour(n) exclude weekends, holidays and, for workhour, time outside working hours.
+// All other periods are calculated by tukutil.OHT_FutureDate in the calendar time zone
+func (c *BusinessCalendar) FutureDate(startdate time.Time, period string) time.Time {
+	if !strings.Contains(period, "(") || !strings.Contains(period, ")") {
+		return startdate
+	}
+	unit := strings.Split(period, "(")[0]
+	n := tukutil.GetIntFromString(strings.Split(strings.Split(period, "(")[1], ")")[0])
+	switch unit {
+	case "workday":
+		return c.addWorkdays(startdate, n)
+	case "workhour":
+		return c.addWorkhours(startdate, n)
+	case "week":
+		return startdate.In(c.Location).AddDate(0, 0, 7*n)
+	}
+	return tukutil.OHT_FutureDate(startdate.In(c.Location), period)
+}
+
+// parseTime returns the time of an event time string. Event times are recorded by tukutil in Europe/London
+func (c *BusinessCalendar) parseTime(timestr string) time.Time {
+	return tukutil.GetTimeFromString(timestr).In(c.Location)
+}
+func (c *BusinessCalendar) addWorkdays(startdate time.Time, n int) time.Time {
+	t := startdate.In(c.Location)
+	for n > 0 {
+		t = t.AddDate(0, 0, 1)
+		if c.IsWorkingDay(t) {
+			n--
+		}
+	}
+	return t
+}
+func (c *BusinessCalendar) addWorkhours(startdate time.Time, n int) time.Time {
+	return c.addWorkingTime(startdate, time.Duration(n)*time.Hour)
+}
+
+// addWorkingTime returns the date the working time d after startdate
+func (c *BusinessCalendar) addWorkingTime(startdate time.Time, d time.Duration) time.Time {
+	if d <= 0 {
+		return startdate
+	}
+	t := startdate.In(c.Location)
+	remaining := d
+	for {
+		daystart := time.Date(t.Year(), t.Month(), t.Day(), c.DayStart, 0, 0, 0, c.Location)
+		dayend := time.Date(t.Year(), t.Month(), t.Day(), c.DayEnd, 0, 0, 0, c.Location)
+		if !c.IsWorkingDay(t) || !t.Before(dayend) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, c.DayStart, 0, 0, 0, c.Location)
+			continue
+		}
+		if t.Before(daystart) {
+			t = daystart
+		}
+		if available := dayend.Sub(t); remaining > available {
+			remaining = remaining - available
+			t = dayend
+			continue
+		}
+		return t.Add(remaining)
+	}
+}
+
+// workingTime returns the time between from and to that is within working hours on working days
+func (c *BusinessCalendar) workingTime(from time.Time, to time.Time) time.Duration {
+	var worked time.Duration
+	t := from.In(c.Location)
+	for t.Before(to) {
+		daystart := time.Date(t.Year(), t.Month(), t.Day(), c.DayStart, 0, 0, 0, c.Location)
+		dayend := time.Date(t.Year(), t.Month(), t.Day(), c.DayEnd, 0, 0, 0, c.Location)
+		if c.IsWorkingDay(t) {
+			start, end := t, to
+			if start.Before(daystart) {
+				start = daystart
+			}
+			if end.After(dayend) {
+				end = dayend
+			}
+			if end.After(start) {
+				worked = worked + end.Sub(start)
+			}
+		}
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.Location)
+	}
+	return worked
+}
+
+// workdayLength returns the working time of a working day
+func (c *BusinessCalendar) workdayLength() time.Duration {
+	return time.Duration(c.DayEnd-c.DayStart) * time.Hour
+}
@@ -0,0 +1,177 @@
+package tukint
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+const (
+	DSUB_QUERY_CLASS_CODE         = "$XDSDocumentEntryClassCode"
+	DSUB_QUERY_FORMAT_CODE        = "$XDSDocumentEntryFormatCode"
+	DSUB_QUERY_PRACTICE_SETTING   = "$XDSDocumentEntryPracticeSettingCode"
+	DSUB_QUERY_FACILITY           = "$XDSDocumentEntryHealthcareFacilityTypeCode"
+	DSUB_QUERY_AUTHOR_INSTITUTION = "$XDSDocumentEntryAuthorInstitution"
+)
+
+// DSUBCode is a coded filter criterion. The code and code system are sent in the subscribe request. Notification events record the display
+// name of the document codes, so events are matched on the display name, or on the code if no display name is declared
+type DSUBCode struct {
+	Code       string `json:"code"`
+	CodeSystem string `json:"codesystem"`
+	Display    string `json:"display,omitempty"`
+}
+
+// DSUBFilter is the filter criteria of a workflow definition task input or output in addition to its type code expression. A document
+// matches the filter if it matches one of the values of each criterion. Author institutions are XON values and are matched on the
+// organisation name
+type DSUBFilter struct {
+	ClassCode         []DSUBCode `json:"classcode,omitempty"`
+	FormatCode        []DSUBCode `json:"formatcode,omitempty"`
+	PracticeSetting   []DSUBCode `json:"practicesetting,omitempty"`
+	Facility          []DSUBCode `json:"facility,omitempty"`
+	AuthorInstitution []string   `json:"authorinstitution,omitempty"`
+}
+
+// dsubSlot is an ad hoc query parameter of a subscribe request
+type dsubSlot struct {
+	Name  string
+	Value string
+}
+
+// dsubDefinition is the subscription criteria of the XDS registered task inputs and outputs of a workflow definition. The filter is an
+// optional property of a definition input or output
+type dsubDefinition struct {
+	Ref   string `json:"ref"`
+	Tasks []struct {
+		ID     string     `json:"id"`
+		Input  []dsubPart `json:"input"`
+		Output []dsubPart `json:"output"`
+	} `json:"tasks"`
+}
+type dsubPart struct {
+	Name       string     `json:"name"`
+	AccessType string     `json:"accesstype"`
+	Filter     DSUBFilter `json:"filter"`
+}
+
+// dsubCriteria is a subscription expression and filter
+type dsubCriteria struct {
+	Expression string
+	Filter     DSUBFilter
+}
+
+func (f DSUBFilter) isEmpty() bool {
+	return len(f.ClassCode) == 0 && len(f.FormatCode) == 0 && len(f.PracticeSetting) == 0 && len(f.Facility) == 0 && len(f.AuthorInstitution) == 0
+}
+
+// key returns the filter as a string that is equal for equal filters. An empty filter has an empty key
+func (f DSUBFilter) key() string {
+	if f.isEmpty() {
+		return ""
+	}
+	b, _ := json.Marshal(f)
+	return string(b)
+}
+
+// slots returns the ad hoc query parameters of the filter
+func (f DSUBFilter) slots() []dsubSlot {
+	var slots []dsubSlot
+	for _, c := range []struct {
+		name  string
+		codes []DSUBCode
+	}{
+		{DSUB_QUERY_CLASS_CODE, f.ClassCode},
+		{DSUB_QUERY_FORMAT_CODE, f.FormatCode},
+		{DSUB_QUERY_PRACTICE_SETTING, f.PracticeSetting},
+		{DSUB_QUERY_FACILITY, f.Facility},
+	} {
+		var vals []string
+		for _, code := range c.codes {
+			vals = append(vals, code.Code+"^^"+code.CodeSystem)
+		}
+		if len(vals) > 0 {
+			slots = append(slots, dsubSlot{Name: c.name, Value: queryValues(vals)})
+		}
+	}
+	if len(f.AuthorInstitution) > 0 {
+		slots = append(slots, dsubSlot{Name: DSUB_QUERY_AUTHOR_INSTITUTION, Value: queryValues(f.AuthorInstitution)})
+	}
+	return slots
+}
+
+// matches returns true if the notification event matches each criterion of the filter
+func (f DSUBFilter) matches(ev tukdbint.Event) bool {
+	if !matchesCode(f.ClassCode, ev.ClassCode) || !matchesCode(f.FormatCode, ev.FormatCode) || !matchesCode(f.PracticeSetting, ev.PracticeCode) || !matchesCode(f.Facility, ev.FacilityCode) {
+		return false
+	}
+	if len(f.AuthorInstitution) == 0 {
+		return true
+	}
+	org, _, _ := strings.Cut(ev.Org, "^")
+	for _, inst := range f.AuthorInstitution {
+		name, _, _ := strings.Cut(inst, "^")
+		if strings.EqualFold(strings.TrimSpace(name), strings.TrimSpace(org)) {
+			return true
+		}
+	}
+	return false
+}
+func matchesCode(codes []DSUBCode, val string) bool {
+	if len(codes) == 0 {
+		return true
+	}
+	for _, code := range codes {
+		display := code.Display
+		if display == "" {
+			display = code.Code
+		}
+		if strings.EqualFold(display, strings.TrimSpace(val)) {
+			return true
+		}
+	}
+	return false
+}
+
+// queryValues returns the values as a stored query value list
+func queryValues(vals []string) string {
+	return "('" + strings.Join(vals, "','") + "')"
+}
+
+// newDSUBDefinition parses the subscription criteria of the workflow definition json
+func newDSUBDefinition(xdwdef string) (dsubDefinition, error) {
+	def := dsubDefinition{}
+	err := json.Unmarshal([]byte(xdwdef), &def)
+	return def, err
+}
+
+// criteria returns the expression and filter of each XDS registered task input and output
+func (d dsubDefinition) criteria() []dsubCriteria {
+	var criteria []dsubCriteria
+	keys := make(map[string]bool)
+	for _, task := range d.Tasks {
+		for _, part := range append(append([]dsubPart{}, task.Input...), task.Output...) {
+			key := part.Name + "|" + part.Filter.key()
+			if part.AccessType == tukcnst.XDS_REGISTERED && !keys[key] {
+				keys[key] = true
+				criteria = append(criteria, dsubCriteria{Expression: part.Name, Filter: part.Filter})
+			}
+		}
+	}
+	return criteria
+}
+
+// filters returns the filters of the task inputs and outputs keyed by task id and part name
+func (d dsubDefinition) filters() map[string]DSUBFilter {
+	filters := make(map[string]DSUBFilter)
+	for _, task := range d.Tasks {
+		for _, part := range append(append([]dsubPart{}, task.Input...), task.Output...) {
+			if !part.Filter.isEmpty() {
+				filters[task.ID+"|"+part.Name] = part.Filter
+			}
+		}
+	}
+	return filters
+}
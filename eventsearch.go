@@ -0,0 +1,125 @@
+package tukint
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+const (
+	TUK_TASK_SEARCH                   = "search"
+	TUK_TEMPLATE_EVENT_SEARCH_WIDGET  = "eventsearchwidget"
+	TUK_EVENT_QUERY_PARAM_SEARCH_TEXT = "q"
+	TUK_EVENT_QUERY_PARAM_CLASS_CODE  = "classcode"
+	TUK_EVENT_QUERY_PARAM_EVENT_ORG   = "eventorg"
+	EVENT_SEARCH_INDEX                = "events_search"
+	EVENT_SEARCH_COLUMNS              = "comments, authors, docname, expression"
+)
+
+// EventSearch selects events by structured filters and free text. Text is matched against the event comments, authors, document name
+// and expression using MySQL boolean mode full text search, eg. '+DNA -cancelled', and requires the EVENT_SEARCH_INDEX created by
+// migrations/001_events_search_index.sql. Org matches the event org or the document authors. Empty filters are ignored
+type EventSearch struct {
+	Text      string `json:"q"`
+	Pathway   string `json:"pathway"`
+	NHSId     string `json:"nhsid"`
+	EventType string `json:"eventtype"`
+	ClassCode string `json:"classcode"`
+	Org       string `json:"org"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+}
+type EventSearchResult struct {
+	Search EventSearch      `json:"search"`
+	Events []tukdbint.Event `json:"events"`
+	Page   Page             `json:"page"`
+}
+
+func (i *TukEvent) eventSearch() EventSearch {
+	return EventSearch{
+		Text:      i.SearchText,
+		Pathway:   i.Pathway,
+		NHSId:     i.NHSId,
+		EventType: i.EventType,
+		ClassCode: i.ClassCode,
+		Org:       i.EventOrg,
+		From:      i.DateFrom,
+		To:        i.DateTo,
+	}
+}
+
+// searchEvents returns the events matching the search as json or the search widget
+func (i *TukEvent) searchEvents() []byte {
+	var err error
+	if i.Page, err = i.newPage("id"); err != nil {
+		i.ReturnCode = http.StatusBadRequest
+		return []byte(err.Error())
+	}
+	rslt := EventSearchResult{Search: i.eventSearch()}
+	evs, err := getEventSearchPage(rslt.Search, &i.Page)
+	if err != nil {
+		log.Println(err.Error())
+		i.ReturnCode = http.StatusBadRequest
+	}
+	rslt.Events = evs
+	i.DBEvents = append([]tukdbint.Event{{Pathway: i.Pathway, NhsId: i.NHSId}}, evs...)
+	i.setLinkHeader()
+	rslt.Page = i.Page
+	if i.ReturnJSON {
+		if i.HttpResponse != nil {
+			i.HttpResponse.Header().Add(tukcnst.CONTENT_TYPE, tukcnst.APPLICATION_JSON)
+		}
+		b, err := json.MarshalIndent(rslt, "", "  ")
+		if err != nil {
+			log.Println(err.Error())
+			return []byte(err.Error())
+		}
+		return b
+	}
+	var b bytes.Buffer
+	if err := i.EventServices.HTMLTemplates.ExecuteTemplate(&b, TUK_TEMPLATE_EVENT_SEARCH_WIDGET, i); err != nil {
+		log.Println(err.Error())
+		return []byte(err.Error())
+	}
+	return b.Bytes()
+}
+
+// getEventSearchPage returns a page of the events matching the search
+func getEventSearchPage(s EventSearch, p *Page) ([]tukdbint.Event, error) {
+	var conds []string
+	var params []interface{}
+	add := func(cond string, param interface{}) {
+		conds = append(conds, cond)
+		params = append(params, param)
+	}
+	if s.Text != "" {
+		add("MATCH ("+EVENT_SEARCH_COLUMNS+") AGAINST (? IN BOOLEAN MODE)", s.Text)
+	}
+	if s.Pathway != "" {
+		add("pathway = ?", s.Pathway)
+	}
+	if s.NHSId != "" {
+		add("nhsid = ?", s.NHSId)
+	}
+	if s.EventType != "" {
+		add("eventtype = ?", s.EventType)
+	}
+	if s.ClassCode != "" {
+		add("classcode = ?", s.ClassCode)
+	}
+	if s.Org != "" {
+		conds = append(conds, "(org = ? OR authors LIKE ?)")
+		params = append(params, s.Org, "%"+s.Org+"%")
+	}
+	if s.From != "" {
+		add("DATE(creationtime) >= ?", s.From)
+	}
+	if s.To != "" {
+		add("DATE(creationtime) <= ?", s.To)
+	}
+	return queryEventsPage(conds, params, p)
+}
@@ -0,0 +1,255 @@
+package tukint
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukxdw"
+)
+
+const (
+	CONTENT_DISPOSITION   = "Content-Disposition"
+	UTF8_BOM              = "\ufeff"
+	EXPORT_FLUSH_INTERVAL = 100
+	EXPORT_LAMBDA_LIMIT   = 5000
+	EXPORT_LAMBDA_TIMEOUT = 25 * time.Second
+)
+
+var workflowExportColumns = []string{"id", "pathway", "nhsid", "version", "created", "status", "createdby", "org", "completeby", "lastupdate", "overdue", "escalated", "targetmet", "inprogress", "duration", "timeremaining"}
+var workflowTaskExportColumns = []string{"id", "name", "status", "owner", "activationtime", "lastmodifiedtime"}
+var eventExportColumns = []string{"id", "creationtime", "eventtype", "docname", "classcode", "confcode", "formatcode", "facilitycode", "practicecode", "speciality", "expression", "authors", "xdspid", "xdsdocentryuid", "repositoryuniqueid", "nhsid", "user", "org", "role", "topic", "pathway", "comments", "version", "taskid", "brokerref"}
+
+// csvExport writes csv rows to the http response, flushing every EXPORT_FLUSH_INTERVAL rows so that exports are streamed.
+// Lambda responses cannot be streamed and are buffered, so Lambda exports are paged by at most EXPORT_LAMBDA_LIMIT rows with a
+// Link header to the next page
+type csvExport struct {
+	w    *csv.Writer
+	buf  *bytes.Buffer
+	rsp  http.ResponseWriter
+	rows int
+}
+
+func (i *TukEvent) newCSVExport(filename string) *csvExport {
+	exp := csvExport{}
+	var out io.Writer
+	if i.HttpResponse != nil {
+		i.HttpResponse.Header().Set(tukcnst.CONTENT_TYPE, TEXT_CSV+"; charset=utf-8")
+		i.HttpResponse.Header().Set(CONTENT_DISPOSITION, "attachment; filename=\""+filename+".csv\"")
+		exp.rsp = i.HttpResponse
+		out = i.HttpResponse
+	} else {
+		exp.buf = &bytes.Buffer{}
+		out = exp.buf
+	}
+	io.WriteString(out, UTF8_BOM)
+	exp.w = csv.NewWriter(out)
+	return &exp
+}
+func (e *csvExport) write(record []string) error {
+	if err := e.w.Write(csvRecord(record)); err != nil {
+		return err
+	}
+	e.rows++
+	if e.rows%EXPORT_FLUSH_INTERVAL == 0 {
+		e.flush()
+	}
+	return nil
+}
+
+// csvRecord returns the record with a ' prefixed to each cell starting with a character a spreadsheet reads as the start of a formula,
+// so exported values are not evaluated when the csv is opened in a spreadsheet
+func csvRecord(record []string) []string {
+	cells := make([]string, len(record))
+	for k, cell := range record {
+		if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+			cell = "'" + cell
+		}
+		cells[k] = cell
+	}
+	return cells
+}
+func (e *csvExport) flush() {
+	e.w.Flush()
+	if f, ok := e.rsp.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close flushes the export and returns the buffered csv, or nil if the export was written to the http response
+func (e *csvExport) close() []byte {
+	e.flush()
+	if err := e.w.Error(); err != nil {
+		log.Println(err.Error())
+	}
+	log.Printf("Exported %v csv rows", e.rows)
+	if e.buf != nil {
+		return e.buf.Bytes()
+	}
+	return nil
+}
+
+// newExportPage returns the page of an export request. Http exports are only limited if the request is paged
+func (i *TukEvent) newExportPage(defaultsort string) (Page, error) {
+	p, err := i.newPage(defaultsort)
+	if err == nil && i.HttpResponse == nil && (p.Limit == 0 || p.Limit > EXPORT_LAMBDA_LIMIT) {
+		p.Limit = EXPORT_LAMBDA_LIMIT
+	}
+	return p, err
+}
+
+// exportContext returns the context of the export queries. Http exports are streamed until the request is done, so queries use the
+// request context. Lambda exports are buffered and their queries are limited to EXPORT_LAMBDA_TIMEOUT
+func (i *TukEvent) exportContext() (context.Context, context.CancelFunc) {
+	if i.HttpRequest != nil {
+		return context.WithCancel(i.HttpRequest.Context())
+	}
+	return context.WithTimeout(context.Background(), EXPORT_LAMBDA_TIMEOUT)
+}
+
+// exportWorkflows writes the workflows selected by the request filters as csv with the workflow state and one group of columns per task
+func (i *TukEvent) exportWorkflows() []byte {
+	p, err := i.newExportPage(DEFAULT_WORKFLOWS_SORT)
+	if err != nil {
+		i.ReturnCode = http.StatusBadRequest
+		return []byte(err.Error())
+	}
+	ctx, cancelCtx := i.exportContext()
+	defer cancelCtx()
+	f := i.workflowFilter()
+	where, params := f.where()
+	from := " FROM workflows w LEFT JOIN workflowstate s ON s.workflowid = w.id"
+	var tasks int
+	if err := tukdbint.DBConn.QueryRowContext(ctx, "SELECT COALESCE(MAX(JSON_LENGTH(w.xdw_doc, '$.TaskList.XDWTask')), 0)"+from+where, params...).Scan(&tasks); err != nil {
+		log.Println(err.Error())
+		i.ReturnCode = http.StatusInternalServerError
+		return []byte(err.Error())
+	}
+	header := append([]string{}, workflowExportColumns...)
+	for t := 1; t <= tasks; t++ {
+		for _, col := range workflowTaskExportColumns {
+			header = append(header, "task"+strconv.Itoa(t)+"_"+col)
+		}
+	}
+	sortcol := sortColumn(workflowSortColumns, p.Sort, DEFAULT_WORKFLOWS_SORT)
+	where, params = p.where(where, params, sortcol, "w.id")
+	stmnt := "SELECT w.id, w.pathway, w.nhsid, w.version, w.created, w.status, w.xdw_doc, COALESCE(s.createdby, ''), COALESCE(s.completeby, ''), COALESCE(s.lastupdate, ''), COALESCE(s.overdue, ''), COALESCE(s.escalated, ''), COALESCE(s.targetmet, ''), COALESCE(s.inprogress, ''), COALESCE(s.duration, ''), COALESCE(s.timeremaining, ''), COALESCE(CAST(" + sortcol + " AS CHAR), '')" +
+		from + where
+	rows, err := tukdbint.DBConn.QueryContext(ctx, stmnt, params...)
+	if err != nil {
+		log.Println(err.Error())
+		i.ReturnCode = http.StatusInternalServerError
+		return []byte(err.Error())
+	}
+	defer rows.Close()
+	exp := i.newCSVExport("workflows")
+	exp.write(header)
+	var keys []string
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var version int
+		var pathway, nhsid, created, status, doc, createdby, completeby, lastupdate, overdue, escalated, targetmet, inprogress, duration, timeremaining, key string
+		if err := rows.Scan(&id, &pathway, &nhsid, &version, &created, &status, &doc, &createdby, &completeby, &lastupdate, &overdue, &escalated, &targetmet, &inprogress, &duration, &timeremaining, &key); err != nil {
+			log.Println(err.Error())
+			break
+		}
+		keys = append(keys, key)
+		ids = append(ids, id)
+		if p.Limit > 0 && len(keys) > p.Limit {
+			break
+		}
+		wfdoc := tukxdw.WorkflowDocument{}
+		if err := json.Unmarshal([]byte(doc), &wfdoc); err != nil {
+			log.Println(err.Error())
+		}
+		record := []string{strconv.FormatInt(id, 10), pathway, nhsid, strconv.Itoa(version), created, status, createdby, wfdoc.Author.AssignedAuthor.ID.Extension, completeby, lastupdate, overdue, escalated, targetmet, inprogress, duration, timeremaining}
+		for _, task := range wfdoc.TaskList.XDWTask {
+			details := task.TaskData.TaskDetails
+			record = append(record, details.ID, details.Name, details.Status, details.ActualOwner, details.ActivationTime, details.LastModifiedTime)
+		}
+		for len(record) < len(header) {
+			record = append(record, "")
+		}
+		if err := exp.write(record); err != nil {
+			log.Println(err.Error())
+			break
+		}
+	}
+	i.setExportNext(&p, keys, ids)
+	return exp.close()
+}
+
+// exportEvents writes the events selected by the request as csv
+func (i *TukEvent) exportEvents(filter tukdbint.Event) []byte {
+	p, err := i.newExportPage("id")
+	if err != nil {
+		i.ReturnCode = http.StatusBadRequest
+		return []byte(err.Error())
+	}
+	conds, params := eventFilter(filter)
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+	sortcol := sortColumn(eventSortColumns, p.Sort, "id")
+	where, params = p.where(where, params, sortcol, "id")
+	ctx, cancelCtx := i.exportContext()
+	defer cancelCtx()
+	rows, err := tukdbint.DBConn.QueryContext(ctx, "SELECT "+eventColumns+", COALESCE(CAST("+sortcol+" AS CHAR), '') FROM events"+where, params...)
+	if err != nil {
+		log.Println(err.Error())
+		i.ReturnCode = http.StatusInternalServerError
+		return []byte(err.Error())
+	}
+	defer rows.Close()
+	exp := i.newCSVExport("events")
+	exp.write(eventExportColumns)
+	var keys []string
+	var ids []int64
+	for rows.Next() {
+		var key string
+		ev := tukdbint.Event{}
+		if err := rows.Scan(append(eventDest(&ev), &key)...); err != nil {
+			log.Println(err.Error())
+			break
+		}
+		keys = append(keys, key)
+		ids = append(ids, ev.Id)
+		if p.Limit > 0 && len(keys) > p.Limit {
+			break
+		}
+		record := []string{strconv.FormatInt(ev.Id, 10), ev.Creationtime, ev.EventType, ev.DocName, ev.ClassCode, ev.ConfCode, ev.FormatCode, ev.FacilityCode, ev.PracticeCode, ev.Speciality, ev.Expression, ev.Authors, ev.XdsPid, ev.XdsDocEntryUid, ev.RepositoryUniqueId, ev.NhsId, ev.User, ev.Org, ev.Role, ev.Topic, ev.Pathway, ev.Comments, strconv.Itoa(ev.Version), strconv.Itoa(ev.TaskId), ev.BrokerRef}
+		if err := exp.write(record); err != nil {
+			log.Println(err.Error())
+			break
+		}
+	}
+	i.setExportNext(&p, keys, ids)
+	return exp.close()
+}
+
+// setExportNext sets the next page of a limited export, and the Link header to it, from the sort keys and ids of the exported rows
+func (i *TukEvent) setExportNext(p *Page, keys []string, ids []int64) {
+	p.setNext(keys, ids)
+	i.Page = *p
+	i.setLinkHeader()
+}
+
+// exportDashboard writes the dashboard counts as csv
+func (i *TukEvent) exportDashboard() []byte {
+	exp := i.newCSVExport("dashboard")
+	exp.write([]string{"pathway", "status", "from", "to", "org", "total", "inprogress", "targetmet", "targetmissed", "escalated", "complete"})
+	d := i.Dashboard
+	exp.write([]string{i.Pathway, i.Status, i.DateFrom, i.DateTo, i.AuthorOrg, strconv.Itoa(d.Total), strconv.Itoa(d.InProgress), strconv.Itoa(d.TargetMet), strconv.Itoa(d.TargetMissed), strconv.Itoa(d.Escalated), strconv.Itoa(d.Complete)})
+	return exp.close()
+}
@@ -0,0 +1,597 @@
+package tukint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukutil"
+	"github.com/ipthomas/tukxdw"
+)
+
+const (
+	FHIR_PATH                       = "fhir"
+	APPLICATION_FHIR_JSON           = "application/fhir+json"
+	FHIR_RESOURCE_CAREPLAN          = "CarePlan"
+	FHIR_RESOURCE_TASK              = "Task"
+	FHIR_RESOURCE_BUNDLE            = "Bundle"
+	FHIR_RESOURCE_OPERATION_OUTCOME = "OperationOutcome"
+	FHIR_RESOURCE_PATIENT           = "Patient"
+	FHIR_SYSTEM_NHS_NUMBER          = "https://fhir.nhs.uk/Id/nhs-number"
+	FHIR_SYSTEM_ODS_CODE            = "https://fhir.nhs.uk/Id/ods-organization-code"
+	FHIR_SYSTEM_URI                 = "urn:ietf:rfc:3986"
+	FHIR_SEARCH_PARAM_ID            = "_id"
+	FHIR_SEARCH_PARAM_COUNT         = "_count"
+	FHIR_SEARCH_PARAM_OFFSET        = "_offset"
+	FHIR_SEARCH_PARAM_PATIENT       = "patient"
+	FHIR_SEARCH_PARAM_SUBJECT       = "subject"
+	FHIR_SEARCH_PARAM_STATUS        = "status"
+	FHIR_SEARCH_PARAM_CATEGORY      = "category"
+	FHIR_SEARCH_PARAM_OWNER         = "owner"
+	FHIR_SEARCH_PARAM_CODE          = "code"
+	FHIR_SEARCH_PARAM_BASED_ON      = "based-on"
+	FHIR_CAREPLAN_STATUS_ACTIVE     = "active"
+	FHIR_CAREPLAN_STATUS_ON_HOLD    = "on-hold"
+	FHIR_CAREPLAN_STATUS_REVOKED    = "revoked"
+	FHIR_CAREPLAN_STATUS_COMPLETED  = "completed"
+	FHIR_TASK_STATUS_REQUESTED      = "requested"
+	FHIR_TASK_STATUS_READY          = "ready"
+	FHIR_TASK_STATUS_IN_PROGRESS    = "in-progress"
+	FHIR_TASK_STATUS_ON_HOLD        = "on-hold"
+	FHIR_TASK_STATUS_CANCELLED      = "cancelled"
+	FHIR_TASK_STATUS_COMPLETED      = "completed"
+	FHIR_ISSUE_SEVERITY_ERROR       = "error"
+	FHIR_ISSUE_CODE_NOT_FOUND       = "not-found"
+	FHIR_ISSUE_CODE_NOT_SUPPORTED   = "not-supported"
+	FHIR_ISSUE_CODE_INVALID         = "invalid"
+	FHIR_ISSUE_CODE_EXCEPTION       = "exception"
+	FHIR_BUNDLE_TYPE_SEARCHSET      = "searchset"
+	FHIR_BUNDLE_LINK_SELF           = "self"
+	FHIR_BUNDLE_LINK_NEXT           = "next"
+	FHIR_BUNDLE_SEARCH_MODE_MATCH   = "match"
+	FHIR_CAREPLAN_INTENT_PLAN       = "plan"
+	FHIR_TASK_INTENT_ORDER          = "order"
+	FHIR_TASK_TABLE                 = "JSON_TABLE(w.xdw_doc, '$.TaskList.XDWTask[*]' COLUMNS (seq FOR ORDINALITY, taskid VARCHAR(64) PATH '$.TaskData.TaskDetails.ID', status VARCHAR(64) PATH '$.TaskData.TaskDetails.Status', owner VARCHAR(255) PATH '$.TaskData.TaskDetails.ActualOwner', name VARCHAR(255) PATH '$.TaskData.TaskDetails.Name')) t"
+)
+
+// FHIR R4 resources. Only the elements that XDW workflow documents map to are included
+
+type FHIRReference struct {
+	Reference  string          `json:"reference,omitempty"`
+	Type       string          `json:"type,omitempty"`
+	Identifier *FHIRIdentifier `json:"identifier,omitempty"`
+	Display    string          `json:"display,omitempty"`
+}
+type FHIRIdentifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value"`
+}
+type FHIRCodeableConcept struct {
+	Text string `json:"text"`
+}
+type FHIRPeriod struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+type FHIRAnnotation struct {
+	AuthorString string `json:"authorString,omitempty"`
+	Time         string `json:"time,omitempty"`
+	Text         string `json:"text"`
+}
+type FHIRTaskParameter struct {
+	Type           FHIRCodeableConcept `json:"type"`
+	ValueReference FHIRReference       `json:"valueReference"`
+}
+type FHIRTask struct {
+	ResourceType    string              `json:"resourceType"`
+	Id              string              `json:"id"`
+	BasedOn         []FHIRReference     `json:"basedOn,omitempty"`
+	Status          string              `json:"status"`
+	BusinessStatus  FHIRCodeableConcept `json:"businessStatus"`
+	Intent          string              `json:"intent"`
+	Code            FHIRCodeableConcept `json:"code"`
+	Description     string              `json:"description,omitempty"`
+	For             FHIRReference       `json:"for"`
+	ExecutionPeriod *FHIRPeriod         `json:"executionPeriod,omitempty"`
+	AuthoredOn      string              `json:"authoredOn,omitempty"`
+	LastModified    string              `json:"lastModified,omitempty"`
+	Requester       *FHIRReference      `json:"requester,omitempty"`
+	Owner           *FHIRReference      `json:"owner,omitempty"`
+	Note            []FHIRAnnotation    `json:"note,omitempty"`
+	Input           []FHIRTaskParameter `json:"input,omitempty"`
+	Output          []FHIRTaskParameter `json:"output,omitempty"`
+}
+type FHIRCarePlanActivity struct {
+	Reference FHIRReference `json:"reference"`
+}
+type FHIRCarePlan struct {
+	ResourceType          string                 `json:"resourceType"`
+	Id                    string                 `json:"id"`
+	Contained             []FHIRTask             `json:"contained,omitempty"`
+	Identifier            []FHIRIdentifier       `json:"identifier,omitempty"`
+	InstantiatesCanonical []string               `json:"instantiatesCanonical,omitempty"`
+	Status                string                 `json:"status"`
+	Intent                string                 `json:"intent"`
+	Category              []FHIRCodeableConcept  `json:"category"`
+	Title                 string                 `json:"title"`
+	Subject               FHIRReference          `json:"subject"`
+	Period                FHIRPeriod             `json:"period"`
+	Created               string                 `json:"created,omitempty"`
+	Author                *FHIRReference         `json:"author,omitempty"`
+	Activity              []FHIRCarePlanActivity `json:"activity,omitempty"`
+	Note                  []FHIRAnnotation       `json:"note,omitempty"`
+}
+type FHIRBundleLink struct {
+	Relation string `json:"relation"`
+	URL      string `json:"url"`
+}
+type FHIRBundleSearch struct {
+	Mode string `json:"mode"`
+}
+type FHIRBundleEntry struct {
+	FullURL  string           `json:"fullUrl"`
+	Resource interface{}      `json:"resource"`
+	Search   FHIRBundleSearch `json:"search"`
+}
+type FHIRBundle struct {
+	ResourceType string            `json:"resourceType"`
+	Type         string            `json:"type"`
+	Total        int               `json:"total"`
+	Link         []FHIRBundleLink  `json:"link,omitempty"`
+	Entry        []FHIRBundleEntry `json:"entry"`
+}
+type FHIROperationOutcomeIssue struct {
+	Severity    string `json:"severity"`
+	Code        string `json:"code"`
+	Diagnostics string `json:"diagnostics"`
+}
+type FHIROperationOutcome struct {
+	ResourceType string                      `json:"resourceType"`
+	Issue        []FHIROperationOutcomeIssue `json:"issue"`
+}
+
+// fhirRequest is a FHIR request. Path is the request path following the fhir base, eg. Task/12-1 or CarePlan
+type fhirRequest struct {
+	Base          string
+	Path          string
+	Params        url.Values
+	Body          []byte
+	Authorization string
+}
+
+// Handle_FHIR_HTTP_Request serves FHIR CarePlan and Task read and search requests for workflows. Each workflow is a CarePlan with the
+// workflow tasks as contained Task resources. Tasks are also searchable as resources, eg. Task?patient=9999999468&status=ready
+func Handle_FHIR_HTTP_Request(rsp http.ResponseWriter, req *http.Request) {
+	log.Printf("Received FHIR %s request %s from %s", req.Method, req.URL.String(), req.RemoteAddr)
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	req.ParseForm()
+	base := Services.EventService.Scheme + "://" + req.Host + "/" + Services.EventService.BaseURLPath + "/" + FHIR_PATH
+	path := req.URL.Path[strings.Index(req.URL.Path, "/"+FHIR_PATH+"/")+len(FHIR_PATH)+2:]
+	code, body := handleFHIRRequest(req.Method, fhirRequest{Base: base, Path: path, Params: req.Form, Body: body, Authorization: req.Header.Get(tukcnst.AUTHORIZATION)})
+	rsp.Header().Set(tukcnst.CONTENT_TYPE, APPLICATION_FHIR_JSON)
+	rsp.WriteHeader(code)
+	rsp.Write(body)
+}
+
+// handleAWSFHIRRequest serves FHIR requests received by the AWS API Gateway handler
+func handleAWSFHIRRequest(request events.APIGatewayProxyRequest) *events.APIGatewayProxyResponse {
+	params := url.Values{}
+	for key, value := range request.QueryStringParameters {
+		params.Set(key, value)
+	}
+	idx := strings.Index(request.Path, "/"+FHIR_PATH+"/")
+	base := Services.EventService.Scheme + "://" + request.Headers["Host"] + request.Path[:idx+len(FHIR_PATH)+1]
+	code, body := handleFHIRRequest(request.HTTPMethod, fhirRequest{Base: base, Path: request.Path[idx+len(FHIR_PATH)+2:], Params: params, Body: []byte(request.Body), Authorization: request.Headers[tukcnst.AUTHORIZATION]})
+	i := TukEvent{}
+	headers := i.setAwsResponseHeaders()
+	headers[tukcnst.CONTENT_TYPE] = APPLICATION_FHIR_JSON
+	return &events.APIGatewayProxyResponse{StatusCode: code, Headers: headers, Body: string(body)}
+}
+func isFHIRRequest(path string) bool {
+	return strings.Contains(path, "/"+FHIR_PATH+"/")
+}
+
+// handleFHIRRequest returns the http status code and json of the resource, search bundle or operation outcome
+func handleFHIRRequest(method string, req fhirRequest) (int, []byte) {
+	var rslt interface{}
+	var err error
+	code := http.StatusOK
+	parts := strings.Split(strings.Trim(req.Path, "/"), "/")
+	switch {
+	case parts[0] == FHIR_RESOURCE_SUBSCRIPTION:
+		code, rslt, err = req.subscription(method, parts)
+	case method != http.MethodGet:
+		code, err = http.StatusMethodNotAllowed, errors.New("only read and search interactions are supported for "+parts[0])
+	case len(parts) > 2:
+		code, err = http.StatusBadRequest, errors.New("invalid fhir request "+req.Path)
+	case len(parts) == 2:
+		rslt, err = req.read(parts[0], parts[1])
+		if err != nil {
+			code = http.StatusNotFound
+		}
+	default:
+		rslt, err = req.search(parts[0])
+		if err != nil {
+			code = http.StatusBadRequest
+		}
+	}
+	if err != nil {
+		log.Println(err.Error())
+		rslt = newFHIROperationOutcome(code, err)
+	}
+	b, err := json.MarshalIndent(rslt, "", "  ")
+	if err != nil {
+		log.Println(err.Error())
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+	return code, b
+}
+func newFHIROperationOutcome(code int, err error) FHIROperationOutcome {
+	issue := FHIROperationOutcomeIssue{Severity: FHIR_ISSUE_SEVERITY_ERROR, Code: FHIR_ISSUE_CODE_INVALID, Diagnostics: err.Error()}
+	switch code {
+	case http.StatusNotFound:
+		issue.Code = FHIR_ISSUE_CODE_NOT_FOUND
+	case http.StatusMethodNotAllowed:
+		issue.Code = FHIR_ISSUE_CODE_NOT_SUPPORTED
+	case http.StatusInternalServerError:
+		issue.Code = FHIR_ISSUE_CODE_EXCEPTION
+	}
+	return FHIROperationOutcome{ResourceType: FHIR_RESOURCE_OPERATION_OUTCOME, Issue: []FHIROperationOutcomeIssue{issue}}
+}
+
+// read returns the CarePlan with the workflow id or the Task with the id workflowid-taskid
+func (r fhirRequest) read(resource string, id string) (interface{}, error) {
+	wfid, taskid, _ := strings.Cut(id, "-")
+	wf, err := getWorkflow(int64(tukutil.GetIntFromString(wfid)))
+	if err != nil {
+		return nil, errors.New(resource + "/" + id + " not found")
+	}
+	careplan, err := newFHIRCarePlan(wf)
+	if err != nil {
+		return nil, err
+	}
+	switch resource {
+	case FHIR_RESOURCE_CAREPLAN:
+		if taskid == "" {
+			return careplan, nil
+		}
+	case FHIR_RESOURCE_TASK:
+		for _, task := range careplan.Contained {
+			if task.Id == id {
+				return careplan.taskResource(task), nil
+			}
+		}
+	default:
+		return nil, errors.New("resource type " + resource + " is not supported")
+	}
+	return nil, errors.New(resource + "/" + id + " not found")
+}
+
+// search returns a searchset bundle of the CarePlans or Tasks matching the search params. The search params are applied in sql, Tasks
+// being selected from the workflow documents with JSON_TABLE, so that the bundle total is the count of all matching resources
+func (r fhirRequest) search(resource string) (FHIRBundle, error) {
+	bundle := FHIRBundle{ResourceType: FHIR_RESOURCE_BUNDLE, Type: FHIR_BUNDLE_TYPE_SEARCHSET, Entry: []FHIRBundleEntry{}}
+	count := tukutil.GetIntFromString(r.Params.Get(FHIR_SEARCH_PARAM_COUNT))
+	if count <= 0 {
+		count = DEFAULT_PAGE_LIMIT
+	}
+	if count > MAX_QUERY_LIMIT {
+		count = MAX_QUERY_LIMIT
+	}
+	offset := tukutil.GetIntFromString(r.Params.Get(FHIR_SEARCH_PARAM_OFFSET))
+	if offset < 0 {
+		offset = 0
+	}
+	if resource != FHIR_RESOURCE_CAREPLAN && resource != FHIR_RESOURCE_TASK {
+		return bundle, errors.New("resource type " + resource + " is not supported")
+	}
+	from, where, params := r.where(resource)
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelCtx()
+	if err := tukdbint.DBConn.QueryRowContext(ctx, "SELECT COUNT(*)"+from+where, params...).Scan(&bundle.Total); err != nil {
+		log.Println(err.Error())
+		return bundle, err
+	}
+	cols, orderby := "w.id, w.pathway, w.nhsid, w.created, w.xdw_uid, w.xdw_doc, ''", " ORDER BY w.created DESC, w.id DESC"
+	if resource == FHIR_RESOURCE_TASK {
+		cols, orderby = "w.id, w.pathway, w.nhsid, w.created, w.xdw_uid, w.xdw_doc, COALESCE(t.taskid, '')", orderby+", t.seq"
+	}
+	rows, err := tukdbint.DBConn.QueryContext(ctx, "SELECT "+cols+from+where+orderby+" LIMIT ? OFFSET ?", append(params, count, offset)...)
+	if err != nil {
+		log.Println(err.Error())
+		return bundle, err
+	}
+	defer rows.Close()
+	careplans := make(map[int64]FHIRCarePlan)
+	for rows.Next() {
+		var taskid string
+		wf := tukdbint.Workflow{}
+		if err := rows.Scan(&wf.Id, &wf.Pathway, &wf.NHSId, &wf.Created, &wf.XDW_UID, &wf.XDW_Doc, &taskid); err != nil {
+			log.Println(err.Error())
+			return bundle, err
+		}
+		careplan, ok := careplans[wf.Id]
+		if !ok {
+			if careplan, err = newFHIRCarePlan(wf); err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			careplans[wf.Id] = careplan
+		}
+		if resource == FHIR_RESOURCE_CAREPLAN {
+			bundle.Entry = append(bundle.Entry, FHIRBundleEntry{FullURL: r.Base + "/" + resource + "/" + careplan.Id, Resource: careplan, Search: FHIRBundleSearch{Mode: FHIR_BUNDLE_SEARCH_MODE_MATCH}})
+			continue
+		}
+		for _, task := range careplan.Contained {
+			if task.Id == careplan.Id+"-"+taskid {
+				bundle.Entry = append(bundle.Entry, FHIRBundleEntry{FullURL: r.Base + "/" + resource + "/" + task.Id, Resource: careplan.taskResource(task), Search: FHIRBundleSearch{Mode: FHIR_BUNDLE_SEARCH_MODE_MATCH}})
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Println(err.Error())
+		return bundle, err
+	}
+	bundle.Link = append(bundle.Link, FHIRBundleLink{Relation: FHIR_BUNDLE_LINK_SELF, URL: r.pageURL(resource, count, offset)})
+	if offset+count < bundle.Total {
+		bundle.Link = append(bundle.Link, FHIRBundleLink{Relation: FHIR_BUNDLE_LINK_NEXT, URL: r.pageURL(resource, count, offset+count)})
+	}
+	return bundle, nil
+}
+
+// where returns the from and where clauses and params of the search. CarePlans are selected by patient, pathway, _id, based-on and status.
+// Tasks are additionally selected by owner and code
+func (r fhirRequest) where(resource string) (string, string, []interface{}) {
+	var conds []string
+	var params []interface{}
+	add := func(cond string, param ...interface{}) {
+		conds = append(conds, cond)
+		params = append(params, param...)
+	}
+	from := " FROM workflows w"
+	if resource == FHIR_RESOURCE_TASK {
+		from = from + ", " + FHIR_TASK_TABLE
+	}
+	if pathway := r.Params.Get(FHIR_SEARCH_PARAM_CATEGORY); pathway != "" {
+		add("w.pathway = ?", pathway)
+	} else if pathway := r.Params.Get(tukcnst.TUK_EVENT_QUERY_PARAM_PATHWAY); pathway != "" {
+		add("w.pathway = ?", pathway)
+	}
+	if nhsid := fhirPatientId(r.Params); nhsid != "" {
+		add("w.nhsid = ?", nhsid)
+	}
+	if id := r.Params.Get(FHIR_SEARCH_PARAM_ID); id != "" {
+		wfid, taskid, istask := strings.Cut(id, "-")
+		add("w.id = ?", tukutil.GetIntFromString(wfid))
+		if istask && resource == FHIR_RESOURCE_TASK {
+			add("t.taskid = ?", taskid)
+		}
+	}
+	if basedon := r.Params.Get(FHIR_SEARCH_PARAM_BASED_ON); basedon != "" {
+		add("w.id = ?", tukutil.GetIntFromString(strings.TrimPrefix(basedon, FHIR_RESOURCE_CAREPLAN+"/")))
+	}
+	if statuses := r.Params.Get(FHIR_SEARCH_PARAM_STATUS); statuses != "" {
+		var statusconds []string
+		for _, status := range strings.Split(statuses, ",") {
+			cond, statusparams := fhirStatusCondition(resource, status)
+			statusconds = append(statusconds, cond)
+			params = append(params, statusparams...)
+		}
+		conds = append(conds, "("+strings.Join(statusconds, " OR ")+")")
+	}
+	if resource == FHIR_RESOURCE_TASK {
+		if owner := r.Params.Get(FHIR_SEARCH_PARAM_OWNER); owner != "" {
+			add("LOWER(t.owner) = LOWER(?)", owner)
+		}
+		if code := r.Params.Get(FHIR_SEARCH_PARAM_CODE); code != "" {
+			add("LOWER(t.name) = LOWER(?)", code)
+		}
+	}
+	if len(conds) == 0 {
+		return from, "", params
+	}
+	return from, " WHERE " + strings.Join(conds, " AND "), params
+}
+
+// fhirStatusCondition returns the sql condition and params selecting the CarePlans or Tasks with the FHIR status. The condition is the
+// inverse of fhirCarePlanStatus and fhirTaskStatus. Unknown statuses match nothing
+func fhirStatusCondition(resource string, status string) (string, []interface{}) {
+	held := []interface{}{WORKFLOW_STATUS_SUSPENDED, WORKFLOW_STATUS_CANCELLED}
+	if resource == FHIR_RESOURCE_CAREPLAN {
+		switch status {
+		case FHIR_CAREPLAN_STATUS_COMPLETED:
+			return "w.status = ?", []interface{}{tukcnst.CLOSED}
+		case FHIR_CAREPLAN_STATUS_ON_HOLD:
+			return "w.status = ?", []interface{}{WORKFLOW_STATUS_SUSPENDED}
+		case FHIR_CAREPLAN_STATUS_REVOKED:
+			return "w.status = ?", []interface{}{WORKFLOW_STATUS_CANCELLED}
+		case FHIR_CAREPLAN_STATUS_ACTIVE:
+			return "w.status NOT IN (?, ?, ?)", []interface{}{tukcnst.CLOSED, WORKFLOW_STATUS_SUSPENDED, WORKFLOW_STATUS_CANCELLED}
+		}
+		return "FALSE", nil
+	}
+	switch status {
+	case FHIR_TASK_STATUS_COMPLETED:
+		return "COALESCE(t.status, '') = ?", []interface{}{tukcnst.COMPLETE}
+	case FHIR_TASK_STATUS_ON_HOLD:
+		return "(COALESCE(t.status, '') != ? AND w.status = ?)", []interface{}{tukcnst.COMPLETE, WORKFLOW_STATUS_SUSPENDED}
+	case FHIR_TASK_STATUS_CANCELLED:
+		return "(COALESCE(t.status, '') != ? AND w.status = ?)", []interface{}{tukcnst.COMPLETE, WORKFLOW_STATUS_CANCELLED}
+	case FHIR_TASK_STATUS_READY:
+		return "(COALESCE(t.status, '') = ? AND w.status NOT IN (?, ?))", append([]interface{}{tukcnst.READY}, held...)
+	case FHIR_TASK_STATUS_IN_PROGRESS:
+		return "(COALESCE(t.status, '') = ? AND w.status NOT IN (?, ?))", append([]interface{}{tukcnst.IN_PROGRESS}, held...)
+	case FHIR_TASK_STATUS_REQUESTED:
+		return "(COALESCE(t.status, '') NOT IN (?, ?, ?) AND w.status NOT IN (?, ?))", append([]interface{}{tukcnst.COMPLETE, tukcnst.READY, tukcnst.IN_PROGRESS}, held...)
+	}
+	return "FALSE", nil
+}
+func (r fhirRequest) pageURL(resource string, count int, offset int) string {
+	q := url.Values{}
+	for key, vals := range r.Params {
+		q[key] = vals
+	}
+	q.Set(FHIR_SEARCH_PARAM_COUNT, strconv.Itoa(count))
+	q.Set(FHIR_SEARCH_PARAM_OFFSET, strconv.Itoa(offset))
+	return r.Base + "/" + resource + "?" + q.Encode()
+}
+
+// fhirPatientId returns the nhs id of the patient or subject param. The param can be a Patient reference, a token with the nhs number
+// system or an nhs id
+func fhirPatientId(params url.Values) string {
+	patient := params.Get(FHIR_SEARCH_PARAM_PATIENT)
+	if patient == "" {
+		patient = params.Get(FHIR_SEARCH_PARAM_SUBJECT)
+	}
+	patient = strings.TrimPrefix(patient, FHIR_RESOURCE_PATIENT+"/")
+	if _, nhsid, ok := strings.Cut(patient, "|"); ok {
+		return nhsid
+	}
+	return patient
+}
+
+// newFHIRCarePlan maps the workflow document to a CarePlan with the workflow tasks as contained Tasks
+func newFHIRCarePlan(wf tukdbint.Workflow) (FHIRCarePlan, error) {
+	doc := tukxdw.WorkflowDocument{}
+	if err := json.Unmarshal([]byte(wf.XDW_Doc), &doc); err != nil {
+		return FHIRCarePlan{}, err
+	}
+	id := strconv.FormatInt(wf.Id, 10)
+	wfstatus := doc.WorkflowStatus
+	patient := FHIRReference{Type: FHIR_RESOURCE_PATIENT, Identifier: &FHIRIdentifier{System: FHIR_SYSTEM_NHS_NUMBER, Value: wf.NHSId}}
+	careplan := FHIRCarePlan{
+		ResourceType: FHIR_RESOURCE_CAREPLAN,
+		Id:           id,
+		Status:       fhirCarePlanStatus(wfstatus),
+		Intent:       FHIR_CAREPLAN_INTENT_PLAN,
+		Category:     []FHIRCodeableConcept{{Text: wf.Pathway}},
+		Title:        wf.Pathway,
+		Subject:      patient,
+		Period:       FHIRPeriod{Start: doc.EffectiveTime.Value},
+		Created:      wf.Created,
+	}
+	if wf.XDW_UID != "" {
+		careplan.Identifier = append(careplan.Identifier, FHIRIdentifier{System: FHIR_SYSTEM_URI, Value: "urn:oid:" + wf.XDW_UID})
+	}
+	if doc.WorkflowDefinitionReference != "" {
+		careplan.InstantiatesCanonical = append(careplan.InstantiatesCanonical, doc.WorkflowDefinitionReference)
+	}
+	author := doc.Author.AssignedAuthor
+	if author.ID.Extension != "" || author.AssignedPerson.Name.Family != "" {
+		careplan.Author = &FHIRReference{Display: strings.TrimSpace(author.AssignedPerson.Name.Prefix + " " + author.AssignedPerson.Name.Family)}
+		if author.ID.Extension != "" {
+			careplan.Author.Identifier = &FHIRIdentifier{System: FHIR_SYSTEM_ODS_CODE, Value: author.ID.Extension}
+		}
+	}
+	for _, ev := range doc.WorkflowStatusHistory.DocumentEvent {
+		careplan.Note = append(careplan.Note, FHIRAnnotation{AuthorString: ev.Author, Time: ev.EventTime, Text: ev.EventType + " task " + ev.TaskEventIdentifier + " " + ev.PreviousStatus + " to " + ev.ActualStatus})
+		if careplan.Status == FHIR_CAREPLAN_STATUS_COMPLETED && ev.EventTime > careplan.Period.End {
+			careplan.Period.End = ev.EventTime
+		}
+	}
+	for _, xdwtask := range doc.TaskList.XDWTask {
+		task := newFHIRTask(id, xdwtask, wfstatus)
+		task.For = patient
+		task.Requester = careplan.Author
+		careplan.Contained = append(careplan.Contained, task)
+		careplan.Activity = append(careplan.Activity, FHIRCarePlanActivity{Reference: FHIRReference{Reference: "#" + task.Id, Display: task.Code.Text}})
+	}
+	return careplan, nil
+}
+
+// taskResource returns the contained task as a Task resource based on the CarePlan
+func (c FHIRCarePlan) taskResource(task FHIRTask) FHIRTask {
+	task.BasedOn = []FHIRReference{{Reference: FHIR_RESOURCE_CAREPLAN + "/" + c.Id, Display: c.Title}}
+	return task
+}
+func newFHIRTask(careplanid string, xdwtask tukxdw.XDWTask, wfstatus string) FHIRTask {
+	details := xdwtask.TaskData.TaskDetails
+	task := FHIRTask{
+		ResourceType:   FHIR_RESOURCE_TASK,
+		Id:             careplanid + "-" + details.ID,
+		Status:         fhirTaskStatus(details.Status, wfstatus),
+		BusinessStatus: FHIRCodeableConcept{Text: details.Status},
+		Intent:         FHIR_TASK_INTENT_ORDER,
+		Code:           FHIRCodeableConcept{Text: details.Name},
+		Description:    xdwtask.TaskData.Description,
+		AuthoredOn:     details.CreatedTime,
+		LastModified:   details.LastModifiedTime,
+	}
+	if details.ActivationTime != "" {
+		task.ExecutionPeriod = &FHIRPeriod{Start: details.ActivationTime}
+		if details.Status == tukcnst.COMPLETE {
+			task.ExecutionPeriod.End = details.LastModifiedTime
+		}
+	}
+	if details.ActualOwner != "" {
+		task.Owner = &FHIRReference{Display: details.ActualOwner}
+	}
+	for _, in := range xdwtask.TaskData.Input {
+		if in.Part.AttachmentInfo.Identifier != "" {
+			task.Input = append(task.Input, newFHIRTaskParameter(in.Part))
+		}
+	}
+	for _, out := range xdwtask.TaskData.Output {
+		if out.Part.AttachmentInfo.Identifier != "" {
+			task.Output = append(task.Output, newFHIRTaskParameter(out.Part))
+		}
+	}
+	for _, ev := range xdwtask.TaskEventHistory.TaskEvent {
+		task.Note = append(task.Note, FHIRAnnotation{Time: ev.EventTime, Text: ev.EventType + " " + ev.Status + " " + ev.Identifier})
+	}
+	return task
+}
+func newFHIRTaskParameter(part tukxdw.Part) FHIRTaskParameter {
+	return FHIRTaskParameter{
+		Type: FHIRCodeableConcept{Text: part.Name},
+		ValueReference: FHIRReference{
+			Type:       "DocumentReference",
+			Identifier: &FHIRIdentifier{System: FHIR_SYSTEM_URI, Value: "urn:oid:" + part.AttachmentInfo.Identifier},
+			Display:    strings.TrimSpace(part.AttachmentInfo.Name + " " + part.AttachmentInfo.AttachedTime + " " + part.AttachmentInfo.AttachedBy),
+		},
+	}
+}
+func fhirCarePlanStatus(wfstatus string) string {
+	switch wfstatus {
+	case tukcnst.CLOSED:
+		return FHIR_CAREPLAN_STATUS_COMPLETED
+	case WORKFLOW_STATUS_SUSPENDED:
+		return FHIR_CAREPLAN_STATUS_ON_HOLD
+	case WORKFLOW_STATUS_CANCELLED:
+		return FHIR_CAREPLAN_STATUS_REVOKED
+	}
+	return FHIR_CAREPLAN_STATUS_ACTIVE
+}
+
+// fhirTaskStatus maps the XDW task status to the FHIR task status. Open tasks of suspended or cancelled workflows are on hold or cancelled
+func fhirTaskStatus(status string, wfstatus string) string {
+	if status == tukcnst.COMPLETE {
+		return FHIR_TASK_STATUS_COMPLETED
+	}
+	switch wfstatus {
+	case WORKFLOW_STATUS_SUSPENDED:
+		return FHIR_TASK_STATUS_ON_HOLD
+	case WORKFLOW_STATUS_CANCELLED:
+		return FHIR_TASK_STATUS_CANCELLED
+	}
+	switch status {
+	case tukcnst.READY:
+		return FHIR_TASK_STATUS_READY
+	case tukcnst.IN_PROGRESS:
+		return FHIR_TASK_STATUS_IN_PROGRESS
+	}
+	return FHIR_TASK_STATUS_REQUESTED
+}
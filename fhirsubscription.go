@@ -0,0 +1,483 @@
+package tukint
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukutil"
+)
+
+const (
+	FHIR_RESOURCE_SUBSCRIPTION          = "Subscription"
+	FHIR_RESOURCE_SUBSCRIPTION_STATUS   = "SubscriptionStatus"
+	FHIR_OPERATION_STATUS               = "$status"
+	FHIR_TOPIC_WORKFLOW_CREATED         = "workflow-created"
+	FHIR_TOPIC_WORKFLOW_CHANGED         = "workflow-changed"
+	FHIR_TOPIC_WORKFLOW_STATUS_CHANGED  = "workflow-status-changed"
+	FHIR_TOPIC_WORKFLOW_OVERDUE         = "workflow-overdue"
+	FHIR_TOPIC_WORKFLOW_ESCALATED       = "workflow-escalated"
+	FHIR_SUBSCRIPTION_STATUS_ACTIVE     = "active"
+	FHIR_SUBSCRIPTION_STATUS_ERROR      = "error"
+	FHIR_SUBSCRIPTION_STATUS_OFF        = "off"
+	FHIR_CHANNEL_REST_HOOK              = "rest-hook"
+	FHIR_CHANNEL_SYSTEM                 = "http://terminology.hl7.org/CodeSystem/subscription-channel-type"
+	FHIR_CONTENT_EMPTY                  = "empty"
+	FHIR_CONTENT_ID_ONLY                = "id-only"
+	FHIR_CONTENT_FULL_RESOURCE          = "full-resource"
+	FHIR_FILTER_PATHWAY                 = "pathway"
+	FHIR_FILTER_PATIENT                 = "patient"
+	FHIR_BUNDLE_TYPE_NOTIFICATION       = "subscription-notification"
+	FHIR_NOTIFICATION_EVENT             = "event-notification"
+	FHIR_NOTIFICATION_RETRIES           = 5
+	FHIR_NOTIFICATION_BACKOFF           = 30 * time.Second
+	FHIR_NOTIFICATION_TIMEOUT           = 10 * time.Second
+	FHIR_DELIVERY_STATUS_DELIVERED      = "DELIVERED"
+	FHIR_DELIVERY_STATUS_FAILED         = "FAILED"
+	FHIR_SUBSCRIPTION_MAX_FAILURES      = 3
+	FHIR_SUBSCRIPTION_DEFAULT_CONTENT   = FHIR_CONTENT_ID_ONLY
+	FHIR_SUBSCRIPTION_ENDPOINT_MAX_SIZE = 1024
+)
+
+var fhirTopics = []string{FHIR_TOPIC_WORKFLOW_CREATED, FHIR_TOPIC_WORKFLOW_CHANGED, FHIR_TOPIC_WORKFLOW_STATUS_CHANGED, FHIR_TOPIC_WORKFLOW_OVERDUE, FHIR_TOPIC_WORKFLOW_ESCALATED}
+
+// FHIRNotifier delivers the pending FHIR subscription notifications. Each delivery is attempted up to Retries times, with exponential
+// backoff from Backoff between attempts. Client does not follow redirects so that notifications are only posted to registered endpoints
+type FHIRNotifier struct {
+	Client  *http.Client
+	Retries int
+	Backoff time.Duration
+}
+
+// FHIRNotifications is the notifier used to deliver FHIR subscription notifications. It can be replaced, eg. to deliver to a test receiver
+var FHIRNotifications = &FHIRNotifier{
+	Client: &http.Client{
+		Timeout: FHIR_NOTIFICATION_TIMEOUT,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	},
+	Retries: FHIR_NOTIFICATION_RETRIES,
+	Backoff: FHIR_NOTIFICATION_BACKOFF,
+}
+
+// FHIRSubscription is an R5 topic based Subscription. Topic is the canonical url or code of a workflow topic, one of workflow-created,
+// workflow-changed, workflow-status-changed, workflow-overdue or workflow-escalated. Notifications can be filtered by pathway and patient nhs id
+type FHIRSubscription struct {
+	ResourceType string                   `json:"resourceType"`
+	Id           string                   `json:"id,omitempty"`
+	Status       string                   `json:"status"`
+	Topic        string                   `json:"topic"`
+	Reason       string                   `json:"reason,omitempty"`
+	End          string                   `json:"end,omitempty"`
+	FilterBy     []FHIRSubscriptionFilter `json:"filterBy,omitempty"`
+	ChannelType  FHIRCoding               `json:"channelType"`
+	Endpoint     string                   `json:"endpoint"`
+	Header       []string                 `json:"header,omitempty"`
+	ContentType  string                   `json:"contentType,omitempty"`
+	Content      string                   `json:"content,omitempty"`
+}
+type FHIRSubscriptionFilter struct {
+	FilterParameter string `json:"filterParameter"`
+	Value           string `json:"value"`
+}
+type FHIRCoding struct {
+	System string `json:"system,omitempty"`
+	Code   string `json:"code"`
+}
+type FHIRSubscriptionStatus struct {
+	ResourceType                 string                  `json:"resourceType"`
+	Status                       string                  `json:"status"`
+	Type                         string                  `json:"type"`
+	EventsSinceSubscriptionStart int                     `json:"eventsSinceSubscriptionStart"`
+	NotificationEvent            []FHIRNotificationEvent `json:"notificationEvent,omitempty"`
+	Subscription                 FHIRReference           `json:"subscription"`
+	Topic                        string                  `json:"topic"`
+	Error                        []FHIRCodeableConcept   `json:"error,omitempty"`
+}
+type FHIRNotificationEvent struct {
+	EventNumber int           `json:"eventNumber"`
+	Timestamp   string        `json:"timestamp"`
+	Focus       FHIRReference `json:"focus"`
+}
+
+// fhirSubscription is a persisted FHIR subscription
+type fhirSubscription struct {
+	Id           int64
+	Created      string
+	Status       string
+	Topic        string
+	Pathway      string
+	NHSId        string
+	Endpoint     string
+	Header       string
+	Content      string
+	Reason       string
+	End          string
+	EventCount   int
+	Failures     int
+	LastDelivery string
+	LastError    string
+}
+
+// fhirDelivery is a persisted notification of a workflow to a FHIR subscription, pending until it is delivered or has failed
+type fhirDelivery struct {
+	Id             int64
+	Created        string
+	SubscriptionId int64
+	WorkflowId     int64
+	EventNumber    int
+	Status         string
+	Attempts       int
+	NextAttempt    string
+	LastError      string
+	Delivered      string
+}
+
+// subscription handles the FHIR Subscription create, read, search, delete and $status interactions. Requests must have the bearer token
+// configured as the event service fhirsubscriptiontoken
+func (r fhirRequest) subscription(method string, parts []string) (int, interface{}, error) {
+	if err := r.authorizeSubscription(); err != nil {
+		return http.StatusForbidden, nil, err
+	}
+	switch {
+	case method == http.MethodPost && len(parts) == 1:
+		sub, err := r.newFHIRSubscription()
+		if err != nil {
+			return http.StatusBadRequest, nil, err
+		}
+		if err = setFHIRSubscription(&sub); err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		log.Printf("Created FHIR Subscription %v to %s for pathway %s nhs id %s. Endpoint %s", sub.Id, sub.Topic, sub.Pathway, sub.NHSId, sub.Endpoint)
+		return http.StatusCreated, sub.resource(), nil
+	case method == http.MethodGet && len(parts) == 1:
+		subs, err := getFHIRSubscriptions("")
+		if err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		bundle := FHIRBundle{ResourceType: FHIR_RESOURCE_BUNDLE, Type: FHIR_BUNDLE_TYPE_SEARCHSET, Total: len(subs), Entry: []FHIRBundleEntry{}}
+		for _, sub := range subs {
+			bundle.Entry = append(bundle.Entry, FHIRBundleEntry{FullURL: r.Base + "/" + FHIR_RESOURCE_SUBSCRIPTION + "/" + strconv.FormatInt(sub.Id, 10), Resource: sub.resource(), Search: FHIRBundleSearch{Mode: FHIR_BUNDLE_SEARCH_MODE_MATCH}})
+		}
+		return http.StatusOK, bundle, nil
+	case len(parts) == 1:
+		return http.StatusMethodNotAllowed, nil, errors.New(method + " " + r.Path + " is not supported")
+	}
+	sub, err := getFHIRSubscription(int64(tukutil.GetIntFromString(parts[1])))
+	if err != nil {
+		return http.StatusNotFound, nil, errors.New(FHIR_RESOURCE_SUBSCRIPTION + "/" + parts[1] + " not found")
+	}
+	switch {
+	case method == http.MethodGet && len(parts) == 2:
+		return http.StatusOK, sub.resource(), nil
+	case method == http.MethodGet && len(parts) == 3 && parts[2] == FHIR_OPERATION_STATUS:
+		return http.StatusOK, sub.status(nil), nil
+	case method == http.MethodDelete && len(parts) == 2:
+		if err = deleteFHIRSubscription(sub.Id); err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		log.Printf("Deleted FHIR Subscription %v", sub.Id)
+		sub.Status = FHIR_SUBSCRIPTION_STATUS_OFF
+		return http.StatusOK, sub.resource(), nil
+	}
+	return http.StatusMethodNotAllowed, nil, errors.New(method + " " + r.Path + " is not supported")
+}
+
+// newFHIRSubscription validates the Subscription resource in the request body
+func (r fhirRequest) newFHIRSubscription() (fhirSubscription, error) {
+	res := FHIRSubscription{}
+	sub := fhirSubscription{Created: tukutil.Time_Now(), Status: FHIR_SUBSCRIPTION_STATUS_ACTIVE}
+	if err := json.Unmarshal(r.Body, &res); err != nil {
+		return sub, err
+	}
+	if res.ResourceType != FHIR_RESOURCE_SUBSCRIPTION {
+		return sub, errors.New("resource type must be " + FHIR_RESOURCE_SUBSCRIPTION)
+	}
+	if res.ChannelType.Code != FHIR_CHANNEL_REST_HOOK {
+		return sub, errors.New("only the " + FHIR_CHANNEL_REST_HOOK + " channel type is supported")
+	}
+	if len(res.Endpoint) > FHIR_SUBSCRIPTION_ENDPOINT_MAX_SIZE || !isAllowedFHIREndpoint(res.Endpoint) {
+		return sub, errors.New("subscription endpoint " + res.Endpoint + " is not an allowed endpoint")
+	}
+	sub.Topic = res.Topic[strings.LastIndex(res.Topic, "/")+1:]
+	if !containsString(fhirTopics, sub.Topic) {
+		return sub, errors.New("unknown subscription topic " + res.Topic + ". supported topics are " + strings.Join(fhirTopics, ", "))
+	}
+	switch res.Content {
+	case "":
+		sub.Content = FHIR_SUBSCRIPTION_DEFAULT_CONTENT
+	case FHIR_CONTENT_EMPTY, FHIR_CONTENT_ID_ONLY, FHIR_CONTENT_FULL_RESOURCE:
+		sub.Content = res.Content
+	default:
+		return sub, errors.New("invalid subscription content " + res.Content)
+	}
+	for _, filter := range res.FilterBy {
+		switch filter.FilterParameter {
+		case FHIR_FILTER_PATHWAY, FHIR_SEARCH_PARAM_CATEGORY:
+			sub.Pathway = filter.Value
+		case FHIR_FILTER_PATIENT, FHIR_SEARCH_PARAM_SUBJECT:
+			sub.NHSId = fhirPatientId(url.Values{FHIR_SEARCH_PARAM_PATIENT: {filter.Value}})
+		default:
+			return sub, errors.New("unsupported subscription filter " + filter.FilterParameter)
+		}
+	}
+	for _, header := range res.Header {
+		if !strings.Contains(header, ":") {
+			return sub, errors.New("invalid subscription header " + header)
+		}
+	}
+	sub.Endpoint = res.Endpoint
+	sub.Header = strings.Join(res.Header, "\n")
+	sub.Reason = res.Reason
+	sub.End = res.End
+	return sub, nil
+}
+
+// authorizeSubscription returns an error if the request does not have the configured subscription bearer token. Subscriptions cannot be
+// managed if no token is configured
+func (r fhirRequest) authorizeSubscription() error {
+	token := Services.EventService.FHIRSubscriptionToken
+	if token == "" {
+		return errors.New("fhir subscriptions are not enabled")
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Authorization), []byte("Bearer "+token)) != 1 {
+		return errors.New("fhir subscription requests require a valid bearer token")
+	}
+	return nil
+}
+
+// isAllowedFHIREndpoint returns true if the endpoint has the scheme and host, and the path or a path below it, of one of the event service
+// fhirsubscriptionendpoints. Notifications are only posted to allowed endpoints
+func isAllowedFHIREndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.User != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	for _, allowed := range Services.EventService.FHIRSubscriptionEndpoints {
+		a, err := url.Parse(allowed)
+		if err == nil && strings.EqualFold(a.Scheme, u.Scheme) && strings.EqualFold(a.Host, u.Host) && (u.Path == a.Path || strings.HasPrefix(u.Path, strings.TrimSuffix(a.Path, "/")+"/")) {
+			return true
+		}
+	}
+	return false
+}
+func (s fhirSubscription) resource() FHIRSubscription {
+	res := FHIRSubscription{
+		ResourceType: FHIR_RESOURCE_SUBSCRIPTION,
+		Id:           strconv.FormatInt(s.Id, 10),
+		Status:       s.Status,
+		Topic:        s.Topic,
+		Reason:       s.Reason,
+		End:          s.End,
+		ChannelType:  FHIRCoding{System: FHIR_CHANNEL_SYSTEM, Code: FHIR_CHANNEL_REST_HOOK},
+		Endpoint:     s.Endpoint,
+		ContentType:  APPLICATION_FHIR_JSON,
+		Content:      s.Content,
+	}
+	if s.Pathway != "" {
+		res.FilterBy = append(res.FilterBy, FHIRSubscriptionFilter{FilterParameter: FHIR_FILTER_PATHWAY, Value: s.Pathway})
+	}
+	if s.NHSId != "" {
+		res.FilterBy = append(res.FilterBy, FHIRSubscriptionFilter{FilterParameter: FHIR_FILTER_PATIENT, Value: FHIR_RESOURCE_PATIENT + "/" + s.NHSId})
+	}
+	return res
+}
+func (s fhirSubscription) status(events []FHIRNotificationEvent) FHIRSubscriptionStatus {
+	status := FHIRSubscriptionStatus{
+		ResourceType:                 FHIR_RESOURCE_SUBSCRIPTION_STATUS,
+		Status:                       s.Status,
+		Type:                         FHIR_NOTIFICATION_EVENT,
+		EventsSinceSubscriptionStart: s.EventCount,
+		NotificationEvent:            events,
+		Subscription:                 FHIRReference{Reference: FHIR_RESOURCE_SUBSCRIPTION + "/" + strconv.FormatInt(s.Id, 10)},
+		Topic:                        s.Topic,
+	}
+	if events == nil && s.LastError != "" {
+		status.Error = append(status.Error, FHIRCodeableConcept{Text: s.LastDelivery + " " + s.LastError})
+	}
+	return status
+}
+
+// notifyWorkflowCreated notifies the FHIR subscribers of the workflow created topic
+func notifyWorkflowCreated(wf tukdbint.Workflow) {
+	notifyFHIRSubscribers(wf, []string{FHIR_TOPIC_WORKFLOW_CREATED})
+}
+
+// notifyWorkflowChanged notifies the FHIR subscribers of the workflow changed topic and, if the workflow status changed, the workflow
+// status changed topic
+func notifyWorkflowChanged(wf tukdbint.Workflow, prevstatus string) {
+	topics := []string{FHIR_TOPIC_WORKFLOW_CHANGED}
+	if prevstatus != wf.Status {
+		topics = append(topics, FHIR_TOPIC_WORKFLOW_STATUS_CHANGED)
+	}
+	notifyFHIRSubscribers(wf, topics)
+}
+
+// notifyFHIRSubscribers adds a pending notification of the workflow to each active subscription to the topics whose filters match the
+// workflow. Notifications are delivered by the notification workers, or by ProcessFHIRNotifications where no workers are running, so
+// that workflow updates, which hold the workflow lock, are not delayed by subscriber endpoints
+func notifyFHIRSubscribers(wf tukdbint.Workflow, topics []string) {
+	if tukdbint.DBConn == nil {
+		return
+	}
+	subs, err := getFHIRSubscriptions(FHIR_SUBSCRIPTION_STATUS_ACTIVE)
+	if err != nil {
+		return
+	}
+	cnt := 0
+	for _, sub := range subs {
+		if !containsString(topics, sub.Topic) || (sub.Pathway != "" && sub.Pathway != wf.Pathway) || (sub.NHSId != "" && sub.NHSId != wf.NHSId) {
+			continue
+		}
+		if sub.End != "" && !tukutil.IsAfterNow(sub.End) {
+			log.Printf("FHIR Subscription %v ended %s", sub.Id, sub.End)
+			setFHIRSubscriptionStatus(sub.Id, FHIR_SUBSCRIPTION_STATUS_OFF)
+			continue
+		}
+		eventnumber, err := nextFHIRSubscriptionEvent(sub.Id)
+		if err != nil {
+			continue
+		}
+		d := fhirDelivery{SubscriptionId: sub.Id, WorkflowId: wf.Id, EventNumber: eventnumber, Status: NOTIFICATION_STATUS_PENDING}
+		if err = setFHIRDelivery(&d); err == nil {
+			cnt++
+		}
+	}
+	if cnt == 0 {
+		return
+	}
+	log.Printf("Added %v FHIR Subscription notifications for %s workflow NHS ID %s", cnt, wf.Pathway, wf.NHSId)
+	select {
+	case inboxSignal <- struct{}{}:
+	default:
+	}
+}
+
+// ProcessFHIRNotifications delivers every FHIR subscription notification due. It is used where no notification workers are running, eg. by
+// the AWS scheduled event handler
+func ProcessFHIRNotifications() error {
+	if tukdbint.DBConn == nil {
+		return errors.New("no database connection available to deliver fhir notifications")
+	}
+	cnt := 0
+	for FHIRNotifications.deliverNext() {
+		cnt++
+	}
+	if cnt > 0 {
+		log.Printf("Processed %v FHIR Subscription notifications", cnt)
+	}
+	return nil
+}
+
+// deliverNext claims and posts the next notification due. Failed notifications are retried with exponential backoff until the notifier
+// retry limit. The subscription is set to error status after FHIR_SUBSCRIPTION_MAX_FAILURES consecutive failed notifications. It returns
+// false if no notification is due
+func (n *FHIRNotifier) deliverNext() bool {
+	d, err := claimFHIRDelivery()
+	if err != nil || d.Id == 0 {
+		return false
+	}
+	sub, err := getFHIRSubscription(d.SubscriptionId)
+	if err != nil || sub.Status != FHIR_SUBSCRIPTION_STATUS_ACTIVE {
+		log.Printf("FHIR Subscription %v is not active. Notification %v is not delivered", d.SubscriptionId, d.EventNumber)
+		d.Status = FHIR_DELIVERY_STATUS_FAILED
+		d.LastError = "subscription is not active"
+		setFHIRDeliveryStatus(&d)
+		return true
+	}
+	sub.EventCount = d.EventNumber
+	wf, err := getWorkflow(d.WorkflowId)
+	if err == nil {
+		err = n.post(sub, wf)
+	}
+	now := time.Now().UTC().Format(NOTIFICATION_TIME_FORMAT)
+	switch {
+	case err == nil:
+		log.Printf("Delivered FHIR Subscription %v %s notification %v for %s workflow NHS ID %s to %s", sub.Id, sub.Topic, d.EventNumber, wf.Pathway, wf.NHSId, sub.Endpoint)
+		d.Status, d.LastError, d.Delivered = FHIR_DELIVERY_STATUS_DELIVERED, "", now
+		setFHIRSubscriptionDelivered(sub.Id, tukutil.Time_Now())
+	case d.Attempts >= n.Retries:
+		log.Printf("FHIR Subscription %v notification %v failed %v attempts. %s", sub.Id, d.EventNumber, d.Attempts, err.Error())
+		d.Status, d.LastError = FHIR_DELIVERY_STATUS_FAILED, err.Error()
+		setFHIRSubscriptionFailed(sub.Id, tukutil.Time_Now(), err.Error())
+	default:
+		d.Status, d.LastError = NOTIFICATION_STATUS_PENDING, err.Error()
+		d.NextAttempt = time.Now().UTC().Add(n.Backoff * time.Duration(1<<(d.Attempts-1))).Format(NOTIFICATION_TIME_FORMAT)
+		log.Printf("FHIR Subscription %v notification %v attempt %v failed. Retrying at %s. %s", sub.Id, d.EventNumber, d.Attempts, d.NextAttempt, err.Error())
+	}
+	setFHIRDeliveryStatus(&d)
+	return true
+}
+
+// notification returns the subscription notification bundle. The CarePlan is included if the subscription content is full-resource
+func (s fhirSubscription) notification(wf tukdbint.Workflow) FHIRBundle {
+	careplanid := strconv.FormatInt(wf.Id, 10)
+	var events []FHIRNotificationEvent
+	if s.Content != FHIR_CONTENT_EMPTY {
+		events = append(events, FHIRNotificationEvent{EventNumber: s.EventCount, Timestamp: time.Now().Format(time.RFC3339), Focus: FHIRReference{Reference: FHIR_RESOURCE_CAREPLAN + "/" + careplanid}})
+	} else {
+		events = []FHIRNotificationEvent{}
+	}
+	base := Services.EventService.Scheme + "://" + Services.EventService.Host + ":" + tukutil.GetStringFromInt(Services.EventService.Port) + "/" + Services.EventService.BaseURLPath + "/" + FHIR_PATH
+	bundle := FHIRBundle{ResourceType: FHIR_RESOURCE_BUNDLE, Type: FHIR_BUNDLE_TYPE_NOTIFICATION}
+	bundle.Entry = append(bundle.Entry, FHIRBundleEntry{FullURL: base + "/" + FHIR_RESOURCE_SUBSCRIPTION + "/" + strconv.FormatInt(s.Id, 10) + "/" + FHIR_OPERATION_STATUS, Resource: s.status(events)})
+	if s.Content == FHIR_CONTENT_FULL_RESOURCE {
+		if careplan, err := newFHIRCarePlan(wf); err == nil {
+			bundle.Entry = append(bundle.Entry, FHIRBundleEntry{FullURL: base + "/" + FHIR_RESOURCE_CAREPLAN + "/" + careplanid, Resource: careplan})
+		} else {
+			log.Println(err.Error())
+		}
+	}
+	return bundle
+}
+
+// post posts the notification bundle of the workflow to the subscription endpoint
+func (n *FHIRNotifier) post(s fhirSubscription, wf tukdbint.Workflow) error {
+	if !isAllowedFHIREndpoint(s.Endpoint) {
+		return errors.New("subscription endpoint " + s.Endpoint + " is not an allowed endpoint")
+	}
+	body, err := json.Marshal(s.notification(wf))
+	if err != nil {
+		return err
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), FHIR_NOTIFICATION_TIMEOUT)
+	defer cancelCtx()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(tukcnst.CONTENT_TYPE, APPLICATION_FHIR_JSON)
+	for _, header := range strings.Split(s.Header, "\n") {
+		if name, value, ok := strings.Cut(header, ":"); ok {
+			req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+	rsp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return errors.New("subscriber endpoint returned " + rsp.Status)
+	}
+	return nil
+}
+func containsString(vals []string, val string) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
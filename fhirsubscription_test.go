@@ -0,0 +1,115 @@
+//go:build integration
+
+package tukint
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/ipthomas/tukcnst"
+)
+
+// testReceiver is a FHIR rest-hook subscriber endpoint that records the notifications it receives and returns status
+type testReceiver struct {
+	sync.Mutex
+	status        int
+	notifications []FHIRBundle
+}
+
+func (r *testReceiver) ServeHTTP(rsp http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	body, _ := io.ReadAll(req.Body)
+	bundle := FHIRBundle{}
+	if req.Header.Get(tukcnst.CONTENT_TYPE) == APPLICATION_FHIR_JSON && json.Unmarshal(body, &bundle) == nil {
+		r.notifications = append(r.notifications, bundle)
+	}
+	rsp.WriteHeader(r.status)
+}
+func (r *testReceiver) received() []FHIRBundle {
+	r.Lock()
+	defer r.Unlock()
+	return append([]FHIRBundle{}, r.notifications...)
+}
+func (r *testReceiver) setStatus(status int) {
+	r.Lock()
+	defer r.Unlock()
+	r.status = status
+}
+
+func TestFHIRSubscriptionDelivery(t *testing.T) {
+	db := newTestDB(t)
+	receiver := &testReceiver{status: http.StatusOK}
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+	eventService, notifier := Services.EventService, FHIRNotifications
+	defer func() { Services.EventService, FHIRNotifications = eventService, notifier }()
+	Services.EventService.FHIRSubscriptionToken = "testtoken"
+	Services.EventService.FHIRSubscriptionEndpoints = []string{srv.URL + "/notify"}
+	FHIRNotifications = &FHIRNotifier{Client: srv.Client(), Retries: 2}
+
+	subscribe := func(endpoint string, authorization string) int {
+		body := `{"resourceType": "Subscription", "topic": "workflow-changed", "channelType": {"code": "rest-hook"}, "endpoint": "` + endpoint + `", "filterBy": [{"filterParameter": "patient", "value": "Patient/9999999468"}]}`
+		code, _ := handleFHIRRequest(http.MethodPost, fhirRequest{Path: FHIR_RESOURCE_SUBSCRIPTION, Body: []byte(body), Authorization: authorization})
+		return code
+	}
+	if code := subscribe(srv.URL+"/notify", ""); code != http.StatusForbidden {
+		t.Errorf("subscription without a bearer token returned %v, expected %v", code, http.StatusForbidden)
+	}
+	if code := subscribe("http://169.254.169.254/latest/meta-data", "Bearer testtoken"); code != http.StatusBadRequest {
+		t.Errorf("subscription to an endpoint that is not allowed returned %v, expected %v", code, http.StatusBadRequest)
+	}
+	if code := subscribe(srv.URL+"/notifyother", "Bearer testtoken"); code != http.StatusBadRequest {
+		t.Errorf("subscription to an endpoint path that is not below the allowed path returned %v, expected %v", code, http.StatusBadRequest)
+	}
+	if code := subscribe(srv.URL+"/notify", "Bearer testtoken"); code != http.StatusCreated {
+		t.Fatalf("subscription returned %v, expected %v", code, http.StatusCreated)
+	}
+
+	wf := newTestWorkflow(t, "9999999468")
+	notifyWorkflowChanged(wf, wf.Status)
+	if cnt := len(receiver.received()); cnt != 0 {
+		t.Errorf("receiver received %v notifications before delivery, expected 0", cnt)
+	}
+	if err := ProcessFHIRNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	notifications := receiver.received()
+	if len(notifications) != 1 {
+		t.Fatalf("receiver received %v notifications, expected 1", len(notifications))
+	}
+	b, _ := json.Marshal(notifications[0].Entry[0].Resource)
+	status := FHIRSubscriptionStatus{}
+	json.Unmarshal(b, &status)
+	if len(status.NotificationEvent) != 1 || status.NotificationEvent[0].EventNumber != 1 || status.NotificationEvent[0].Focus.Reference != FHIR_RESOURCE_CAREPLAN+"/"+strconv.FormatInt(wf.Id, 10) {
+		t.Errorf("unexpected notification %s", string(b))
+	}
+	if deliveries := db.Rows(t, "fhirdeliveries"); len(deliveries) != 1 || deliveries[0]["status"] != FHIR_DELIVERY_STATUS_DELIVERED {
+		t.Errorf("notification was not recorded as delivered %v", deliveries)
+	}
+
+	receiver.setStatus(http.StatusInternalServerError)
+	notifyWorkflowChanged(wf, wf.Status)
+	if err := ProcessFHIRNotifications(); err != nil {
+		t.Fatal(err)
+	}
+	if cnt := len(receiver.received()); cnt != 3 {
+		t.Errorf("receiver received %v notifications, expected 3", cnt)
+	}
+	deliveries := db.Rows(t, "fhirdeliveries")
+	if len(deliveries) != 2 || deliveries[1]["status"] != FHIR_DELIVERY_STATUS_FAILED {
+		t.Errorf("failed notification was not recorded as failed %v", deliveries)
+	}
+	subs, err := getFHIRSubscriptions("")
+	if err != nil || len(subs) != 1 {
+		t.Fatal("subscription was not persisted")
+	}
+	if subs[0].Failures != 1 || subs[0].Status != FHIR_SUBSCRIPTION_STATUS_ACTIVE || subs[0].EventCount != 2 {
+		t.Errorf("subscription failures %v status %s event count %v, expected 1 %s 2", subs[0].Failures, subs[0].Status, subs[0].EventCount, FHIR_SUBSCRIPTION_STATUS_ACTIVE)
+	}
+}
@@ -0,0 +1,4 @@
+-- Full text search index of the events comments, authors, document name and expression used by the event search api.
+-- Creating the index locks the events table while it is built, so run this once before deploying event search rather
+-- than on service start
+CREATE FULLTEXT INDEX events_search ON events (comments, authors, docname, expression);
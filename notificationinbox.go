@@ -0,0 +1,318 @@
+package tukint
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukdsub"
+)
+
+const (
+	NOTIFICATION_STATUS_PENDING       = "PENDING"
+	NOTIFICATION_STATUS_PROCESSING    = "PROCESSING"
+	NOTIFICATION_STATUS_PROCESSED     = "PROCESSED"
+	NOTIFICATION_STATUS_DEAD_LETTER   = "DEAD_LETTER"
+	NOTIFICATION_STAGE_EVENTS_CREATED = "EVENTS_CREATED"
+	DEFAULT_NOTIFICATION_WORKERS      = 4
+	DEFAULT_NOTIFICATION_RETRIES      = 5
+	NOTIFICATION_RETRY_BACKOFF        = 30 * time.Second
+	NOTIFICATION_POLL_INTERVAL        = 10 * time.Second
+	TUK_TASK_NOTIFICATIONS            = "notifications"
+	TUK_TASK_REPLAY_NOTIFICATION      = "replaynotification"
+	TUK_TEMPLATE_NOTIFICATIONS_WIDGET = "notificationswidget"
+)
+
+// InboxNotification is a broker Notify message persisted in the notification inbox. Notifications are acknowledged when they are persisted
+// and processed by the notification workers. Failed notifications are retried with exponential backoff until the retry limit, when they
+// are dead lettered. Dead lettered notifications can be replayed from the notifications widget. Stage records the notification events have
+// been created, so a retry only repeats the stages that failed. AWS Lambda has no notification workers, so there the inbox is only processed
+// by the scheduled event handler and a notification is not applied to its workflows until the next scheduled event
+type InboxNotification struct {
+	Id             int64  `json:"id"`
+	Received       string `json:"received"`
+	Status         string `json:"status"`
+	Stage          string `json:"stage"`
+	Attempts       int    `json:"attempts"`
+	NextAttempt    string `json:"nextattempt"`
+	LastError      string `json:"lasterror"`
+	Processed      string `json:"processed"`
+	BrokerRef      string `json:"brokerref"`
+	XdsDocEntryUid string `json:"xdsdocentryuid"`
+	Message        string `json:"message,omitempty"`
+}
+
+// errNoNotificationEvents is returned when no event was created for a notification with subscribed pathways
+var errNoNotificationEvents = errors.New("no events were created for the notification document. the patient service may be unavailable")
+
+// dsubTransaction creates the events for a broker notification. Tests replace it as no patient service is available to resolve the NHS ID
+var dsubTransaction = tukdsub.New_Transaction
+
+// inboxSignal wakes an idle notification worker when a notification is received
+var inboxSignal = make(chan struct{}, 1)
+var inboxWorkers int
+
+// StartNotificationWorkers starts the notification inbox worker pool. The workers also deliver FHIR subscription notifications and process
+// queued patient subscriptions. Notifications left processing by a previous instance are returned to the inbox
+func StartNotificationWorkers(workers int) {
+	if workers <= 0 {
+		workers = DEFAULT_NOTIFICATION_WORKERS
+	}
+	if tukdbint.DBConn == nil {
+		log.Println("no database connection available. Notification Workers not started")
+		return
+	}
+	if cnt, err := resetInboxNotifications(); err == nil && cnt > 0 {
+		log.Printf("Returned %v interrupted Notifications to the Notification Inbox", cnt)
+	}
+	if cnt, err := resetFHIRDeliveries(); err == nil && cnt > 0 {
+		log.Printf("Returned %v interrupted FHIR Subscription notifications for delivery", cnt)
+	}
+	log.Printf("Starting %v Notification Workers", workers)
+	inboxWorkers = workers
+	for w := 1; w <= workers; w++ {
+		go notificationWorker(w)
+	}
+}
+func notificationWorker(worker int) {
+	ticker := time.NewTicker(NOTIFICATION_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		for processNextInboxNotification() {
+		}
+		for FHIRNotifications.deliverNext() {
+		}
+		for processNextPatientSubscription() {
+		}
+		select {
+		case <-inboxSignal:
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessNotificationInbox processes every notification due in the inbox. It is used where no notification workers are running, eg. by
+// the AWS scheduled event handler
+func ProcessNotificationInbox() error {
+	if tukdbint.DBConn == nil {
+		return errors.New("no database connection available to process the notification inbox")
+	}
+	cnt := 0
+	for processNextInboxNotification() {
+		cnt++
+	}
+	log.Printf("Processed %v Notification Inbox Notifications", cnt)
+	return nil
+}
+
+// processNextInboxNotification claims and processes the next notification due. It returns false if no notification is due
+func processNextInboxNotification() bool {
+	n, err := claimInboxNotification()
+	if err != nil || n.Id == 0 {
+		return false
+	}
+	if isPausedBrokerRef(n.BrokerRef) {
+		n.Status = NOTIFICATION_STATUS_PAUSED
+		log.Printf("Delivery of Broker Ref %s is paused. Holding Notification %v", n.BrokerRef, n.Id)
+		setInboxNotificationStatus(&n)
+		return true
+	}
+	i := TukEvent{REGOid: Regoid, EventServices: Services, Body: n.Message}
+	retries := Services.EventService.NotificationRetries
+	if retries <= 0 {
+		retries = DEFAULT_NOTIFICATION_RETRIES
+	}
+	wfs, err := i.processInboxNotification(&n)
+	if err == nil {
+		n.Status = NOTIFICATION_STATUS_PROCESSED
+		n.LastError = ""
+		n.Processed = time.Now().UTC().Format(NOTIFICATION_TIME_FORMAT)
+		log.Printf("Processed Notification %v for Broker Ref %s XDS Doc UID %s", n.Id, n.BrokerRef, n.XdsDocEntryUid)
+		if err = updateNotificationWorkflows(wfs); err != nil {
+			n.LastError = err.Error()
+			log.Printf("Notification %v Content Update failed. %s", n.Id, err.Error())
+		}
+	} else if n.Attempts >= retries {
+		n.Status = NOTIFICATION_STATUS_DEAD_LETTER
+		n.LastError = err.Error()
+		log.Printf("Notification %v failed %v attempts and is dead lettered. %s", n.Id, n.Attempts, err.Error())
+	} else {
+		n.Status = NOTIFICATION_STATUS_PENDING
+		n.LastError = err.Error()
+		n.NextAttempt = time.Now().UTC().Add(NOTIFICATION_RETRY_BACKOFF * time.Duration(1<<(n.Attempts-1))).Format(NOTIFICATION_TIME_FORMAT)
+		log.Printf("Notification %v attempt %v failed. Retrying at %s. %s", n.Id, n.Attempts, n.NextAttempt, err.Error())
+	}
+	setInboxNotificationStatus(&n)
+	return true
+}
+
+// enqueueBrokerNotification persists the Notify message in the request body to the notification inbox and wakes a notification worker
+func (i *TukEvent) enqueueBrokerNotification() error {
+	n := InboxNotification{Status: NOTIFICATION_STATUS_PENDING, Message: i.Body}
+	if bn, err := newBrokerNotification(i.Body); err == nil {
+		n.BrokerRef, n.XdsDocEntryUid = bn.BrokerRef, bn.XdsDocEntryUid
+	}
+	if isPausedBrokerRef(n.BrokerRef) {
+		n.Status = NOTIFICATION_STATUS_PAUSED
+	}
+	if err := setInboxNotification(&n); err != nil {
+		return err
+	}
+	log.Printf("Added %s Notification %v to the Notification Inbox", n.Status, n.Id)
+	select {
+	case inboxSignal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// processInboxNotification creates the notification events, unless a previous attempt created them, and returns the workflows the events
+// were created for. The stage is persisted once the events are created so a failed workflow lookup is retried without creating the events
+// again. The stage is cleared if no events were created so the retry creates them
+func (i *TukEvent) processInboxNotification(n *InboxNotification) ([]tukdbint.Workflow, error) {
+	if n.Stage != NOTIFICATION_STAGE_EVENTS_CREATED {
+		if err := i.createNotificationEvents(); err != nil {
+			return nil, err
+		}
+		n.Stage = NOTIFICATION_STAGE_EVENTS_CREATED
+		setInboxNotificationStage(n)
+	} else {
+		log.Printf("Events for Notification %v were created by a previous attempt", n.Id)
+	}
+	wfs, err := i.notificationWorkflows()
+	if err == errNoNotificationEvents {
+		n.Stage = ""
+	}
+	return wfs, err
+}
+
+// processBrokerNotification creates the events for the Notify message in the request body and returns the workflows the events were created
+// for. tukdsub does not return notification processing errors, so an error is returned if no event was created for a notification with
+// subscribed pathways
+func (i *TukEvent) processBrokerNotification() ([]tukdbint.Workflow, error) {
+	if err := i.createNotificationEvents(); err != nil {
+		return nil, err
+	}
+	return i.notificationWorkflows()
+}
+
+// createNotificationEvents creates the events for the Notify message in the request body
+func (i *TukEvent) createNotificationEvents() error {
+	event := tukdsub.DSUBEvent{
+		BrokerURL:       i.EventServices.BrokerService.WSE,
+		PDQ_SERVER_TYPE: i.EventServices.EventService.PatientSrvc,
+		REG_OID:         Regoid,
+		EventMessage:    i.Body,
+	}
+	switch event.PDQ_SERVER_TYPE {
+	case tukcnst.PDQ_SERVER_TYPE_IHE_PDQV3:
+		event.PDQ_SERVER_URL = i.EventServices.PDQv3Service.WSE
+	case tukcnst.PDQ_SERVER_TYPE_IHE_PIXM:
+		event.PDQ_SERVER_URL = i.EventServices.PIXmService.WSE
+	}
+	return dsubTransaction(&event)
+}
+
+// notificationWorkflows returns the workflows with events for the document of the Notify message in the request body. An error is returned
+// if a pathway is subscribed to the broker ref and no events exist for the document
+func (i *TukEvent) notificationWorkflows() ([]tukdbint.Workflow, error) {
+	n, err := newBrokerNotification(i.Body)
+	if err != nil {
+		return nil, err
+	}
+	if n.XdsDocEntryUid == "" || len(n.Pathways) == 0 {
+		return nil, nil
+	}
+	wfs, err := getDocumentEventWorkflows(n.XdsDocEntryUid, n.Pathways)
+	if err != nil {
+		return nil, err
+	}
+	if len(wfs) == 0 {
+		log.Printf("No events were created for XDS Doc UID %s", n.XdsDocEntryUid)
+		return nil, errNoNotificationEvents
+	}
+	return wfs, nil
+}
+
+// updateNotificationWorkflows runs the XDW Content Updater for each workflow with notification events. The notification is not retried
+// if the update fails as its events have been created, so the errors of each failed update are returned for the notification log
+func updateNotificationWorkflows(wfs []tukdbint.Workflow) error {
+	var errs []string
+	for _, wf := range wfs {
+		log.Printf("Running Content Updater for %s Workflow NHS ID %s", wf.Pathway, wf.NHSId)
+		if err := updateWorkflows(wf.Pathway, wf.NHSId, wf.Version); err != nil {
+			errs = append(errs, wf.Pathway+" nhs id "+wf.NHSId+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New("content update failed. " + strings.Join(errs, ". "))
+	}
+	return nil
+}
+
+// NotificationsWidget returns the notifications in the inbox with the request status, or the notifications not yet processed if no
+// status is requested
+func (i *TukEvent) NotificationsWidget() []byte {
+	ns, err := getInboxNotifications(i.Status, i.RowId)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	i.Notifications = ns
+	if i.ReturnJSON {
+		if i.HttpResponse != nil {
+			i.HttpResponse.Header().Add(tukcnst.CONTENT_TYPE, tukcnst.APPLICATION_JSON)
+		}
+		b, err := json.MarshalIndent(ns, "", "  ")
+		if err != nil {
+			log.Println(err.Error())
+			return []byte(err.Error())
+		}
+		return b
+	}
+	var b bytes.Buffer
+	if err := i.EventServices.HTMLTemplates.ExecuteTemplate(&b, TUK_TEMPLATE_NOTIFICATIONS_WIDGET, i); err != nil {
+		log.Println(err.Error())
+		return []byte(err.Error())
+	}
+	return b.Bytes()
+}
+
+// replayNotifications returns the notification with the row id, or all dead lettered notifications if no row id is provided, to the inbox
+func (i *TukEvent) replayNotifications() []byte {
+	cnt, err := replayInboxNotifications(i.RowId)
+	if err != nil {
+		i.ReturnCode = http.StatusInternalServerError
+		return []byte(err.Error())
+	}
+	log.Printf("Replaying %v Notifications", cnt)
+	if inboxWorkers == 0 {
+		ProcessNotificationInbox()
+	} else {
+		select {
+		case inboxSignal <- struct{}{}:
+		default:
+		}
+	}
+	i.RowId = 0
+	i.Status = ""
+	if i.ReturnJSON {
+		return []byte(`{"replayed":` + strconv.FormatInt(cnt, 10) + `}`)
+	}
+	return i.NotificationsWidget()
+}
+
+// isPausedBrokerRef returns true if delivery of notifications for the broker ref is paused
+func isPausedBrokerRef(brokerref string) bool {
+	if brokerref == "" {
+		return false
+	}
+	state, err := getSubscriptionState(brokerref)
+	return err == nil && state.Status == SUBSCRIPTION_STATUS_PAUSED
+}
@@ -0,0 +1,321 @@
+package tukint
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukdbint"
+)
+
+const (
+	TUK_EVENT_QUERY_PARAM_CURSOR = "cursor"
+	DEFAULT_PAGE_LIMIT           = 100
+	LINK                         = "Link"
+)
+
+var eventSortColumns = map[string]string{
+	"id":           "id",
+	"creationtime": "creationtime",
+	"eventtype":    "eventtype",
+	"pathway":      "pathway",
+	"nhsid":        "nhsid",
+	"taskid":       "taskid",
+	"user":         "user",
+	"org":          "org",
+}
+var subscriptionSortColumns = map[string]string{
+	"id":         "id",
+	"created":    "created",
+	"pathway":    "pathway",
+	"topic":      "topic",
+	"expression": "expression",
+	"nhsid":      "nhsid",
+}
+
+// Page is a page of a list request. Cursor is the opaque position of the page returned as NextCursor by the previous page.
+// Offset is used if no cursor is provided. A Limit of 0 is an unpaged request and returns all rows
+type Page struct {
+	Limit      int    `json:"limit"`
+	Offset     int    `json:"offset,omitempty"`
+	Sort       string `json:"sort"`
+	Order      string `json:"order"`
+	Cursor     string `json:"cursor,omitempty"`
+	NextCursor string `json:"nextcursor,omitempty"`
+	Next       string `json:"next,omitempty"`
+	Count      int    `json:"count"`
+	Total      int    `json:"total"`
+	cursor     *pageCursor
+}
+type pageCursor struct {
+	Key string `json:"k"`
+	Id  int64  `json:"id"`
+}
+type EventsPage struct {
+	tukdbint.Events
+	Page Page `json:"page"`
+}
+type WorkflowsPage struct {
+	Workflows []tukdbint.Workflow `json:"workflows"`
+	Page      Page                `json:"page"`
+}
+type SubscriptionsPage struct {
+	Subscriptions []tukdbint.Subscription `json:"subscriptions"`
+	Page          Page                    `json:"page"`
+}
+
+// newPage returns the page of the request. Requests without paging parameters are not limited. An error is returned if the cursor is
+// not a cursor returned by a previous page
+func (i *TukEvent) newPage(defaultsort string) (Page, error) {
+	p := Page{Limit: i.Limit, Offset: i.Offset, Sort: strings.ToLower(i.Sort), Order: strings.ToLower(i.Order), Cursor: i.Cursor}
+	if !i.isPaged() {
+		p.Limit = 0
+	} else if p.Limit <= 0 {
+		p.Limit = DEFAULT_PAGE_LIMIT
+	}
+	if p.Limit > MAX_QUERY_LIMIT {
+		p.Limit = MAX_QUERY_LIMIT
+	}
+	if p.Offset < 0 {
+		p.Offset = 0
+	}
+	if p.Sort == "" {
+		p.Sort = defaultsort
+	}
+	if p.Order != SORT_ORDER_ASC {
+		p.Order = SORT_ORDER_DESC
+	}
+	if p.Cursor != "" {
+		cursor, err := decodeCursor(p.Cursor)
+		if err != nil {
+			log.Println(err.Error())
+			return p, errors.New("invalid cursor " + p.Cursor)
+		}
+		p.cursor = &cursor
+	}
+	return p, nil
+}
+
+// isPaged returns true if the request provided paging parameters
+func (i *TukEvent) isPaged() bool {
+	return i.Limit > 0 || i.Offset > 0 || i.Cursor != ""
+}
+
+// clauses returns the keyset condition of the page cursor and the order by and limit clauses of the page. The limit is one more than
+// the page limit so that setNext can determine if there is a next page. Unpaged requests have no limit clause
+func (p *Page) clauses(sortcol string, idcol string) (string, []interface{}, string, []interface{}) {
+	dir, cmp := " DESC", " < "
+	if p.Order == SORT_ORDER_ASC {
+		dir, cmp = " ASC", " > "
+	}
+	orderby := " ORDER BY " + sortcol + dir + ", " + idcol + dir
+	if p.Limit == 0 {
+		return "", nil, orderby, nil
+	}
+	orderby = orderby + " LIMIT ?"
+	limitparams := []interface{}{p.Limit + 1}
+	if p.cursor == nil {
+		orderby = orderby + " OFFSET ?"
+		limitparams = append(limitparams, p.Offset)
+		return "", nil, orderby, limitparams
+	}
+	cursor := *p.cursor
+	cond := "(CAST(" + sortcol + " AS CHAR)" + cmp + "? OR (CAST(" + sortcol + " AS CHAR) = ? AND " + idcol + cmp + "?))"
+	if isNumericSort(sortcol) {
+		cond = "(" + sortcol + cmp + "? OR (" + sortcol + " = ? AND " + idcol + cmp + "?))"
+	}
+	return cond, []interface{}{cursor.Key, cursor.Key, cursor.Id}, orderby, limitparams
+}
+
+// where returns the where clause, with the page cursor condition, and the order by and limit clauses of the page
+func (p *Page) where(where string, params []interface{}, sortcol string, idcol string) (string, []interface{}) {
+	cursorcond, cursorparams, orderby, limitparams := p.clauses(sortcol, idcol)
+	if cursorcond != "" {
+		if where == "" {
+			where = " WHERE " + cursorcond
+		} else {
+			where = where + " AND " + cursorcond
+		}
+		params = append(params, cursorparams...)
+	}
+	return where + orderby, append(params, limitparams...)
+}
+func isNumericSort(sortcol string) bool {
+	switch strings.TrimPrefix(sortcol, "w.") {
+	case "id", "version", "taskid":
+		return true
+	}
+	return false
+}
+
+// setNext sets the page count and, if more rows than the page limit were returned, the next cursor from the sort key and id of the
+// last row of the page. It returns the number of rows in the page
+func (p *Page) setNext(keys []string, ids []int64) int {
+	p.Count = len(keys)
+	if p.Limit > 0 && p.Count > p.Limit {
+		p.Count = p.Limit
+		p.NextCursor = encodeCursor(pageCursor{Key: keys[p.Limit-1], Id: ids[p.Limit-1]})
+	}
+	return p.Count
+}
+func encodeCursor(c pageCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+func decodeCursor(s string) (pageCursor, error) {
+	c := pageCursor{}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
+func sortColumn(cols map[string]string, sort string, defaultsort string) string {
+	if col, ok := cols[sort]; ok {
+		return col
+	}
+	return cols[defaultsort]
+}
+
+// setLinkHeader sets the next page url and, for http requests, the Link response header. Lambda responses set the Link header
+// from the next page url in setAwsResponseHeaders
+func (i *TukEvent) setLinkHeader() {
+	if i.Page.NextCursor == "" || i.RequestURL == nil {
+		return
+	}
+	q := i.RequestURL.Query()
+	q.Set(TUK_EVENT_QUERY_PARAM_CURSOR, i.Page.NextCursor)
+	q.Del(TUK_EVENT_QUERY_PARAM_OFFSET)
+	i.Page.Next = i.RequestURL.Path + "?" + q.Encode()
+	if i.HttpResponse != nil {
+		i.HttpResponse.Header().Add(LINK, "<"+i.Page.Next+">; rel=\"next\"")
+	}
+}
+
+// getEventsPage returns a page of the events matching the event filter. Id, Version and TaskId filters are ignored if less than 1, -1 and -1
+func getEventsPage(filter tukdbint.Event, p *Page) ([]tukdbint.Event, error) {
+	conds, params := eventFilter(filter)
+	return queryEventsPage(conds, params, p)
+}
+func eventFilter(filter tukdbint.Event) ([]string, []interface{}) {
+	var conds []string
+	var params []interface{}
+	if filter.Id > 0 {
+		conds = append(conds, "id = ?")
+		params = append(params, filter.Id)
+	}
+	for col, val := range map[string]string{"pathway": filter.Pathway, "nhsid": filter.NhsId, "eventtype": filter.EventType, "topic": filter.Topic} {
+		if val != "" {
+			conds = append(conds, col+" = ?")
+			params = append(params, val)
+		}
+	}
+	if filter.Version != -1 {
+		conds = append(conds, "version = ?")
+		params = append(params, filter.Version)
+	}
+	if filter.TaskId != -1 {
+		conds = append(conds, "taskid = ?")
+		params = append(params, filter.TaskId)
+	}
+	return conds, params
+}
+func queryEventsPage(conds []string, params []interface{}, p *Page) ([]tukdbint.Event, error) {
+	var evs []tukdbint.Event
+	sortcol := sortColumn(eventSortColumns, p.Sort, "id")
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	rows, err := queryPage(ctx, "events", eventColumns, sortcol, "id", conds, params, p)
+	if err != nil {
+		return evs, err
+	}
+	defer rows.Close()
+	var keys []string
+	var ids []int64
+	for rows.Next() {
+		var key string
+		ev := tukdbint.Event{}
+		if err = rows.Scan(append(eventDest(&ev), &key)...); err != nil {
+			log.Println(err.Error())
+			return evs, err
+		}
+		evs = append(evs, ev)
+		keys = append(keys, key)
+		ids = append(ids, ev.Id)
+	}
+	return evs[:p.setNext(keys, ids)], rows.Err()
+}
+
+// getSubscriptionsPage returns a page of the subscriptions for the pathway, or all subscriptions if pathway is empty
+func getSubscriptionsPage(pathway string, p *Page) ([]tukdbint.Subscription, error) {
+	var subs []tukdbint.Subscription
+	var conds []string
+	var params []interface{}
+	if pathway != "" {
+		conds = append(conds, "pathway = ?")
+		params = append(params, pathway)
+	}
+	sortcol := sortColumn(subscriptionSortColumns, p.Sort, "id")
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	rows, err := queryPage(ctx, "subscriptions", subscriptionColumns, sortcol, "id", conds, params, p)
+	if err != nil {
+		return subs, err
+	}
+	defer rows.Close()
+	var keys []string
+	var ids []int64
+	for rows.Next() {
+		var key string
+		sub := tukdbint.Subscription{}
+		if err = rows.Scan(&sub.Id, &sub.Created, &sub.BrokerRef, &sub.Pathway, &sub.Topic, &sub.Expression, &sub.Email, &sub.NhsId, &sub.User, &sub.Org, &sub.Role, &key); err != nil {
+			log.Println(err.Error())
+			return subs, err
+		}
+		subs = append(subs, sub)
+		keys = append(keys, key)
+		ids = append(ids, sub.Id)
+	}
+	return subs[:p.setNext(keys, ids)], rows.Err()
+}
+
+// eventDest returns the scan destinations of the eventColumns of ev
+func eventDest(ev *tukdbint.Event) []interface{} {
+	return []interface{}{&ev.Id, &ev.Creationtime, &ev.EventType, &ev.DocName, &ev.ClassCode, &ev.ConfCode, &ev.FormatCode, &ev.FacilityCode, &ev.PracticeCode, &ev.Speciality, &ev.Expression, &ev.Authors, &ev.XdsPid, &ev.XdsDocEntryUid, &ev.RepositoryUniqueId, &ev.NhsId, &ev.User, &ev.Org, &ev.Role, &ev.Topic, &ev.Pathway, &ev.Comments, &ev.Version, &ev.TaskId, &ev.BrokerRef}
+}
+
+const (
+	eventColumns        = "id, creationtime, eventtype, docname, classcode, confcode, formatcode, facilitycode, practicecode, speciality, expression, authors, xdspid, xdsdocentryuid, repositoryuniqueid, nhsid, user, org, role, topic, pathway, comments, version, taskid, COALESCE(brokerref, '')"
+	subscriptionColumns = "id, created, brokerref, pathway, topic, expression, email, nhsid, user, org, role"
+)
+
+// queryPage selects a page of rows of table and sets the page total. The sort key of each row is returned as the last column
+func queryPage(ctx context.Context, table string, columns string, sortcol string, idcol string, conds []string, params []interface{}, p *Page) (*sql.Rows, error) {
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+	if err := tukdbint.DBConn.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table+where, params...).Scan(&p.Total); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	cursorcond, cursorparams, orderby, limitparams := p.clauses(sortcol, idcol)
+	if cursorcond != "" {
+		conds = append(conds, cursorcond)
+		params = append(params, cursorparams...)
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+	params = append(params, limitparams...)
+	stmnt := "SELECT " + columns + ", COALESCE(CAST(" + sortcol + " AS CHAR), '') FROM " + table + where + orderby
+	rows, err := tukdbint.DBConn.QueryContext(ctx, stmnt, params...)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return rows, err
+}
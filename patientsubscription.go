@@ -0,0 +1,172 @@
+package tukint
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+const (
+	PATIENT_SUBSCRIPTION_OP_SUBSCRIBE = "SUBSCRIBE"
+	PATIENT_SUBSCRIPTION_OP_CANCEL    = "CANCEL"
+)
+
+var (
+	patientSubscriptionLocks   = make(map[string]*workflowMutex)
+	patientSubscriptionLocksMu sync.Mutex
+)
+
+// isPatientSubscriptionPathway returns true if the pathway subscribes to documents per patient. Patient subscription pathways are
+// subscribed when a workflow is created for a patient and the subscriptions are cancelled when the patient has no open workflow
+func isPatientSubscriptionPathway(pathway string) bool {
+	return containsString(Services.EventService.PatientSubscriptions, pathway)
+}
+
+// lockPatientSubscriptions locks the patient subscriptions of the pathway and returns the func that unlocks them. Subscribing a patient
+// and cancelling the patient subscriptions hold the lock so the subscriptions of a workflow created while another workflow for the
+// patient closes are not cancelled
+func lockPatientSubscriptions(pathway string, nhsid string) func() {
+	key := pathway + "|" + nhsid
+	patientSubscriptionLocksMu.Lock()
+	lock, ok := patientSubscriptionLocks[key]
+	if !ok {
+		lock = &workflowMutex{}
+		patientSubscriptionLocks[key] = lock
+	}
+	lock.refs++
+	patientSubscriptionLocksMu.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		patientSubscriptionLocksMu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(patientSubscriptionLocks, key)
+		}
+		patientSubscriptionLocksMu.Unlock()
+	}
+}
+
+// queuePatientSubscriptionOp queues the subscribe or cancel op for the workflow patient of a patient subscription pathway and wakes a
+// notification worker to process it. The broker is not called while the workflow is persisted or locked. A failed subscription is retried
+// by the Workflow State Scheduler, which subscribes the patients of open workflows
+func queuePatientSubscriptionOp(wf tukdbint.Workflow, op string) {
+	if !isPatientSubscriptionPathway(wf.Pathway) || tukdbint.DBConn == nil {
+		return
+	}
+	if err := queuePatientSubscription(wf.Pathway, wf.NHSId, op); err != nil {
+		return
+	}
+	select {
+	case inboxSignal <- struct{}{}:
+	default:
+	}
+}
+
+// ProcessPatientSubscriptions processes every queued patient subscription op. It is used where no notification workers are running, eg. by
+// the AWS scheduled event handler
+func ProcessPatientSubscriptions() error {
+	if tukdbint.DBConn == nil {
+		return errors.New("no database connection available to process patient subscriptions")
+	}
+	cnt := 0
+	for processNextPatientSubscription() {
+		cnt++
+	}
+	if cnt > 0 {
+		log.Printf("Processed %v Patient Subscriptions", cnt)
+	}
+	return nil
+}
+
+// processNextPatientSubscription claims and processes the next queued patient subscription op. It returns false if no op is queued
+func processNextPatientSubscription() bool {
+	wf, op, err := claimPatientSubscription()
+	if err != nil || wf.Pathway == "" {
+		return false
+	}
+	switch op {
+	case PATIENT_SUBSCRIPTION_OP_SUBSCRIBE:
+		subscribePatient(wf)
+	case PATIENT_SUBSCRIPTION_OP_CANCEL:
+		cancelPatientSubscriptions(wf)
+	default:
+		log.Printf("Unknown Patient Subscription op %s for %s NHS ID %s", op, wf.Pathway, wf.NHSId)
+	}
+	return true
+}
+
+// subscribePatient subscribes the workflow patient to the expression and filter of each XDS registered task input and output of the
+// workflow pathway that the patient is not subscribed to
+func subscribePatient(wf tukdbint.Workflow) {
+	if !isPatientSubscriptionPathway(wf.Pathway) {
+		return
+	}
+	unlock := lockPatientSubscriptions(wf.Pathway, wf.NHSId)
+	defer unlock()
+	xdw, err := getWorkflowDefinition(wf.Pathway)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	def, err := newDSUBDefinition(xdw.XDW)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	filters, err := getSubscriptionFilters()
+	if err != nil {
+		log.Printf("Unable to subscribe %s NHS ID %s. %s", wf.Pathway, wf.NHSId, err.Error())
+		return
+	}
+	subscribed := make(map[string]bool)
+	for _, sub := range tukdbint.GetSubscriptions("", wf.Pathway, "").Subscriptions {
+		if sub.Id > 0 && sub.NhsId == wf.NHSId {
+			subscribed[sub.Expression+"|"+filters[sub.BrokerRef].key()] = true
+		}
+	}
+	terminationtime := defaultTerminationTime(Services.EventService.SubscriptionTerm)
+	for _, c := range def.criteria() {
+		if subscribed[c.Expression+"|"+c.Filter.key()] {
+			continue
+		}
+		sub := tukdbint.Subscription{Pathway: wf.Pathway, Topic: tukcnst.DSUB_TOPIC_TYPE_CODE, Expression: c.Expression, NhsId: wf.NHSId, User: DSUB_BROKER_USER, Org: DSUB_BROKER_ORG, Role: DSUB_BROKER_ROLE}
+		if _, err := registerSubscription(sub, c.Filter, terminationtime, SUBSCRIPTION_ORIGIN_WORKFLOW); err != nil {
+			log.Printf("Unable to subscribe %s NHS ID %s to %s. %s", wf.Pathway, wf.NHSId, c.Expression, err.Error())
+		}
+	}
+}
+
+// cancelPatientSubscriptions cancels the patient subscriptions of the pathway if the patient has no open workflow for the pathway
+func cancelPatientSubscriptions(wf tukdbint.Workflow) {
+	if !isPatientSubscriptionPathway(wf.Pathway) {
+		return
+	}
+	unlock := lockPatientSubscriptions(wf.Pathway, wf.NHSId)
+	defer unlock()
+	if getWorkflows(wf.Pathway, wf.NHSId, -1, tukcnst.TUK_STATUS_OPEN).Count > 0 {
+		log.Printf("NHS ID %s has an open %s Workflow. Retaining Patient Subscriptions", wf.NHSId, wf.Pathway)
+		return
+	}
+	for _, sub := range tukdbint.GetSubscriptions("", wf.Pathway, "").Subscriptions {
+		if sub.Id > 0 && sub.NhsId == wf.NHSId {
+			if err := cancelSubscription(sub, true); err != nil {
+				log.Printf("Unable to cancel %s Subscription %v. %s", wf.Pathway, sub.Id, err.Error())
+			}
+		}
+	}
+}
+
+// subscribeOpenWorkflowPatients subscribes the patient of each open workflow of the patient subscription pathways, so patients with
+// workflows opened before their pathway subscribed per patient, or whose subscription failed, are subscribed. If the Workflow State
+// Scheduler is disabled patients are only subscribed when a workflow is created
+func subscribeOpenWorkflowPatients(wfs tukdbint.Workflows) {
+	for _, wf := range wfs.Workflows {
+		if wf.Id > 0 && isPatientSubscriptionPathway(wf.Pathway) {
+			subscribePatient(wf)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package tukint
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	PDF_PAGE_WIDTH    = 595.0
+	PDF_PAGE_HEIGHT   = 842.0
+	PDF_MARGIN        = 50.0
+	PDF_FONT_REGULAR  = "F1"
+	PDF_FONT_BOLD     = "F2"
+	PDF_CHAR_WIDTH_EM = 0.5
+)
+
+// pdfDocument is a minimal A4 text pdf writer using the standard Helvetica fonts, so no font files are embedded
+type pdfDocument struct {
+	pages []*bytes.Buffer
+	page  *bytes.Buffer
+	y     float64
+}
+
+func newPDFDocument() *pdfDocument {
+	doc := pdfDocument{}
+	doc.newPage()
+	return &doc
+}
+func (d *pdfDocument) newPage() {
+	d.page = &bytes.Buffer{}
+	d.pages = append(d.pages, d.page)
+	d.y = PDF_PAGE_HEIGHT - PDF_MARGIN
+}
+
+// text writes text wrapped to the page width, starting a new page when the page is full
+func (d *pdfDocument) text(font string, size float64, indent float64, text string) {
+	width := PDF_PAGE_WIDTH - 2*PDF_MARGIN - indent
+	for _, line := range wrapText(text, int(width/(size*PDF_CHAR_WIDTH_EM))) {
+		if d.y-size < PDF_MARGIN {
+			d.newPage()
+		}
+		d.y = d.y - size*1.3
+		fmt.Fprintf(d.page, "BT /%s %.1f Tf %.1f %.1f Td (%s) Tj ET\n", font, size, PDF_MARGIN+indent, d.y, pdfEscape(line))
+	}
+}
+func (d *pdfDocument) heading(text string) {
+	d.space(8)
+	d.text(PDF_FONT_BOLD, 13, 0, text)
+	d.line()
+}
+func (d *pdfDocument) line() {
+	d.y = d.y - 4
+	fmt.Fprintf(d.page, "%.1f %.1f m %.1f %.1f l S\n", PDF_MARGIN, d.y, PDF_PAGE_WIDTH-PDF_MARGIN, d.y)
+}
+func (d *pdfDocument) space(height float64) {
+	d.y = d.y - height
+}
+
+// bytes returns the pdf file
+func (d *pdfDocument) bytes() []byte {
+	var b bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	b.WriteString("%PDF-1.4\n")
+	kids := make([]string, len(d.pages))
+	for k := range d.pages {
+		kids[k] = fmt.Sprintf("%d 0 R", 5+2*k)
+	}
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for k, page := range d.pages {
+		footer := fmt.Sprintf("BT /%s 8 Tf %.1f %.1f Td (Page %d of %d) Tj ET\n", PDF_FONT_REGULAR, PDF_PAGE_WIDTH-PDF_MARGIN-50, PDF_MARGIN/2, k+1, len(d.pages))
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /%s 3 0 R /%s 4 0 R >> >> /Contents %d 0 R >>", PDF_PAGE_WIDTH, PDF_PAGE_HEIGHT, PDF_FONT_REGULAR, PDF_FONT_BOLD, 6+2*k))
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%s%s\nendstream", page.Len()+len(footer), page.String(), footer))
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return b.Bytes()
+}
+
+// winAnsiRunes maps the runes of the WinAnsi 0x80 to 0x9f code points to their WinAnsi bytes. WinAnsi 0xa0 to 0xff are the latin-1 runes
+var winAnsiRunes = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87, 'ˆ': 0x88, '‰': 0x89, 'Š': 0x8a, '‹': 0x8b, 'Œ': 0x8c, 'Ž': 0x8e,
+	'‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98, '™': 0x99, 'š': 0x9a, '›': 0x9b, 'œ': 0x9c, 'ž': 0x9e, 'Ÿ': 0x9f,
+}
+
+// pdfEscape escapes pdf string delimiters and writes runes outside the ascii printable range as octal escaped WinAnsi bytes, the encoding of
+// the pdf fonts. Runes with no WinAnsi byte are replaced with ?
+func pdfEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r >= 32 && r <= 126:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		case winAnsiRunes[r] != 0:
+			fmt.Fprintf(&b, "\\%03o", winAnsiRunes[r])
+		default:
+			b.WriteRune('?')
+		}
+	}
+	return b.String()
+}
+
+// wrapText splits text into lines of at most width characters
+func wrapText(text string, width int) []string {
+	var lines []string
+	for _, para := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(para) {
+			for utf8.RuneCountInString(word) > width {
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				runes := []rune(word)
+				lines = append(lines, string(runes[:width]))
+				word = string(runes[width:])
+			}
+			if line == "" {
+				line = word
+			} else if utf8.RuneCountInString(line)+1+utf8.RuneCountInString(word) > width {
+				lines = append(lines, line)
+				line = word
+			} else {
+				line = line + " " + word
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
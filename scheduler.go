@@ -0,0 +1,165 @@
+package tukint
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukutil"
+)
+
+const (
+	WORKFLOW_STATE_OVERDUE   = "overdue"
+	WORKFLOW_STATE_ESCALATED = "escalated"
+)
+
+var (
+	schedulerLock    sync.Mutex
+	schedulerRunning atomic.Bool
+)
+
+// StartWorkflowStateScheduler re-evaluates the state of all open workflows every interval. An interval of 0 disables the scheduler and
+// the state of open workflows is evaluated when workflow state is queried
+func StartWorkflowStateScheduler(interval time.Duration) {
+	if interval <= 0 {
+		log.Println("Workflow State Scheduler is disabled")
+		return
+	}
+	log.Printf("Starting Workflow State Scheduler. Interval %s", interval.String())
+	schedulerRunning.Store(true)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := EvaluateWorkflowStates(); err != nil {
+				log.Println(err.Error())
+			}
+		}
+	}()
+}
+
+func isWorkflowStateSchedulerRunning() bool {
+	return schedulerRunning.Load()
+}
+
+// Handle_AWS_Scheduled_Event is the Lambda entry point for EventBridge (CloudWatch Events) scheduled rules. Lambda has no notification
+// workers so the notification inbox is processed, pending FHIR subscription notifications delivered and queued patient subscriptions
+// processed first
+func Handle_AWS_Scheduled_Event(event events.CloudWatchEvent) error {
+	log.Printf("Processing %s Scheduled Event %s from %s", event.DetailType, event.ID, event.Source)
+	if err := ProcessNotificationInbox(); err != nil {
+		log.Println(err.Error())
+	}
+	if err := ProcessFHIRNotifications(); err != nil {
+		log.Println(err.Error())
+	}
+	if err := ProcessPatientSubscriptions(); err != nil {
+		log.Println(err.Error())
+	}
+	return EvaluateWorkflowStates()
+}
+
+// EvaluateWorkflowStates recomputes and persists the workflowstate of every open workflow and of any workflow whose persisted state is still open.
+// The patients of open workflows of patient subscription pathways that are not subscribed are subscribed
+func EvaluateWorkflowStates() error {
+	if !schedulerLock.TryLock() {
+		log.Println("Workflow State evaluation is already running. Skipping")
+		return nil
+	}
+	defer schedulerLock.Unlock()
+	if tukdbint.DBConn == nil {
+		return errors.New("no database connection available for workflow state evaluation")
+	}
+	log.Println("Evaluating Workflow States")
+	evaluated := make(map[int64]bool)
+	wfs := getWorkflows("", "", -1, tukcnst.TUK_STATUS_OPEN)
+	log.Printf("Open Workflow Count %v", wfs.Count)
+	subscribeOpenWorkflowPatients(wfs)
+	for _, wf := range wfs.Workflows {
+		if wf.Id > 0 {
+			evaluateWorkflowState(wf)
+			evaluated[wf.Id] = true
+		}
+	}
+	states, err := getOpenWorkflowStates()
+	if err != nil {
+		return err
+	}
+	for _, state := range states.Workflowstate {
+		if evaluated[state.WorkflowId] {
+			continue
+		}
+		log.Printf("Workflow %v is no longer open. Updating persisted state", state.WorkflowId)
+		if wf, err := getWorkflow(state.WorkflowId); err == nil {
+			evaluateWorkflowState(wf)
+		}
+	}
+	log.Printf("Evaluated %v Workflow States", len(evaluated))
+	return nil
+}
+func evaluateWorkflowState(wf tukdbint.Workflow) {
+	state, err := newWorkflowState(wf)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	prev, err := GetWorkflowState(wf.Id)
+	if err != nil {
+		return
+	}
+	state.Id = prev.Id
+	if err = SetWorkflowState(&state); err != nil {
+		return
+	}
+	if state.Overdue == "TRUE" && prev.Overdue != "TRUE" {
+		notifyWorkflowState(wf, state, WORKFLOW_STATE_OVERDUE)
+	}
+	if state.Escalated == "TRUE" && prev.Escalated != "TRUE" {
+		notifyWorkflowState(wf, state, WORKFLOW_STATE_ESCALATED)
+	}
+}
+func newWorkflowState(wf tukdbint.Workflow) (tukdbint.Workflowstate, error) {
+	e, err := newWorkflowEngine(wf)
+	if err != nil {
+		return tukdbint.Workflowstate{}, err
+	}
+	return e.State(), nil
+}
+
+// notifyWorkflowState notifies the FHIR subscribers of the workflow overdue or escalated topic and registers an Event Service event
+// recording the workflow has become overdue or escalated
+func notifyWorkflowState(wf tukdbint.Workflow, state tukdbint.Workflowstate, transition string) {
+	log.Printf("%s Workflow for NHS ID %s is now %s", state.Pathway, state.NHSId, transition)
+	switch transition {
+	case WORKFLOW_STATE_OVERDUE:
+		notifyFHIRSubscribers(wf, []string{FHIR_TOPIC_WORKFLOW_OVERDUE})
+	case WORKFLOW_STATE_ESCALATED:
+		notifyFHIRSubscribers(wf, []string{FHIR_TOPIC_WORKFLOW_ESCALATED})
+	}
+	ev := tukdbint.Event{
+		Creationtime: tukutil.Time_Now(),
+		EventType:    transition,
+		Expression:   transition,
+		Authors:      "Workflow State Scheduler",
+		NhsId:        state.NHSId,
+		User:         Services.EventService.User,
+		Org:          Services.EventService.Org,
+		Role:         Services.EventService.Role,
+		Pathway:      state.Pathway,
+		Comments:     state.Pathway + " workflow is " + transition + ". Complete by " + state.CompleteBy,
+		Version:      state.Version,
+		TaskId:       0,
+	}
+	evs := tukdbint.Events{Action: tukcnst.INSERT}
+	evs.Events = append(evs.Events, ev)
+	if err := tukdbint.NewDBEvent(&evs); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	log.Printf("Persisted %s notification Event id %v for %s workflow NHS ID %s", transition, evs.LastInsertId, state.Pathway, state.NHSId)
+}
@@ -0,0 +1,260 @@
+package tukint
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+const (
+	TUK_TASK_SLA            = "sla"
+	TUK_TEMPLATE_SLA_WIDGET = "slawidget"
+	SLA_STATUS_MET          = "MET"
+	SLA_STATUS_BREACHED     = "BREACHED"
+	SLA_STATUS_IN_PROGRESS  = "IN_PROGRESS"
+	SLA_STATUS_CANCELLED    = "CANCELLED"
+	SLA_REPORT_MONTH_FORMAT = "2006-01"
+	SLA_OP_BREACHES         = "breaches"
+	CSV                     = "csv"
+	TEXT_CSV                = "text/csv"
+)
+
+// SLATarget defines a pathway SLA. The SLA interval starts when the From task completes, or when the workflow starts if From is empty,
+// and ends when the To task completes, or when the workflow closes if To is empty. Target is a period, eg. week(18) or workday(10)
+type SLATarget struct {
+	Name   string `json:"name"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	Target string `json:"target"`
+}
+
+// SLAResult is the SLA status of a workflow
+type SLAResult struct {
+	WorkflowId int64  `json:"workflowid"`
+	Pathway    string `json:"pathway"`
+	NHSId      string `json:"nhsid"`
+	Version    int    `json:"version"`
+	Org        string `json:"org"`
+	Month      string `json:"month"`
+	SLA        string `json:"sla"`
+	Target     string `json:"target"`
+	Start      string `json:"start"`
+	Due        string `json:"due"`
+	End        string `json:"end"`
+	Status     string `json:"status"`
+	Breach     string `json:"breach"`
+}
+
+// SLAReportRow aggregates the SLA results for a pathway, org and month
+type SLAReportRow struct {
+	Pathway    string `json:"pathway"`
+	Org        string `json:"org"`
+	Month      string `json:"month"`
+	SLA        string `json:"sla"`
+	Total      int    `json:"total"`
+	Met        int    `json:"met"`
+	Breached   int    `json:"breached"`
+	InProgress int    `json:"inprogress"`
+	Cancelled  int    `json:"cancelled"`
+}
+type SLAReport struct {
+	Rows     []SLAReportRow `json:"rows"`
+	Breaches []SLAResult    `json:"breaches"`
+}
+
+// SLAResults returns the status of each SLA defined for the workflow pathway. SLAs of cancelled workflows that had not ended when the
+// workflow was cancelled are CANCELLED and are neither met nor breached
+func (e *workflowEngine) SLAResults() []SLAResult {
+	var results []SLAResult
+	for _, sla := range e.Flow.SLAs {
+		rslt := SLAResult{
+			WorkflowId: e.Workflow.Id,
+			Pathway:    e.Workflow.Pathway,
+			NHSId:      e.Workflow.NHSId,
+			Version:    e.Workflow.Version,
+			Org:        e.Document.Author.AssignedAuthor.ID.Extension,
+			Month:      e.startTime().Format(SLA_REPORT_MONTH_FORMAT),
+			SLA:        sla.Name,
+			Target:     sla.Target,
+			Status:     SLA_STATUS_IN_PROGRESS,
+		}
+		if e.Document.WorkflowStatus == WORKFLOW_STATUS_CANCELLED {
+			rslt.Status = SLA_STATUS_CANCELLED
+		}
+		start := e.startTime()
+		if sla.From != "" {
+			if start = e.taskCompletionTime(sla.From); start.IsZero() {
+				results = append(results, rslt)
+				continue
+			}
+		}
+		due := e.deadline(start, sla.Target)
+		rslt.Start = eventTime(start)
+		rslt.Due = eventTime(due)
+		end := e.workflowCompletionTime()
+		if sla.To != "" {
+			end = e.taskCompletionTime(sla.To)
+		}
+		switch {
+		case !end.IsZero():
+			rslt.End = eventTime(end)
+			rslt.Status = SLA_STATUS_MET
+			if end.After(due) {
+				rslt.Status = SLA_STATUS_BREACHED
+				rslt.Breach = end.Sub(due).Round(time.Minute).String()
+			}
+		case rslt.Status == SLA_STATUS_CANCELLED:
+		case time.Now().After(due):
+			rslt.Status = SLA_STATUS_BREACHED
+			rslt.Breach = time.Since(due).Round(time.Minute).String()
+		}
+		results = append(results, rslt)
+	}
+	return results
+}
+
+// eventTime returns the time formatted as Event Service event times are, RFC3339 in the calendar time zone
+func eventTime(t time.Time) string {
+	return t.In(Calendar().Location).Format(time.RFC3339)
+}
+
+// taskCompletionTime returns the time of the latest event of a task completed by its events or a zero time if the task is not complete
+// or was completed when the workflow closed
+func (e *workflowEngine) taskCompletionTime(taskid string) time.Time {
+	k := e.taskIndex(taskid)
+	if k < 0 || !e.isTaskCompletedByEvents(k) {
+		return time.Time{}
+	}
+	tevs := e.Document.TaskList.XDWTask[k].TaskEventHistory.TaskEvent
+	return Calendar().parseTime(tevs[len(tevs)-1].EventTime)
+}
+
+// isTaskCompletedByEvents returns true if the task is complete and its completion behaviour is met or, for a subworkflow task, its child
+// workflow closed. Tasks that are complete only because closeWorkflow completed the remaining tasks of the workflow return false
+func (e *workflowEngine) isTaskCompletedByEvents(k int) bool {
+	if e.Document.TaskList.XDWTask[k].TaskData.TaskDetails.Status != tukcnst.COMPLETE {
+		return false
+	}
+	if e.isSubworkflowTask(k) {
+		for _, tev := range e.Document.TaskList.XDWTask[k].TaskEventHistory.TaskEvent {
+			if tev.EventType == TASK_TYPE_SUBWORKFLOW {
+				return true
+			}
+		}
+		return false
+	}
+	if k >= len(e.Definition.Tasks) {
+		return false
+	}
+	trans := e.transaction()
+	trans.Task_ID = k
+	return trans.IsTaskCompleteBehaviorMet()
+}
+func (e *workflowEngine) workflowCompletionTime() time.Time {
+	if e.Document.WorkflowStatus != tukcnst.CLOSED {
+		return time.Time{}
+	}
+	return e.transaction().GetLatestWorkflowEventTime()
+}
+
+// newSLAReport returns the SLA results of the workflows aggregated by pathway, org, month and SLA
+func newSLAReport(wfs []tukdbint.Workflow) SLAReport {
+	report := SLAReport{}
+	rows := make(map[string]*SLAReportRow)
+	var keys []string
+	for _, wf := range wfs {
+		if wf.Id == 0 {
+			continue
+		}
+		e, err := newWorkflowEngine(wf)
+		if err != nil {
+			continue
+		}
+		for _, rslt := range e.SLAResults() {
+			key := rslt.Pathway + "|" + rslt.Org + "|" + rslt.Month + "|" + rslt.SLA
+			row, ok := rows[key]
+			if !ok {
+				row = &SLAReportRow{Pathway: rslt.Pathway, Org: rslt.Org, Month: rslt.Month, SLA: rslt.SLA}
+				rows[key] = row
+				keys = append(keys, key)
+			}
+			row.Total++
+			switch rslt.Status {
+			case SLA_STATUS_MET:
+				row.Met++
+			case SLA_STATUS_BREACHED:
+				row.Breached++
+				report.Breaches = append(report.Breaches, rslt)
+			case SLA_STATUS_CANCELLED:
+				row.Cancelled++
+			default:
+				row.InProgress++
+			}
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		report.Rows = append(report.Rows, *rows[key])
+	}
+	return report
+}
+
+// SLAWidget returns the SLA breach report of the workflows selected by the workflow filter query params, eg. pathway, created date range
+// and author org, as json, csv or html
+func (i *TukEvent) SLAWidget() []byte {
+	wfs := selectWorkflows(i.workflowFilter())
+	log.Printf("Reporting SLAs for %v Workflows", wfs.Count)
+	report := newSLAReport(wfs.Workflows)
+	switch {
+	case i.ReturnCSV:
+		if i.HttpResponse != nil {
+			i.HttpResponse.Header().Add(tukcnst.CONTENT_TYPE, TEXT_CSV)
+		}
+		return report.csv(i.Op)
+	case i.ReturnJSON:
+		if i.HttpResponse != nil {
+			i.HttpResponse.Header().Add(tukcnst.CONTENT_TYPE, tukcnst.APPLICATION_JSON)
+		}
+		b, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			log.Println(err.Error())
+			return []byte(err.Error())
+		}
+		return b
+	}
+	var b bytes.Buffer
+	if err := i.EventServices.HTMLTemplates.ExecuteTemplate(&b, TUK_TEMPLATE_SLA_WIDGET, report); err != nil {
+		log.Println(err.Error())
+		return []byte(err.Error())
+	}
+	return b.Bytes()
+}
+
+// csv returns the aggregated report, or the breach details if op is 'breaches', as csv
+func (r SLAReport) csv(op string) []byte {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	if op == SLA_OP_BREACHES {
+		w.Write([]string{"workflowid", "pathway", "nhsid", "version", "org", "month", "sla", "target", "start", "due", "end", "status", "breach"})
+		for _, rslt := range r.Breaches {
+			w.Write(csvRecord([]string{strconv.FormatInt(rslt.WorkflowId, 10), rslt.Pathway, rslt.NHSId, strconv.Itoa(rslt.Version), rslt.Org, rslt.Month, rslt.SLA, rslt.Target, rslt.Start, rslt.Due, rslt.End, rslt.Status, rslt.Breach}))
+		}
+	} else {
+		w.Write([]string{"pathway", "org", "month", "sla", "total", "met", "breached", "inprogress", "cancelled"})
+		for _, row := range r.Rows {
+			w.Write(csvRecord([]string{row.Pathway, row.Org, row.Month, row.SLA, strconv.Itoa(row.Total), strconv.Itoa(row.Met), strconv.Itoa(row.Breached), strconv.Itoa(row.InProgress), strconv.Itoa(row.Cancelled)}))
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Println(err.Error())
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,188 @@
+package tukint
+
+import (
+	"bytes"
+	"encoding/xml"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukutil"
+)
+
+const (
+	SOAP_11_NAMESPACE                   = "http://schemas.xmlsoap.org/soap/envelope/"
+	SOAP_12_NAMESPACE                   = "http://www.w3.org/2003/05/soap-envelope"
+	WSA_NAMESPACE                       = "http://www.w3.org/2005/08/addressing"
+	WSN_NAMESPACE                       = "http://docs.oasis-open.org/wsn/b-2"
+	TEXT_XML                            = "text/xml"
+	WSA_ACTION_NOTIFY                   = "http://docs.oasis-open.org/wsn/bw-2/NotificationConsumer/Notify"
+	WSA_ACTION_NOTIFY_RESPONSE          = "http://docs.oasis-open.org/wsn/bw-2/NotificationConsumer/NotifyResponse"
+	WSA_ACTION_FAULT                    = "http://www.w3.org/2005/08/addressing/fault"
+	SOAP_FAULT_VERSION_MISMATCH         = "VersionMismatch"
+	SOAP_FAULT_SENDER                   = "Sender"
+	SOAP_FAULT_RECEIVER                 = "Receiver"
+	SOAP_11_FAULT_CLIENT                = "Client"
+	SOAP_11_FAULT_SERVER                = "Server"
+	WSA_FAULT_ACTION_NOT_SUPPORTED      = "ActionNotSupported"
+	WSA_FAULT_HEADER_REQUIRED           = "MessageAddressingHeaderRequired"
+	WSA_FAULT_INVALID_ADDRESSING_HEADER = "InvalidAddressingHeader"
+)
+
+// soapTemplates are the SOAP 1.1 and 1.2 Notify ACK and Fault responses. wsa:RelatesTo is only returned when the request has a wsa:MessageID
+var soapTemplates = template.Must(template.New("soap").Funcs(template.FuncMap{"newuuid": tukutil.NewUuid, "xml": xmlEscape}).Parse(`{{define "header"}}<env:Header><wsa:Action>{{xml .Action}}</wsa:Action><wsa:MessageID>urn:uuid:{{newuuid}}</wsa:MessageID>{{if .MessageID}}<wsa:RelatesTo>{{xml .MessageID}}</wsa:RelatesTo>{{end}}<wsa:To>http://www.w3.org/2005/08/addressing/anonymous</wsa:To></env:Header>{{end}}` +
+	`{{define "ack"}}<env:Envelope xmlns:env='{{.Namespace}}' xmlns:wsa='http://www.w3.org/2005/08/addressing'>{{template "header" .}}<env:Body/></env:Envelope>{{end}}` +
+	`{{define "fault12"}}<env:Envelope xmlns:env='{{.Namespace}}' xmlns:wsa='http://www.w3.org/2005/08/addressing'>{{template "header" .}}<env:Body><env:Fault><env:Code><env:Value>env:{{.Fault.Code}}</env:Value>{{if .Fault.Subcode}}<env:Subcode><env:Value>wsa:{{.Fault.Subcode}}</env:Value></env:Subcode>{{end}}</env:Code><env:Reason><env:Text xml:lang='en'>{{xml .Fault.Reason}}</env:Text></env:Reason></env:Fault></env:Body></env:Envelope>{{end}}` +
+	`{{define "fault11"}}<env:Envelope xmlns:env='{{.Namespace}}' xmlns:wsa='http://www.w3.org/2005/08/addressing'>{{template "header" .}}<env:Body><env:Fault><faultcode>{{if .Fault.Subcode}}wsa:{{.Fault.Subcode}}{{else}}env:{{.Fault.Code}}{{end}}</faultcode><faultstring>{{xml .Fault.Reason}}</faultstring></env:Fault></env:Body></env:Envelope>{{end}}`))
+
+// soapEnvelope is a SOAP 1.1 or 1.2 envelope with WS-Addressing headers
+type soapEnvelope struct {
+	XMLName xml.Name
+	Header  struct {
+		Action    string `xml:"http://www.w3.org/2005/08/addressing Action"`
+		MessageID string `xml:"http://www.w3.org/2005/08/addressing MessageID"`
+	} `xml:"Header"`
+	Body struct {
+		XMLName xml.Name
+		Content []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+		InnerXML string `xml:",innerxml"`
+	} `xml:"Body"`
+}
+
+// soapMessage is a SOAP request received from the DSUB broker
+type soapMessage struct {
+	Namespace string
+	Action    string
+	MessageID string
+	Body      string
+	Fault     *soapFault
+}
+
+// soapFault is a SOAP Fault. Code is the SOAP 1.2 fault code and Subcode the WS-Addressing fault subcode
+type soapFault struct {
+	Code    string
+	Subcode string
+	Reason  string
+}
+
+// newSOAPMessage validates the SOAP envelope, WS-Addressing headers and wsa:Action of a DSUB Notify request. The SOAP version is that of
+// the request content type, or of the envelope if the content type is not a SOAP content type. A message with a Fault is returned if the
+// request is not a valid Notify request. A wsnt:Notify without a SOAP envelope, as sent by brokers before Notify requests were validated,
+// is accepted and acknowledged with a SOAP envelope of the request content type version
+func newSOAPMessage(contenttype string, soapaction string, body []byte) soapMessage {
+	msg := soapMessage{Namespace: SOAP_12_NAMESPACE}
+	mediatype, params, _ := mime.ParseMediaType(contenttype)
+	switch mediatype {
+	case TEXT_XML:
+		msg.Namespace = SOAP_11_NAMESPACE
+		msg.Action = strings.Trim(soapaction, "\"")
+	case tukcnst.SOAP_XML:
+		msg.Action = params["action"]
+	}
+	env := soapEnvelope{}
+	if err := xml.Unmarshal(body, &env); err != nil {
+		msg.Fault = &soapFault{Code: SOAP_FAULT_SENDER, Reason: "malformed soap message. " + err.Error()}
+		return msg
+	}
+	if env.XMLName.Local == "Notify" && env.XMLName.Space == WSN_NAMESPACE {
+		log.Println("Accepting wsnt:Notify request without a SOAP envelope")
+		msg.Body = strings.TrimSpace(string(body))
+		return msg
+	}
+	msg.MessageID = strings.TrimSpace(env.Header.MessageID)
+	if mediatype != TEXT_XML && mediatype != tukcnst.SOAP_XML && env.XMLName.Space == SOAP_11_NAMESPACE {
+		msg.Namespace = SOAP_11_NAMESPACE
+	}
+	if env.XMLName.Local != "Envelope" || env.XMLName.Space != msg.Namespace {
+		msg.Fault = &soapFault{Code: SOAP_FAULT_VERSION_MISMATCH, Reason: "expected a soap envelope in namespace " + msg.Namespace}
+		return msg
+	}
+	action := strings.TrimSpace(env.Header.Action)
+	if action == "" {
+		msg.Fault = &soapFault{Code: SOAP_FAULT_SENDER, Subcode: WSA_FAULT_HEADER_REQUIRED, Reason: "wsa:Action header is required"}
+		return msg
+	}
+	if msg.Action != "" && msg.Action != action {
+		msg.Fault = &soapFault{Code: SOAP_FAULT_SENDER, Subcode: WSA_FAULT_INVALID_ADDRESSING_HEADER, Reason: "wsa:Action " + action + " does not match the soap action " + msg.Action}
+		return msg
+	}
+	msg.Action = action
+	if action != WSA_ACTION_NOTIFY {
+		msg.Fault = &soapFault{Code: SOAP_FAULT_SENDER, Subcode: WSA_FAULT_ACTION_NOT_SUPPORTED, Reason: "wsa:Action " + action + " is not supported"}
+		return msg
+	}
+	if env.Body.XMLName.Space != msg.Namespace || len(env.Body.Content) != 1 || env.Body.Content[0].XMLName.Local != "Notify" || env.Body.Content[0].XMLName.Space != WSN_NAMESPACE {
+		msg.Fault = &soapFault{Code: SOAP_FAULT_SENDER, Reason: "soap body must contain a single wsnt:Notify element"}
+		return msg
+	}
+	msg.Body = strings.TrimSpace(env.Body.InnerXML)
+	return msg
+}
+
+// isSOAPNotifyRequest returns true if the POST request is a DSUB Notify request, ie. it has a SOAP or XML content type or its body is a
+// wsnt:Notify message
+func isSOAPNotifyRequest(contenttype string, body string) bool {
+	mediatype, _, _ := mime.ParseMediaType(contenttype)
+	switch mediatype {
+	case TEXT_XML, tukcnst.SOAP_XML, tukcnst.APPLICATION_XML:
+		return true
+	}
+	return strings.Contains(body, WSN_NAMESPACE) && strings.Contains(body, "Notify")
+}
+
+// contentType returns the response content type of the SOAP version
+func (m soapMessage) contentType() string {
+	if m.Namespace == SOAP_11_NAMESPACE {
+		return tukcnst.TEXT_XML_CHARSET_UTF_8
+	}
+	return tukcnst.SOAP_XML + "; charset=utf-8"
+}
+
+// statusCode returns the http status of the response. SOAP 1.2 sender faults are bad requests, all other faults are server errors
+func (m soapMessage) statusCode() int {
+	switch {
+	case m.Fault == nil:
+		return http.StatusOK
+	case m.Namespace == SOAP_12_NAMESPACE && m.Fault.Code == SOAP_FAULT_SENDER:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// response returns the Notify ACK, or the SOAP Fault if the message has a Fault, with the request message id as wsa:RelatesTo
+func (m soapMessage) response() []byte {
+	tmplt := "ack"
+	rsp := m
+	rsp.Action = WSA_ACTION_NOTIFY_RESPONSE
+	if m.Fault != nil {
+		rsp.Action = WSA_ACTION_FAULT
+		tmplt = "fault12"
+		if m.Namespace == SOAP_11_NAMESPACE {
+			tmplt = "fault11"
+			f := *m.Fault
+			switch f.Code {
+			case SOAP_FAULT_SENDER:
+				f.Code = SOAP_11_FAULT_CLIENT
+			case SOAP_FAULT_RECEIVER:
+				f.Code = SOAP_11_FAULT_SERVER
+			}
+			rsp.Fault = &f
+		}
+	}
+	var b bytes.Buffer
+	if err := soapTemplates.ExecuteTemplate(&b, tmplt, rsp); err != nil {
+		return []byte(tukcnst.GO_TEMPLATE_DSUB_ACK)
+	}
+	return b.Bytes()
+}
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,239 @@
+package tukint
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+const (
+	TUK_TASK_RECONCILE            = "reconcile"
+	TUK_TEMPLATE_RECONCILE_WIDGET = "reconcilewidget"
+	RECONCILE_OP_APPLY            = "apply"
+	DSUB_BROKER_USER              = "DSUB"
+	DSUB_BROKER_ORG               = "ICB"
+	DSUB_BROKER_ROLE              = "BROKER"
+)
+
+var reconcileLock sync.Mutex
+
+// SubscriptionReconciliation is the difference between the subscriptions expected from the registered workflow definitions and the
+// subscriptions table. Missing subscriptions have no subscription with a current broker ref, expired subscriptions have no broker ref or
+// have passed their broker termination time and orphaned subscriptions are not expected by any workflow definition. Subscriptions created
+// explicitly with the subscription create operation are never orphaned. Patient subscriptions are not reconciled, so the pathway
+// subscriptions of patient subscription pathways are orphaned
+type SubscriptionReconciliation struct {
+	Reconciled     string                  `json:"reconciled"`
+	Applied        bool                    `json:"applied"`
+	Expected       int                     `json:"expected"`
+	Missing        []tukdbint.Subscription `json:"missing"`
+	Expired        []tukdbint.Subscription `json:"expired"`
+	Orphaned       []tukdbint.Subscription `json:"orphaned"`
+	Resubscribed   int                     `json:"resubscribed"`
+	Cancelled      int                     `json:"cancelled"`
+	Errors         []string                `json:"errors"`
+	brokerrefs     map[string]string
+	missingFilters []DSUBFilter
+}
+
+// StartSubscriptionReconciler reconciles the subscriptions every interval. An interval of 0 disables the reconciler
+func StartSubscriptionReconciler(interval time.Duration) {
+	if interval <= 0 {
+		log.Println("Subscription Reconciler is disabled")
+		return
+	}
+	log.Printf("Starting Subscription Reconciler. Interval %s", interval.String())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := ReconcileSubscriptions(true); err != nil {
+				log.Println(err.Error())
+			}
+		}
+	}()
+}
+
+// ReconcileSubscriptions compares the expected and registered subscriptions. If apply is true missing and expired subscriptions are
+// re-subscribed with the DSUB broker and orphaned subscriptions are cancelled
+func ReconcileSubscriptions(apply bool) (SubscriptionReconciliation, error) {
+	r := SubscriptionReconciliation{Reconciled: time.Now().UTC().Format(NOTIFICATION_TIME_FORMAT), Applied: apply, brokerrefs: make(map[string]string)}
+	if !reconcileLock.TryLock() {
+		return r, errors.New("subscription reconciliation is already running")
+	}
+	defer reconcileLock.Unlock()
+	if tukdbint.DBConn == nil {
+		return r, errors.New("no database connection available for subscription reconciliation")
+	}
+	expected, err := expectedSubscriptions()
+	if err != nil {
+		return r, err
+	}
+	r.Expected = len(expected)
+	states, err := getSubscriptionStates()
+	if err != nil {
+		return r, err
+	}
+	filters, err := getSubscriptionFilters()
+	if err != nil {
+		return r, err
+	}
+	now := time.Now().UTC().Format(TERMINATION_TIME_FORMAT)
+	current := make(map[string]bool)
+	for _, sub := range tukdbint.GetSubscriptions("", "", "").Subscriptions {
+		if sub.Id == 0 || sub.NhsId != "" {
+			continue
+		}
+		filterkey := filters[sub.BrokerRef].key()
+		key := sub.Pathway + "|" + sub.Expression + "|" + filterkey
+		state := states[sub.BrokerRef]
+		_, ok := expected[key]
+		switch {
+		case !ok && state.Origin == SUBSCRIPTION_ORIGIN_USER:
+			continue
+		case !ok:
+			r.Orphaned = append(r.Orphaned, sub)
+		case sub.BrokerRef == "" || (state.TerminationTime != "" && state.TerminationTime < now):
+			r.Expired = append(r.Expired, sub)
+		default:
+			current[key] = true
+			r.brokerrefs[sub.Expression+"|"+filterkey] = sub.BrokerRef
+		}
+	}
+	for key, filter := range expected {
+		if !current[key] {
+			parts := strings.SplitN(key, "|", 3)
+			r.Missing = append(r.Missing, tukdbint.Subscription{Pathway: parts[0], Expression: parts[1], Topic: tukcnst.DSUB_TOPIC_TYPE_CODE})
+			r.missingFilters = append(r.missingFilters, filter)
+		}
+	}
+	log.Printf("Reconciled Subscriptions. Expected %v Missing %v Expired %v Orphaned %v", r.Expected, len(r.Missing), len(r.Expired), len(r.Orphaned))
+	if apply {
+		r.apply()
+	}
+	return r, nil
+}
+
+// apply cancels the orphaned and expired subscriptions and re-subscribes the missing subscriptions. Missing subscriptions use the current
+// broker ref of their expression and filter if another pathway is subscribed to it
+func (r *SubscriptionReconciliation) apply() {
+	for _, sub := range r.Orphaned {
+		if err := cancelSubscription(sub, true); err != nil {
+			r.Errors = append(r.Errors, "cancel "+sub.Pathway+" "+sub.Expression+": "+err.Error())
+			continue
+		}
+		r.Cancelled++
+	}
+	for _, sub := range r.Expired {
+		if err := cancelSubscription(sub, false); err != nil {
+			r.Errors = append(r.Errors, "cancel "+sub.Pathway+" "+sub.Expression+": "+err.Error())
+			continue
+		}
+		r.Cancelled++
+	}
+	for k, sub := range r.Missing {
+		filter := r.missingFilters[k]
+		sub.User, sub.Org, sub.Role = DSUB_BROKER_USER, DSUB_BROKER_ORG, DSUB_BROKER_ROLE
+		brokerref, ok := r.brokerrefs[sub.Expression+"|"+filter.key()]
+		if !ok {
+			var err error
+			if brokerref, err = registerSubscription(sub, filter, defaultTerminationTime(Services.EventService.SubscriptionTerm), SUBSCRIPTION_ORIGIN_WORKFLOW); err != nil {
+				r.Errors = append(r.Errors, "subscribe "+sub.Pathway+" "+sub.Expression+": "+err.Error())
+				continue
+			}
+			r.brokerrefs[sub.Expression+"|"+filter.key()] = brokerref
+		} else {
+			sub.BrokerRef = brokerref
+			subs := tukdbint.Subscriptions{Action: tukcnst.INSERT}
+			subs.Subscriptions = append(subs.Subscriptions, sub)
+			if err := tukdbint.NewDBEvent(&subs); err != nil {
+				r.Errors = append(r.Errors, "register "+sub.Pathway+" "+sub.Expression+": "+err.Error())
+				continue
+			}
+		}
+		log.Printf("Re-subscribed %s Subscription to %s with Broker Ref %s", sub.Pathway, sub.Expression, brokerref)
+		r.Resubscribed++
+	}
+	for _, err := range r.Errors {
+		log.Println(err)
+	}
+}
+
+// expectedSubscriptions returns the filter of each XDS registered task input and output of the registered workflow definitions keyed by
+// pathway, expression and filter. Patient subscription pathways expect no pathway subscriptions
+func expectedSubscriptions() (map[string]DSUBFilter, error) {
+	expected := make(map[string]DSUBFilter)
+	xdws, err := tukdbint.GetWorkflowDefinitions()
+	if err != nil {
+		return expected, err
+	}
+	for _, xdw := range xdws.XDW {
+		if xdw.Id == 0 || xdw.IsXDSMeta {
+			continue
+		}
+		def, err := newDSUBDefinition(xdw.XDW)
+		if err != nil {
+			log.Printf("Unable to parse Workflow Definition %s. %s", xdw.Name, err.Error())
+			continue
+		}
+		if isPatientSubscriptionPathway(def.Ref) {
+			continue
+		}
+		for _, c := range def.criteria() {
+			expected[def.Ref+"|"+c.Expression+"|"+c.Filter.key()] = c.Filter
+		}
+	}
+	return expected, nil
+}
+
+// cancelSubscription deletes the subscription. If unsubscribe is true and no other subscription has its broker ref the broker ref is
+// unsubscribed
+func cancelSubscription(sub tukdbint.Subscription, unsubscribe bool) error {
+	subs := tukdbint.Subscriptions{Action: tukcnst.DELETE}
+	subs.Subscriptions = append(subs.Subscriptions, tukdbint.Subscription{Id: sub.Id})
+	if err := tukdbint.NewDBEvent(&subs); err != nil {
+		return err
+	}
+	log.Printf("Cancelled %s Subscription %v to %s", sub.Pathway, sub.Id, sub.Expression)
+	if !unsubscribe || sub.BrokerRef == "" || tukdbint.GetSubscriptions(sub.BrokerRef, "", "").Count > 0 {
+		return nil
+	}
+	req := brokerSubscription{BrokerRef: sub.BrokerRef}
+	return req.unsubscribe()
+}
+
+// reconcileSubscriptions returns the reconciliation of the subscriptions. The reconciliation is only applied if the op is apply
+func (i *TukEvent) reconcileSubscriptions() []byte {
+	r, err := ReconcileSubscriptions(i.Op == RECONCILE_OP_APPLY)
+	if err != nil {
+		log.Println(err.Error())
+		i.ReturnCode = http.StatusInternalServerError
+		return []byte(err.Error())
+	}
+	i.Reconciliation = r
+	if i.ReturnJSON {
+		if i.HttpResponse != nil {
+			i.HttpResponse.Header().Add(tukcnst.CONTENT_TYPE, tukcnst.APPLICATION_JSON)
+		}
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			log.Println(err.Error())
+			return []byte(err.Error())
+		}
+		return b
+	}
+	var b bytes.Buffer
+	if err := i.EventServices.HTMLTemplates.ExecuteTemplate(&b, TUK_TEMPLATE_RECONCILE_WIDGET, i); err != nil {
+		log.Println(err.Error())
+		return []byte(err.Error())
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,192 @@
+package tukint
+
+import (
+	"log"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukutil"
+	"github.com/ipthomas/tukxdw"
+)
+
+const (
+	TASK_TYPE_SUBWORKFLOW                 = "subworkflow"
+	XDW_TASKEVENTTYPE_SUBWORKFLOW_CREATED = "SUBWORKFLOW_CREATED"
+	XDW_TASKEVENTTYPE_SUBWORKFLOW_CLOSED  = "SUBWORKFLOW_COMPLETED"
+)
+
+// WorkflowLink records a child workflow created by a parent workflow subworkflow task
+type WorkflowLink struct {
+	Id            int64  `json:"id"`
+	Created       string `json:"created"`
+	ParentId      int64  `json:"parentid"`
+	ParentPathway string `json:"parentpathway"`
+	ParentTask    string `json:"parenttask"`
+	ChildId       int64  `json:"childid"`
+	ChildPathway  string `json:"childpathway"`
+	NHSId         string `json:"nhsid"`
+	Status        string `json:"status"`
+}
+
+func (e *workflowEngine) isSubworkflowTask(k int) bool {
+	return e.Document.TaskList.XDWTask[k].TaskData.TaskDetails.TaskType == TASK_TYPE_SUBWORKFLOW
+}
+
+// applySubworkflowEvent completes a parent workflow subworkflow task when the child workflow has closed
+func (e *workflowEngine) applySubworkflowEvent(ev tukdbint.Event) (bool, bool) {
+	k := e.taskIndex(tukutil.GetStringFromInt(ev.TaskId))
+	if k < 0 || !e.isSubworkflowTask(k) {
+		return false, false
+	}
+	if !e.isTaskActive(k) {
+		return true, false
+	}
+	for _, tev := range e.Document.TaskList.XDWTask[k].TaskEventHistory.TaskEvent {
+		if tev.ID == tukutil.GetStringFromInt(int(ev.Id)) {
+			log.Printf("Task %v Event %v is registered. Skipping Event", ev.TaskId, ev.Id)
+			return true, false
+		}
+	}
+	log.Printf("Completing Subworkflow Task %v with Event ID %v", ev.TaskId, ev.Id)
+	e.newTaskEvent(k, ev)
+	e.Document.TaskList.XDWTask[k].TaskData.TaskDetails.Status = tukcnst.COMPLETE
+	e.activateTasks()
+	return true, true
+}
+
+// spawnSubworkflows creates the child workflow of any active subworkflow task that does not have a child workflow
+func (e *workflowEngine) spawnSubworkflows() {
+	if e.Workflow.Id == 0 || e.Document.WorkflowStatus != tukcnst.OPEN {
+		return
+	}
+	links, err := getWorkflowLinks("parentid", e.Workflow.Id)
+	if err != nil {
+		return
+	}
+	for k, task := range e.Document.TaskList.XDWTask {
+		if !e.isSubworkflowTask(k) || task.TaskData.TaskDetails.Status == tukcnst.COMPLETE || !e.isTaskActive(k) {
+			continue
+		}
+		linked := false
+		for _, link := range links {
+			if link.ParentTask == task.TaskData.TaskDetails.ID {
+				linked = true
+			}
+		}
+		if linked {
+			continue
+		}
+		pathway := e.taskFlow(task.TaskData.TaskDetails.ID).Pathway
+		if pathway == "" {
+			log.Printf("Subworkflow Task %s does not specify a pathway", task.TaskData.TaskDetails.ID)
+			continue
+		}
+		newSubworkflow(e.Workflow, task.TaskData.TaskDetails.ID, pathway)
+	}
+}
+func newSubworkflow(parent tukdbint.Workflow, taskid string, pathway string) {
+	log.Printf("Creating %s Subworkflow for %s Workflow Task %s NHS ID %s", pathway, parent.Pathway, taskid, parent.NHSId)
+	trans := tukxdw.Transaction{
+		Actor:   tukcnst.XDW_ACTOR_CONTENT_CREATOR,
+		Pathway: pathway,
+		NHS_ID:  parent.NHSId,
+		User:    Services.EventService.User,
+		Org:     Services.EventService.Org,
+		Role:    Services.EventService.Role,
+	}
+	if err := tukxdw.Execute(&trans); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	link := WorkflowLink{
+		Created:       tukutil.Time_Now(),
+		ParentId:      parent.Id,
+		ParentPathway: parent.Pathway,
+		ParentTask:    taskid,
+		ChildId:       trans.Workflows.LastInsertId,
+		ChildPathway:  pathway,
+		NHSId:         parent.NHSId,
+		Status:        tukcnst.TUK_STATUS_OPEN,
+	}
+	if err := setWorkflowLink(&link); err != nil {
+		return
+	}
+	ev := tukdbint.Event{
+		Creationtime: tukutil.Time_Now(),
+		EventType:    XDW_TASKEVENTTYPE_SUBWORKFLOW_CREATED,
+		Expression:   pathway,
+		Authors:      Services.EventService.User + " " + Services.EventService.Org + " " + Services.EventService.Role,
+		NhsId:        parent.NHSId,
+		User:         Services.EventService.User,
+		Org:          Services.EventService.Org,
+		Role:         Services.EventService.Role,
+		Pathway:      parent.Pathway,
+		Comments:     "Created " + pathway + " workflow",
+		Version:      parent.Version,
+		TaskId:       tukutil.GetIntFromString(taskid),
+	}
+	evs := tukdbint.Events{Action: tukcnst.INSERT}
+	evs.Events = append(evs.Events, ev)
+	if err := tukdbint.NewDBEvent(&evs); err != nil {
+		log.Println(err.Error())
+	}
+	newWorkflowCreated(link.ChildId, pathway)
+}
+
+// closeSubworkflow registers the closure of a child workflow against its parent workflow task and updates the parent workflow
+func closeSubworkflow(child tukdbint.Workflow) {
+	if child.Id == 0 {
+		return
+	}
+	links, err := getWorkflowLinks("childid", child.Id)
+	if err != nil {
+		return
+	}
+	for _, link := range links {
+		if link.Status != tukcnst.TUK_STATUS_OPEN {
+			continue
+		}
+		parent, err := getWorkflow(link.ParentId)
+		if err != nil {
+			continue
+		}
+		log.Printf("%s Subworkflow for NHS ID %s is complete. Completing %s Workflow Task %s", child.Pathway, child.NHSId, parent.Pathway, link.ParentTask)
+		ev := tukdbint.Event{
+			Creationtime: tukutil.Time_Now(),
+			EventType:    XDW_TASKEVENTTYPE_SUBWORKFLOW_CLOSED,
+			Expression:   child.Pathway,
+			Authors:      Services.EventService.User + " " + Services.EventService.Org + " " + Services.EventService.Role,
+			NhsId:        parent.NHSId,
+			User:         Services.EventService.User,
+			Org:          Services.EventService.Org,
+			Role:         Services.EventService.Role,
+			Pathway:      parent.Pathway,
+			Comments:     child.Pathway + " workflow is complete",
+			Version:      parent.Version,
+			TaskId:       tukutil.GetIntFromString(link.ParentTask),
+		}
+		evs := tukdbint.Events{Action: tukcnst.INSERT}
+		evs.Events = append(evs.Events, ev)
+		if err := tukdbint.NewDBEvent(&evs); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		link.Status = tukcnst.TUK_STATUS_CLOSED
+		setWorkflowLink(&link)
+		if err := updateWorkflows(parent.Pathway, parent.NHSId, parent.Version); err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
+// WorkflowLinks returns the parent and child workflow links of a workflow
+func (i *TukEvent) WorkflowLinks(workflowid int64) []WorkflowLink {
+	var links []WorkflowLink
+	if parents, err := getWorkflowLinks("childid", workflowid); err == nil {
+		links = append(links, parents...)
+	}
+	if children, err := getWorkflowLinks("parentid", workflowid); err == nil {
+		links = append(links, children...)
+	}
+	return links
+}
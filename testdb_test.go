@@ -0,0 +1,101 @@
+//go:build integration
+
+package tukint
+
+import (
+	"database/sql"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/ipthomas/tukdbint"
+)
+
+// The integration tests run against a MySQL database. TUK_TEST_DB_DSN is the go-sql-driver/mysql data source name of a scratch
+// database, eg. root:password@tcp(localhost:3306)/tukinttest. The tables of the database are dropped and created for each test.
+// Run the tests with go test -tags integration
+
+const TUK_TEST_DB_DSN = "TUK_TEST_DB_DSN"
+
+var testTables = []string{
+	"CREATE TABLE IF NOT EXISTS workflows (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, pathway VARCHAR(255) NOT NULL DEFAULT '', nhsid VARCHAR(32) NOT NULL DEFAULT '', created VARCHAR(64) NOT NULL DEFAULT '2023-01-01 00:00:00', xdw_key VARCHAR(255) NOT NULL DEFAULT '', xdw_uid VARCHAR(255) NOT NULL DEFAULT '', xdw_doc MEDIUMTEXT NOT NULL, xdw_def MEDIUMTEXT NOT NULL, version INT NOT NULL DEFAULT 0, published BOOLEAN NOT NULL DEFAULT 0, status VARCHAR(16) NOT NULL DEFAULT '', UNIQUE (xdw_key, version))",
+	"CREATE TABLE IF NOT EXISTS events (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, creationtime VARCHAR(64) NOT NULL DEFAULT '2023-01-01 00:00:00', eventtype VARCHAR(255) NOT NULL DEFAULT '', docname VARCHAR(255) NOT NULL DEFAULT '', classcode VARCHAR(255) NOT NULL DEFAULT '', confcode VARCHAR(255) NOT NULL DEFAULT '', formatcode VARCHAR(255) NOT NULL DEFAULT '', facilitycode VARCHAR(255) NOT NULL DEFAULT '', practicecode VARCHAR(255) NOT NULL DEFAULT '', speciality VARCHAR(255) NOT NULL DEFAULT '', expression VARCHAR(255) NOT NULL DEFAULT '', authors VARCHAR(255) NOT NULL DEFAULT '', xdspid VARCHAR(255) NOT NULL DEFAULT '', xdsdocentryuid VARCHAR(255) NOT NULL DEFAULT '', repositoryuniqueid VARCHAR(255) NOT NULL DEFAULT '', nhsid VARCHAR(32) NOT NULL DEFAULT '', user VARCHAR(255) NOT NULL DEFAULT '', org VARCHAR(255) NOT NULL DEFAULT '', role VARCHAR(255) NOT NULL DEFAULT '', topic VARCHAR(255) NOT NULL DEFAULT '', pathway VARCHAR(255) NOT NULL DEFAULT '', comments TEXT, version INT NOT NULL DEFAULT 0, taskid INT NOT NULL DEFAULT 0, brokerref VARCHAR(255) NOT NULL DEFAULT '')",
+	"CREATE TABLE IF NOT EXISTS subscriptions (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, created VARCHAR(64) NOT NULL DEFAULT '2023-01-01 00:00:00', brokerref VARCHAR(255) NOT NULL DEFAULT '', pathway VARCHAR(255) NOT NULL DEFAULT '', topic VARCHAR(255) NOT NULL DEFAULT '', expression VARCHAR(255) NOT NULL DEFAULT '', email VARCHAR(255) NOT NULL DEFAULT '', nhsid VARCHAR(32) NOT NULL DEFAULT '', user VARCHAR(255) NOT NULL DEFAULT '', org VARCHAR(255) NOT NULL DEFAULT '', role VARCHAR(255) NOT NULL DEFAULT '')",
+	"CREATE TABLE IF NOT EXISTS workflowstate (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, workflowid INT NOT NULL, pathway VARCHAR(255) NOT NULL DEFAULT '', nhsid VARCHAR(32) NOT NULL DEFAULT '', version INT NOT NULL DEFAULT 0, published BOOLEAN NOT NULL DEFAULT 0, created VARCHAR(64) NOT NULL DEFAULT '', createdby VARCHAR(255) NOT NULL DEFAULT '', status VARCHAR(16) NOT NULL DEFAULT '', completeby VARCHAR(64) NOT NULL DEFAULT '', lastupdate VARCHAR(64) NOT NULL DEFAULT '', owner VARCHAR(255) NOT NULL DEFAULT '', overdue VARCHAR(8) NOT NULL DEFAULT '', escalated VARCHAR(8) NOT NULL DEFAULT '', targetmet VARCHAR(8) NOT NULL DEFAULT '', inprogress VARCHAR(8) NOT NULL DEFAULT '', duration VARCHAR(64) NOT NULL DEFAULT '', timeremaining VARCHAR(64) NOT NULL DEFAULT '', UNIQUE (workflowid))",
+	"CREATE TABLE IF NOT EXISTS xdws (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, name VARCHAR(255) NOT NULL DEFAULT '', isxdsmeta BOOLEAN NOT NULL DEFAULT 0, xdw MEDIUMTEXT NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS idmaps (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, lid VARCHAR(255) NOT NULL DEFAULT '', mid VARCHAR(255) NOT NULL DEFAULT '', user VARCHAR(255) NOT NULL DEFAULT '')",
+}
+
+var testTableName = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+)`)
+
+// testDB is the test database
+type testDB struct {
+	conn *sql.DB
+}
+
+// newTestDB sets tukdbint.DBConn to the test database holding empty tukdbint and tukint tables. The test is skipped if no test database
+// is configured
+func newTestDB(t *testing.T) *testDB {
+	t.Helper()
+	dsn := os.Getenv(TUK_TEST_DB_DSN)
+	if dsn == "" {
+		t.Skip(TUK_TEST_DB_DSN + " is not set")
+	}
+	conn, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := tukdbint.DBConn
+	tukdbint.DBConn = conn
+	t.Cleanup(func() {
+		conn.Close()
+		tukdbint.DBConn = prev
+	})
+	for _, stmnt := range append(testTables, tukintTables...) {
+		if _, err := conn.Exec("DROP TABLE IF EXISTS " + testTableName.FindStringSubmatch(stmnt)[1]); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Exec(stmnt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &testDB{conn: conn}
+}
+
+// Rows returns the rows of the table in id order. Column values are strings, or nil if the column is null
+func (db *testDB) Rows(t *testing.T, table string) []map[string]interface{} {
+	t.Helper()
+	rows, err := db.conn.Query("SELECT * FROM " + table + " ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tablerows []map[string]interface{}
+	for rows.Next() {
+		vals := make([]sql.NullString, len(cols))
+		dest := make([]interface{}, len(cols))
+		for k := range vals {
+			dest[k] = &vals[k]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			t.Fatal(err)
+		}
+		row := make(map[string]interface{})
+		for k, col := range cols {
+			if vals[k].Valid {
+				row[col] = vals[k].String
+			} else {
+				row[col] = nil
+			}
+		}
+		tablerows = append(tablerows, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return tablerows
+}
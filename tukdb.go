@@ -0,0 +1,864 @@
+package tukint
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+)
+
+// Event Service persistence not provided by tukdbint
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+var tukintTables = []string{
+	"CREATE TABLE IF NOT EXISTS eventerrors (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, created VARCHAR(64), eventid INT NOT NULL, pathway VARCHAR(255), nhsid VARCHAR(32), user VARCHAR(255), org VARCHAR(255), role VARCHAR(255), reason TEXT, INDEX (pathway, nhsid))",
+	"CREATE TABLE IF NOT EXISTS workflowlinks (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, created VARCHAR(64), parentid INT NOT NULL, parentpathway VARCHAR(255), parenttask VARCHAR(16), childid INT NOT NULL, childpathway VARCHAR(255), nhsid VARCHAR(32), status VARCHAR(16), INDEX (parentid), INDEX (childid))",
+	"CREATE TABLE IF NOT EXISTS fhirsubscriptions (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, created VARCHAR(64), status VARCHAR(16), topic VARCHAR(64), pathway VARCHAR(255), nhsid VARCHAR(32), endpoint VARCHAR(1024), header TEXT, content VARCHAR(16), reason TEXT, end VARCHAR(64), eventcount INT NOT NULL DEFAULT 0, failures INT NOT NULL DEFAULT 0, lastdelivery VARCHAR(64), lasterror TEXT, INDEX (status))",
+	"CREATE TABLE IF NOT EXISTS fhirdeliveries (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, created DATETIME NOT NULL, subscriptionid INT NOT NULL, workflowid INT NOT NULL, eventnumber INT NOT NULL, status VARCHAR(16) NOT NULL, attempts INT NOT NULL DEFAULT 0, nextattempt DATETIME NOT NULL, lasterror TEXT, delivered DATETIME, INDEX (status, nextattempt))",
+	"CREATE TABLE IF NOT EXISTS processednotifications (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, brokerref VARCHAR(255) NOT NULL, xdsdocentryuid VARCHAR(255) NOT NULL, pathway VARCHAR(255) NOT NULL, received DATETIME NOT NULL, duplicates INT NOT NULL DEFAULT 0, UNIQUE (brokerref, xdsdocentryuid, pathway))",
+	"CREATE TABLE IF NOT EXISTS notificationinbox (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, received DATETIME NOT NULL, status VARCHAR(16) NOT NULL, stage VARCHAR(16) NOT NULL DEFAULT '', attempts INT NOT NULL DEFAULT 0, nextattempt DATETIME NOT NULL, lasterror TEXT, processed DATETIME, brokerref VARCHAR(255), xdsdocentryuid VARCHAR(255), message MEDIUMTEXT, INDEX (status, nextattempt))",
+	"CREATE TABLE IF NOT EXISTS subscriptionstates (brokerref VARCHAR(255) NOT NULL PRIMARY KEY, status VARCHAR(16) NOT NULL, terminationtime VARCHAR(32), origin VARCHAR(16) NOT NULL DEFAULT '', updated DATETIME NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS subscriptionfilters (brokerref VARCHAR(255) NOT NULL PRIMARY KEY, filter TEXT NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS patientsubscriptionqueue (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, queued DATETIME NOT NULL, pathway VARCHAR(255) NOT NULL, nhsid VARCHAR(32) NOT NULL, op VARCHAR(16) NOT NULL, UNIQUE (pathway, nhsid))",
+	"CREATE TABLE IF NOT EXISTS holidays (id INT NOT NULL AUTO_INCREMENT PRIMARY KEY, holiday VARCHAR(10) NOT NULL, description VARCHAR(255), UNIQUE (holiday))",
+}
+
+// initTukintTables creates the Event Service tables not included in the tukdbint schema
+func initTukintTables() error {
+	if tukdbint.DBConn == nil {
+		return errors.New("no database connection available to initialise event service tables")
+	}
+	for _, stmnt := range tukintTables {
+		ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := tukdbint.DBConn.ExecContext(ctx, stmnt)
+		cancelCtx()
+		if err != nil {
+			log.Println(err.Error())
+			return err
+		}
+	}
+	log.Printf("Initialised %v Event Service tables", len(tukintTables))
+	return nil
+}
+
+func GetWorkflowState(workflowid int64) (tukdbint.Workflowstate, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	state, err := scanWorkflowState(tukdbint.DBConn.QueryRowContext(ctx, "SELECT "+workflowStateColumns+" FROM workflowstate WHERE workflowid = ?", workflowid))
+	if err == sql.ErrNoRows {
+		return tukdbint.Workflowstate{}, nil
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return state, err
+}
+func SetWorkflowState(state *tukdbint.Workflowstate) error {
+	var err error
+	var rslt sql.Result
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	if state.Id > 0 {
+		_, err = tukdbint.DBConn.ExecContext(ctx, "UPDATE workflowstate SET pathway = ?, nhsid = ?, version = ?, published = ?, created = ?, createdby = ?, status = ?, completeby = ?, lastupdate = ?, owner = ?, overdue = ?, escalated = ?, targetmet = ?, inprogress = ?, duration = ?, timeremaining = ? WHERE id = ?",
+			state.Pathway, state.NHSId, state.Version, state.Published, state.Created, state.CreatedBy, state.Status, state.CompleteBy, state.LastUpdate, state.Owner, state.Overdue, state.Escalated, state.TargetMet, state.InProgress, state.Duration, state.TimeRemaining, state.Id)
+	} else {
+		rslt, err = tukdbint.DBConn.ExecContext(ctx, "INSERT INTO workflowstate (workflowid, pathway, nhsid, version, published, created, createdby, status, completeby, lastupdate, owner, overdue, escalated, targetmet, inprogress, duration, timeremaining) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			state.WorkflowId, state.Pathway, state.NHSId, state.Version, state.Published, state.Created, state.CreatedBy, state.Status, state.CompleteBy, state.LastUpdate, state.Owner, state.Overdue, state.Escalated, state.TargetMet, state.InProgress, state.Duration, state.TimeRemaining)
+		if err == nil {
+			state.Id, err = rslt.LastInsertId()
+		}
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+func getOpenWorkflowStates() (tukdbint.WorkflowStates, error) {
+	states := tukdbint.WorkflowStates{Action: tukcnst.SELECT}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	rows, err := tukdbint.DBConn.QueryContext(ctx, "SELECT "+workflowStateColumns+" FROM workflowstate WHERE status = ?", tukcnst.TUK_STATUS_OPEN)
+	if err != nil {
+		log.Println(err.Error())
+		return states, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		state, err := scanWorkflowState(rows)
+		if err != nil {
+			log.Println(err.Error())
+			return states, err
+		}
+		states.Workflowstate = append(states.Workflowstate, state)
+		states.Count = states.Count + 1
+	}
+	return states, rows.Err()
+}
+
+const workflowStateColumns = "id, workflowid, pathway, nhsid, version, published, created, createdby, status, completeby, lastupdate, owner, overdue, escalated, targetmet, inprogress, duration, timeremaining"
+
+func scanWorkflowState(row rowScanner) (tukdbint.Workflowstate, error) {
+	state := tukdbint.Workflowstate{}
+	err := row.Scan(&state.Id, &state.WorkflowId, &state.Pathway, &state.NHSId, &state.Version, &state.Published, &state.Created, &state.CreatedBy, &state.Status, &state.CompleteBy, &state.LastUpdate, &state.Owner, &state.Overdue, &state.Escalated, &state.TargetMet, &state.InProgress, &state.Duration, &state.TimeRemaining)
+	return state, err
+}
+func getWorkflow(id int64) (tukdbint.Workflow, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	wf, err := scanWorkflow(tukdbint.DBConn.QueryRowContext(ctx, "SELECT "+workflowColumns+" FROM workflows WHERE id = ?", id))
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err.Error())
+	}
+	return wf, err
+}
+
+// getWorkflowDefinition returns the registered workflow definition of the pathway. tukdbint.GetWorkflowDefinition is not used as tukdbint
+// cannot reflect the definition isxdsmeta field
+func getWorkflowDefinition(pathway string) (tukdbint.XDW, error) {
+	xdw := tukdbint.XDW{Name: pathway}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	err := tukdbint.DBConn.QueryRowContext(ctx, "SELECT id, name, isxdsmeta, xdw FROM xdws WHERE name = ? AND isxdsmeta = ?", pathway, false).Scan(&xdw.Id, &xdw.Name, &xdw.IsXDSMeta, &xdw.XDW)
+	if err == sql.ErrNoRows {
+		return xdw, nil
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return xdw, err
+}
+
+const (
+	workflowColumns     = "id, pathway, nhsid, created, xdw_key, xdw_uid, xdw_doc, xdw_def, version, published, status"
+	workflowLinkColumns = "id, created, parentid, parentpathway, parenttask, childid, childpathway, nhsid, status"
+)
+
+func scanWorkflow(row rowScanner) (tukdbint.Workflow, error) {
+	wf := tukdbint.Workflow{}
+	err := row.Scan(&wf.Id, &wf.Pathway, &wf.NHSId, &wf.Created, &wf.XDW_Key, &wf.XDW_UID, &wf.XDW_Doc, &wf.XDW_Def, &wf.Version, &wf.Published, &wf.Status)
+	return wf, err
+}
+func getWorkflowLinks(where string, id int64) ([]WorkflowLink, error) {
+	var links []WorkflowLink
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	rows, err := tukdbint.DBConn.QueryContext(ctx, "SELECT "+workflowLinkColumns+" FROM workflowlinks WHERE "+where+" = ?", id)
+	if err != nil {
+		log.Println(err.Error())
+		return links, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		link := WorkflowLink{}
+		if err := rows.Scan(&link.Id, &link.Created, &link.ParentId, &link.ParentPathway, &link.ParentTask, &link.ChildId, &link.ChildPathway, &link.NHSId, &link.Status); err != nil {
+			log.Println(err.Error())
+			return links, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+func setWorkflowLink(link *WorkflowLink) error {
+	var err error
+	var rslt sql.Result
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	if link.Id > 0 {
+		_, err = tukdbint.DBConn.ExecContext(ctx, "UPDATE workflowlinks SET status = ? WHERE id = ?", link.Status, link.Id)
+	} else {
+		rslt, err = tukdbint.DBConn.ExecContext(ctx, "INSERT INTO workflowlinks (created, parentid, parentpathway, parenttask, childid, childpathway, nhsid, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			link.Created, link.ParentId, link.ParentPathway, link.ParentTask, link.ChildId, link.ChildPathway, link.NHSId, link.Status)
+		if err == nil {
+			link.Id, err = rslt.LastInsertId()
+		}
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+const eventErrorColumns = "id, created, eventid, pathway, nhsid, user, org, role, reason"
+
+func getEventErrors(pathway string, nhsid string) ([]EventError, error) {
+	var errs []EventError
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	rows, err := tukdbint.DBConn.QueryContext(ctx, "SELECT "+eventErrorColumns+" FROM eventerrors WHERE pathway = ? AND nhsid = ?", pathway, nhsid)
+	if err != nil {
+		log.Println(err.Error())
+		return errs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		everr := EventError{}
+		if err := rows.Scan(&everr.Id, &everr.Created, &everr.EventId, &everr.Pathway, &everr.NHSId, &everr.User, &everr.Org, &everr.Role, &everr.Reason); err != nil {
+			log.Println(err.Error())
+			return errs, err
+		}
+		errs = append(errs, everr)
+	}
+	return errs, rows.Err()
+}
+func deleteEventErrors(ids []int64) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	for _, id := range ids {
+		if _, err := tukdbint.DBConn.ExecContext(ctx, "DELETE FROM eventerrors WHERE id = ?", id); err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+func deleteEvent(id int64) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	if _, err := tukdbint.DBConn.ExecContext(ctx, "DELETE FROM events WHERE id = ?", id); err != nil {
+		log.Println(err.Error())
+	}
+}
+func setEventError(everr *EventError) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	rslt, err := tukdbint.DBConn.ExecContext(ctx, "INSERT INTO eventerrors (created, eventid, pathway, nhsid, user, org, role, reason) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		everr.Created, everr.EventId, everr.Pathway, everr.NHSId, everr.User, everr.Org, everr.Role, everr.Reason)
+	if err == nil {
+		everr.Id, err = rslt.LastInsertId()
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// setWorkflowDocument updates the workflow document if the stored document sequence number is seq. It returns false if the document was not updated
+func setWorkflowDocument(id int64, doc string, status string, seq string) (bool, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	rslt, err := tukdbint.DBConn.ExecContext(ctx, "UPDATE workflows SET xdw_doc = ?, status = ? WHERE id = ? AND COALESCE(JSON_UNQUOTE(JSON_EXTRACT(xdw_doc, '$.WorkflowDocumentSequenceNumber')), '') = ?", doc, status, id, seq)
+	if err != nil {
+		log.Println(err.Error())
+		return false, err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		log.Println(err.Error())
+		return false, err
+	}
+	return cnt == 1, nil
+}
+
+// replaceWorkflowDocument updates the workflow document if the stored document is unchanged. It returns false if the document was not updated
+func replaceWorkflowDocument(id int64, doc string, status string, stored string) (bool, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	rslt, err := tukdbint.DBConn.ExecContext(ctx, "UPDATE workflows SET xdw_doc = ?, status = ? WHERE id = ? AND xdw_doc = ?", doc, status, id, stored)
+	if err != nil {
+		log.Println(err.Error())
+		return false, err
+	}
+	cnt, err := rslt.RowsAffected()
+	if err != nil {
+		log.Println(err.Error())
+		return false, err
+	}
+	return cnt == 1, nil
+}
+
+// getHolidays returns the holidays table as a map of yyyy-MM-dd date to holiday description
+func getHolidays() (map[string]string, error) {
+	holidays := make(map[string]string)
+	if tukdbint.DBConn == nil {
+		return holidays, errors.New("no database connection available to load holidays")
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	rows, err := tukdbint.DBConn.QueryContext(ctx, "SELECT holiday, description FROM holidays")
+	if err != nil {
+		log.Println(err.Error())
+		return holidays, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var holiday string
+		var desc sql.NullString
+		if err = rows.Scan(&holiday, &desc); err != nil {
+			log.Println(err.Error())
+			return holidays, err
+		}
+		holidays[holiday] = desc.String
+	}
+	return holidays, rows.Err()
+}
+
+const fhirSubscriptionColumns = "id, created, status, topic, pathway, nhsid, endpoint, header, content, reason, end, eventcount, failures, lastdelivery, lasterror"
+
+// getFHIRSubscriptions returns the FHIR subscriptions with the status, or all subscriptions if status is empty
+func getFHIRSubscriptions(status string) ([]fhirSubscription, error) {
+	var subs []fhirSubscription
+	stmnt := "SELECT " + fhirSubscriptionColumns + " FROM fhirsubscriptions"
+	var params []interface{}
+	if status != "" {
+		stmnt = stmnt + " WHERE status = ?"
+		params = append(params, status)
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	rows, err := tukdbint.DBConn.QueryContext(ctx, stmnt+" ORDER BY id", params...)
+	if err != nil {
+		log.Println(err.Error())
+		return subs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		sub, err := scanFHIRSubscription(rows)
+		if err != nil {
+			log.Println(err.Error())
+			return subs, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+func getFHIRSubscription(id int64) (fhirSubscription, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	sub, err := scanFHIRSubscription(tukdbint.DBConn.QueryRowContext(ctx, "SELECT "+fhirSubscriptionColumns+" FROM fhirsubscriptions WHERE id = ?", id))
+	if err != nil && err != sql.ErrNoRows {
+		log.Println(err.Error())
+	}
+	return sub, err
+}
+func scanFHIRSubscription(row rowScanner) (fhirSubscription, error) {
+	sub := fhirSubscription{}
+	var header, reason, lasterror sql.NullString
+	err := row.Scan(&sub.Id, &sub.Created, &sub.Status, &sub.Topic, &sub.Pathway, &sub.NHSId, &sub.Endpoint, &header, &sub.Content, &reason, &sub.End, &sub.EventCount, &sub.Failures, &sub.LastDelivery, &lasterror)
+	sub.Header, sub.Reason, sub.LastError = header.String, reason.String, lasterror.String
+	return sub, err
+}
+func setFHIRSubscription(sub *fhirSubscription) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	rslt, err := tukdbint.DBConn.ExecContext(ctx, "INSERT INTO fhirsubscriptions (created, status, topic, pathway, nhsid, endpoint, header, content, reason, end, lastdelivery) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, '')",
+		sub.Created, sub.Status, sub.Topic, sub.Pathway, sub.NHSId, sub.Endpoint, sub.Header, sub.Content, sub.Reason, sub.End)
+	if err == nil {
+		sub.Id, err = rslt.LastInsertId()
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// setFHIRSubscriptionDelivered records a delivered notification of the subscription and resets its consecutive failures
+func setFHIRSubscriptionDelivered(id int64, delivered string) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	_, err := tukdbint.DBConn.ExecContext(ctx, "UPDATE fhirsubscriptions SET failures = 0, lastdelivery = ?, lasterror = '' WHERE id = ?", delivered, id)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// setFHIRSubscriptionFailed records a failed notification of the subscription and sets the subscription to error status if it has failed
+// FHIR_SUBSCRIPTION_MAX_FAILURES consecutive notifications
+func setFHIRSubscriptionFailed(id int64, delivered string, lasterror string) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	_, err := tukdbint.DBConn.ExecContext(ctx, "UPDATE fhirsubscriptions SET failures = failures + 1, lastdelivery = ?, lasterror = ? WHERE id = ?", delivered, lasterror, id)
+	if err == nil {
+		var rslt sql.Result
+		if rslt, err = tukdbint.DBConn.ExecContext(ctx, "UPDATE fhirsubscriptions SET status = ? WHERE id = ? AND status = ? AND failures >= ?", FHIR_SUBSCRIPTION_STATUS_ERROR, id, FHIR_SUBSCRIPTION_STATUS_ACTIVE, FHIR_SUBSCRIPTION_MAX_FAILURES); err != nil {
+			log.Println(err.Error())
+			return err
+		}
+		if cnt, _ := rslt.RowsAffected(); cnt == 1 {
+			log.Printf("FHIR Subscription %v has failed %v consecutive notifications. Set status to %s", id, FHIR_SUBSCRIPTION_MAX_FAILURES, FHIR_SUBSCRIPTION_STATUS_ERROR)
+		}
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+func setFHIRSubscriptionStatus(id int64, status string) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	_, err := tukdbint.DBConn.ExecContext(ctx, "UPDATE fhirsubscriptions SET status = ? WHERE id = ?", status, id)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// nextFHIRSubscriptionEvent increments and returns the subscription event count
+func nextFHIRSubscriptionEvent(id int64) (int, error) {
+	var cnt int
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	_, err := tukdbint.DBConn.ExecContext(ctx, "UPDATE fhirsubscriptions SET eventcount = eventcount + 1 WHERE id = ?", id)
+	if err == nil {
+		err = tukdbint.DBConn.QueryRowContext(ctx, "SELECT eventcount FROM fhirsubscriptions WHERE id = ?", id).Scan(&cnt)
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return cnt, err
+}
+func deleteFHIRSubscription(id int64) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	_, err := tukdbint.DBConn.ExecContext(ctx, "DELETE FROM fhirsubscriptions WHERE id = ?", id)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+const inboxColumns = "id, received, status, stage, attempts, nextattempt, lasterror, processed, brokerref, xdsdocentryuid, message"
+
+func setInboxNotification(n *InboxNotification) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	now := time.Now().UTC().Format(NOTIFICATION_TIME_FORMAT)
+	n.Received, n.NextAttempt = now, now
+	rslt, err := tukdbint.DBConn.ExecContext(ctx, "INSERT INTO notificationinbox (received, status, attempts, nextattempt, brokerref, xdsdocentryuid, message) VALUES (?, ?, 0, ?, ?, ?, ?)",
+		n.Received, n.Status, n.NextAttempt, n.BrokerRef, n.XdsDocEntryUid, n.Message)
+	if err == nil {
+		n.Id, err = rslt.LastInsertId()
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// claimInboxNotification sets the next pending notification due to processing and returns it. A zero id is returned if no notification is due
+func claimInboxNotification() (InboxNotification, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	for {
+		var id int64
+		err := tukdbint.DBConn.QueryRowContext(ctx, "SELECT id FROM notificationinbox WHERE status = ? AND nextattempt <= ? ORDER BY id LIMIT 1", NOTIFICATION_STATUS_PENDING, time.Now().UTC().Format(NOTIFICATION_TIME_FORMAT)).Scan(&id)
+		if err == sql.ErrNoRows {
+			return InboxNotification{}, nil
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return InboxNotification{}, err
+		}
+		rslt, err := tukdbint.DBConn.ExecContext(ctx, "UPDATE notificationinbox SET status = ?, attempts = attempts + 1 WHERE id = ? AND status = ?", NOTIFICATION_STATUS_PROCESSING, id, NOTIFICATION_STATUS_PENDING)
+		if err != nil {
+			log.Println(err.Error())
+			return InboxNotification{}, err
+		}
+		if cnt, _ := rslt.RowsAffected(); cnt == 1 {
+			n, err := scanInboxNotification(tukdbint.DBConn.QueryRowContext(ctx, "SELECT "+inboxColumns+" FROM notificationinbox WHERE id = ?", id))
+			if err != nil {
+				log.Println(err.Error())
+			}
+			return n, err
+		}
+	}
+}
+func scanInboxNotification(row rowScanner) (InboxNotification, error) {
+	n := InboxNotification{}
+	var lasterror, processed, brokerref, docuid, msg sql.NullString
+	err := row.Scan(&n.Id, &n.Received, &n.Status, &n.Stage, &n.Attempts, &n.NextAttempt, &lasterror, &processed, &brokerref, &docuid, &msg)
+	n.LastError, n.Processed, n.BrokerRef, n.XdsDocEntryUid, n.Message = lasterror.String, processed.String, brokerref.String, docuid.String, msg.String
+	return n, err
+}
+func setInboxNotificationStatus(n *InboxNotification) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	var processed interface{}
+	if n.Processed != "" {
+		processed = n.Processed
+	}
+	_, err := tukdbint.DBConn.ExecContext(ctx, "UPDATE notificationinbox SET status = ?, stage = ?, nextattempt = ?, lasterror = ?, processed = ? WHERE id = ?", n.Status, n.Stage, n.NextAttempt, n.LastError, processed, n.Id)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// setInboxNotificationStage persists the processing stage of the notification
+func setInboxNotificationStage(n *InboxNotification) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	_, err := tukdbint.DBConn.ExecContext(ctx, "UPDATE notificationinbox SET stage = ? WHERE id = ?", n.Stage, n.Id)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// resetInboxNotifications returns notifications left processing to pending
+func resetInboxNotifications() (int64, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	rslt, err := tukdbint.DBConn.ExecContext(ctx, "UPDATE notificationinbox SET status = ? WHERE status = ?", NOTIFICATION_STATUS_PENDING, NOTIFICATION_STATUS_PROCESSING)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	return rslt.RowsAffected()
+}
+
+// getInboxNotifications returns the notification with the id, or the notifications with the status, or all notifications not processed.
+// The message is only returned for a single notification
+func getInboxNotifications(status string, id int64) ([]InboxNotification, error) {
+	var ns []InboxNotification
+	cols := "id, received, status, stage, attempts, nextattempt, lasterror, processed, brokerref, xdsdocentryuid, ''"
+	stmnt := " FROM notificationinbox WHERE status != ? ORDER BY id DESC LIMIT ?"
+	params := []interface{}{NOTIFICATION_STATUS_PROCESSED, MAX_QUERY_LIMIT}
+	switch {
+	case id > 0:
+		cols = inboxColumns
+		stmnt = " FROM notificationinbox WHERE id = ?"
+		params = []interface{}{id}
+	case status != "":
+		stmnt = " FROM notificationinbox WHERE status = ? ORDER BY id DESC LIMIT ?"
+		params = []interface{}{status, MAX_QUERY_LIMIT}
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	rows, err := tukdbint.DBConn.QueryContext(ctx, "SELECT "+cols+stmnt, params...)
+	if err != nil {
+		log.Println(err.Error())
+		return ns, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		n, err := scanInboxNotification(rows)
+		if err != nil {
+			log.Println(err.Error())
+			return ns, err
+		}
+		ns = append(ns, n)
+	}
+	return ns, rows.Err()
+}
+
+// replayInboxNotifications returns the notification with the id, or all dead lettered notifications if id is 0, to pending
+func replayInboxNotifications(id int64) (int64, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	now := time.Now().UTC().Format(NOTIFICATION_TIME_FORMAT)
+	stmnt := "UPDATE notificationinbox SET status = ?, attempts = 0, nextattempt = ? WHERE status = ?"
+	params := []interface{}{NOTIFICATION_STATUS_PENDING, now, NOTIFICATION_STATUS_DEAD_LETTER}
+	if id > 0 {
+		stmnt = "UPDATE notificationinbox SET status = ?, attempts = 0, nextattempt = ? WHERE id = ? AND status != ?"
+		params = []interface{}{NOTIFICATION_STATUS_PENDING, now, id, NOTIFICATION_STATUS_PROCESSING}
+	}
+	rslt, err := tukdbint.DBConn.ExecContext(ctx, stmnt, params...)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	return rslt.RowsAffected()
+}
+
+// getEvents returns the events matching the event filter in id order, with the filter event first as returned by tukdbint. Id, Version
+// and TaskId filters are ignored if less than 1, -1 and -1. The tukdbint events select does not return the brokerref column
+func getEvents(filter tukdbint.Event) (tukdbint.Events, error) {
+	evs := tukdbint.Events{Action: tukcnst.SELECT, Events: []tukdbint.Event{filter}}
+	conds, params := eventFilter(filter)
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	rows, err := tukdbint.DBConn.QueryContext(ctx, "SELECT "+eventColumns+" FROM events"+where+" ORDER BY id", params...)
+	if err != nil {
+		log.Println(err.Error())
+		return evs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		ev := tukdbint.Event{}
+		if err := rows.Scan(eventDest(&ev)...); err != nil {
+			log.Println(err.Error())
+			return evs, err
+		}
+		evs.Events = append(evs.Events, ev)
+		evs.Count++
+	}
+	return evs, rows.Err()
+}
+
+// getDocumentEventWorkflows returns the pathway, nhs id and version of each workflow with an event for the xds document in the pathways
+func getDocumentEventWorkflows(docuid string, pathways []string) ([]tukdbint.Workflow, error) {
+	var wfs []tukdbint.Workflow
+	params := []interface{}{docuid}
+	in := ""
+	for k, pathway := range pathways {
+		if k > 0 {
+			in = in + ", "
+		}
+		in = in + "?"
+		params = append(params, pathway)
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	rows, err := tukdbint.DBConn.QueryContext(ctx, "SELECT DISTINCT pathway, nhsid, version FROM events WHERE xdsdocentryuid = ? AND pathway IN ("+in+")", params...)
+	if err != nil {
+		log.Println(err.Error())
+		return wfs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		wf := tukdbint.Workflow{}
+		if err := rows.Scan(&wf.Pathway, &wf.NHSId, &wf.Version); err != nil {
+			log.Println(err.Error())
+			return wfs, err
+		}
+		wfs = append(wfs, wf)
+	}
+	return wfs, rows.Err()
+}
+
+const subscriptionStateColumns = "brokerref, status, terminationtime, origin, updated"
+
+// getSubscriptionState returns the state of the broker ref. Broker refs without a state are active
+func getSubscriptionState(brokerref string) (SubscriptionState, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	state, err := scanSubscriptionState(tukdbint.DBConn.QueryRowContext(ctx, "SELECT "+subscriptionStateColumns+" FROM subscriptionstates WHERE brokerref = ?", brokerref))
+	if err == sql.ErrNoRows {
+		return SubscriptionState{BrokerRef: brokerref, Status: SUBSCRIPTION_STATUS_ACTIVE}, nil
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return state, err
+}
+func getSubscriptionStates() (map[string]SubscriptionState, error) {
+	states := make(map[string]SubscriptionState)
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	rows, err := tukdbint.DBConn.QueryContext(ctx, "SELECT "+subscriptionStateColumns+" FROM subscriptionstates")
+	if err != nil {
+		log.Println(err.Error())
+		return states, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		state, err := scanSubscriptionState(rows)
+		if err != nil {
+			log.Println(err.Error())
+			return states, err
+		}
+		states[state.BrokerRef] = state
+	}
+	return states, rows.Err()
+}
+func scanSubscriptionState(row rowScanner) (SubscriptionState, error) {
+	state := SubscriptionState{}
+	var terminationtime sql.NullString
+	err := row.Scan(&state.BrokerRef, &state.Status, &terminationtime, &state.Origin, &state.Updated)
+	state.TerminationTime = terminationtime.String
+	return state, err
+}
+
+// setSubscriptionState sets the status and termination time of the broker ref. The origin is only set when the state is first registered
+func setSubscriptionState(state SubscriptionState) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	_, err := tukdbint.DBConn.ExecContext(ctx, "INSERT INTO subscriptionstates (brokerref, status, terminationtime, origin, updated) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE status = VALUES(status), terminationtime = VALUES(terminationtime), updated = VALUES(updated)",
+		state.BrokerRef, state.Status, state.TerminationTime, state.Origin, time.Now().UTC().Format(NOTIFICATION_TIME_FORMAT))
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// getBrokerRefNotifications returns the number of notifications in the inbox for the broker ref and when the last was received
+func getBrokerRefNotifications(brokerref string) (int, string, error) {
+	var cnt int
+	var last sql.NullString
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	err := tukdbint.DBConn.QueryRowContext(ctx, "SELECT COUNT(*), MAX(received) FROM notificationinbox WHERE brokerref = ?", brokerref).Scan(&cnt, &last)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return cnt, last.String, err
+}
+
+// releaseInboxNotifications returns the paused notifications of the broker ref to pending
+func releaseInboxNotifications(brokerref string) (int64, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	rslt, err := tukdbint.DBConn.ExecContext(ctx, "UPDATE notificationinbox SET status = ?, nextattempt = ? WHERE brokerref = ? AND status = ?", NOTIFICATION_STATUS_PENDING, time.Now().UTC().Format(NOTIFICATION_TIME_FORMAT), brokerref, NOTIFICATION_STATUS_PAUSED)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	return rslt.RowsAffected()
+}
+
+// getSubscriptionFilters returns the filter criteria of the broker refs with filter criteria
+func getSubscriptionFilters() (map[string]DSUBFilter, error) {
+	filters := make(map[string]DSUBFilter)
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	rows, err := tukdbint.DBConn.QueryContext(ctx, "SELECT brokerref, filter FROM subscriptionfilters")
+	if err != nil {
+		log.Println(err.Error())
+		return filters, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var brokerref, filter string
+		if err := rows.Scan(&brokerref, &filter); err != nil {
+			log.Println(err.Error())
+			return filters, err
+		}
+		f := DSUBFilter{}
+		if err := json.Unmarshal([]byte(filter), &f); err != nil {
+			log.Println(err.Error())
+			continue
+		}
+		filters[brokerref] = f
+	}
+	return filters, rows.Err()
+}
+func setSubscriptionFilter(brokerref string, filter DSUBFilter) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	_, err := tukdbint.DBConn.ExecContext(ctx, "INSERT INTO subscriptionfilters (brokerref, filter) VALUES (?, ?) ON DUPLICATE KEY UPDATE filter = VALUES(filter)", brokerref, filter.key())
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+const fhirDeliveryColumns = "id, created, subscriptionid, workflowid, eventnumber, status, attempts, nextattempt, lasterror, delivered"
+
+func setFHIRDelivery(d *fhirDelivery) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	now := time.Now().UTC().Format(NOTIFICATION_TIME_FORMAT)
+	d.Created, d.NextAttempt = now, now
+	rslt, err := tukdbint.DBConn.ExecContext(ctx, "INSERT INTO fhirdeliveries (created, subscriptionid, workflowid, eventnumber, status, attempts, nextattempt) VALUES (?, ?, ?, ?, ?, 0, ?)",
+		d.Created, d.SubscriptionId, d.WorkflowId, d.EventNumber, d.Status, d.NextAttempt)
+	if err == nil {
+		d.Id, err = rslt.LastInsertId()
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// claimFHIRDelivery sets the next pending notification due to processing and returns it. A zero id is returned if no notification is due
+func claimFHIRDelivery() (fhirDelivery, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	for {
+		var id int64
+		err := tukdbint.DBConn.QueryRowContext(ctx, "SELECT id FROM fhirdeliveries WHERE status = ? AND nextattempt <= ? ORDER BY id LIMIT 1", NOTIFICATION_STATUS_PENDING, time.Now().UTC().Format(NOTIFICATION_TIME_FORMAT)).Scan(&id)
+		if err == sql.ErrNoRows {
+			return fhirDelivery{}, nil
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return fhirDelivery{}, err
+		}
+		rslt, err := tukdbint.DBConn.ExecContext(ctx, "UPDATE fhirdeliveries SET status = ?, attempts = attempts + 1 WHERE id = ? AND status = ?", NOTIFICATION_STATUS_PROCESSING, id, NOTIFICATION_STATUS_PENDING)
+		if err != nil {
+			log.Println(err.Error())
+			return fhirDelivery{}, err
+		}
+		if cnt, _ := rslt.RowsAffected(); cnt == 1 {
+			d, err := scanFHIRDelivery(tukdbint.DBConn.QueryRowContext(ctx, "SELECT "+fhirDeliveryColumns+" FROM fhirdeliveries WHERE id = ?", id))
+			if err != nil {
+				log.Println(err.Error())
+			}
+			return d, err
+		}
+	}
+}
+func scanFHIRDelivery(row rowScanner) (fhirDelivery, error) {
+	d := fhirDelivery{}
+	var lasterror, delivered sql.NullString
+	err := row.Scan(&d.Id, &d.Created, &d.SubscriptionId, &d.WorkflowId, &d.EventNumber, &d.Status, &d.Attempts, &d.NextAttempt, &lasterror, &delivered)
+	d.LastError, d.Delivered = lasterror.String, delivered.String
+	return d, err
+}
+func setFHIRDeliveryStatus(d *fhirDelivery) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	var delivered interface{}
+	if d.Delivered != "" {
+		delivered = d.Delivered
+	}
+	_, err := tukdbint.DBConn.ExecContext(ctx, "UPDATE fhirdeliveries SET status = ?, nextattempt = ?, lasterror = ?, delivered = ? WHERE id = ?", d.Status, d.NextAttempt, d.LastError, delivered, d.Id)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// resetFHIRDeliveries returns notifications left processing to pending
+func resetFHIRDeliveries() (int64, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	rslt, err := tukdbint.DBConn.ExecContext(ctx, "UPDATE fhirdeliveries SET status = ? WHERE status = ?", NOTIFICATION_STATUS_PENDING, NOTIFICATION_STATUS_PROCESSING)
+	if err != nil {
+		log.Println(err.Error())
+		return 0, err
+	}
+	return rslt.RowsAffected()
+}
+
+// queuePatientSubscription queues the subscribe or cancel op for the patient of the pathway. An op already queued for the patient is
+// replaced, as the op is applied to the current workflows of the patient when it is processed
+func queuePatientSubscription(pathway string, nhsid string, op string) error {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	_, err := tukdbint.DBConn.ExecContext(ctx, "INSERT INTO patientsubscriptionqueue (queued, pathway, nhsid, op) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE queued = VALUES(queued), op = VALUES(op)", time.Now().UTC().Format(NOTIFICATION_TIME_FORMAT), pathway, nhsid, op)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
+
+// claimPatientSubscription removes and returns the next queued patient subscription op. The workflow pathway and nhs id are empty if no op
+// is queued
+func claimPatientSubscription() (tukdbint.Workflow, string, error) {
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	for {
+		var id int64
+		var op string
+		wf := tukdbint.Workflow{}
+		err := tukdbint.DBConn.QueryRowContext(ctx, "SELECT id, pathway, nhsid, op FROM patientsubscriptionqueue ORDER BY id LIMIT 1").Scan(&id, &wf.Pathway, &wf.NHSId, &op)
+		if err == sql.ErrNoRows {
+			return tukdbint.Workflow{}, "", nil
+		}
+		if err != nil {
+			log.Println(err.Error())
+			return tukdbint.Workflow{}, "", err
+		}
+		rslt, err := tukdbint.DBConn.ExecContext(ctx, "DELETE FROM patientsubscriptionqueue WHERE id = ?", id)
+		if err != nil {
+			log.Println(err.Error())
+			return tukdbint.Workflow{}, "", err
+		}
+		if cnt, _ := rslt.RowsAffected(); cnt == 1 {
+			return wf, op, nil
+		}
+	}
+}
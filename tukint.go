@@ -11,6 +11,7 @@ import (
 	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"sort"
@@ -53,59 +54,72 @@ type EventServices struct {
 	WorkflowXDWMeta     []string
 }
 type ServiceState struct {
-	Id             string `json:"id"`
-	Desc           string `json:"desc"`
-	Type           string `json:"type"`
-	Proto          string `json:"proto"`
-	Vers           string `json:"vers"`
-	Enabled        bool   `json:"enabled"`
-	Paused         bool   `json:"paused"`
-	Debugmode      bool   `json:"debugmode"`
-	Scheme         string `json:"scheme"`
-	Host           string `json:"host"`
-	Port           int    `json:"port"`
-	Url            string `json:"url"`
-	WSE            string `json:"wse"`
-	DemoMode       bool   `json:"demomode"`
-	XDSDomain      string `json:"xdsdomain"`
-	User           string `json:"user"`
-	Password       string `json:"password"`
-	Org            string `json:"org"`
-	Role           string `json:"role"`
-	POU            string `json:"pou"`
-	ClaimDialect   string `json:"claimdialect"`
-	ClaimValue     string `json:"claimvalue"`
-	RequestTmplt   string `json:"requesttmplt"`
-	DataBase       string `json:"db"`
-	TmpltsPath     string `json:"tmpltspath"`
-	HTMLTmplts     string `json:"htmltmplts"`
-	XMLTmplts      string `json:"xmltmplts"`
-	BaseURLPath    string `json:"baseurlpath"`
-	EventUrl       string `json:"eventurl"`
-	FilesUrl       string `json:"filesurl"`
-	XDWConfigsPath string `json:"xdwconfigspath"`
-	FilesPath      string `json:"filespath"`
-	Secret         string `json:"secret"`
-	Token          string `json:"token"`
-	CertPath       string `json:"certpath"`
-	Certs          string `json:"certs"`
-	Keys           string `json:"keys"`
-	LogSrvc        string `json:"logsrvc"`
-	DBSrvc         string `json:"dbsrvc"`
-	BrokerSrvc     string `json:"brokersrvc"`
-	STSSrvc        string `json:"stssrvc"`
-	SAMLSrvc       string `json:"samlsrvc"`
-	LoginSrvc      string `json:"loginsrvc"`
-	PDQv3Srvc      string `json:"pdqv3srvc"`
-	PIXmSrvc       string `json:"pixmsrvc"`
-	ODDSrvc        string `json:"oddsrvc"`
-	XDSRegSrvc     string `json:"xdsregsrvc"`
-	XDSRepSrvc     string `json:"xdsrepsrvc"`
-	CacheTimeout   int    `json:"cachetimeout"`
-	CacheEnabled   bool   `json:"cacheenabled"`
-	PatientSrvc    string `json:"patientsrvc"`
-	TokenSrvc      string `json:"tokensrvc"`
-	ContextTimeout int    `json:"contexttimeout"`
+	Id                        string   `json:"id"`
+	Desc                      string   `json:"desc"`
+	Type                      string   `json:"type"`
+	Proto                     string   `json:"proto"`
+	Vers                      string   `json:"vers"`
+	Enabled                   bool     `json:"enabled"`
+	Paused                    bool     `json:"paused"`
+	Debugmode                 bool     `json:"debugmode"`
+	Scheme                    string   `json:"scheme"`
+	Host                      string   `json:"host"`
+	Port                      int      `json:"port"`
+	Url                       string   `json:"url"`
+	WSE                       string   `json:"wse"`
+	DemoMode                  bool     `json:"demomode"`
+	XDSDomain                 string   `json:"xdsdomain"`
+	User                      string   `json:"user"`
+	Password                  string   `json:"password"`
+	Org                       string   `json:"org"`
+	Role                      string   `json:"role"`
+	POU                       string   `json:"pou"`
+	ClaimDialect              string   `json:"claimdialect"`
+	ClaimValue                string   `json:"claimvalue"`
+	RequestTmplt              string   `json:"requesttmplt"`
+	DataBase                  string   `json:"db"`
+	TmpltsPath                string   `json:"tmpltspath"`
+	HTMLTmplts                string   `json:"htmltmplts"`
+	XMLTmplts                 string   `json:"xmltmplts"`
+	BaseURLPath               string   `json:"baseurlpath"`
+	EventUrl                  string   `json:"eventurl"`
+	FilesUrl                  string   `json:"filesurl"`
+	XDWConfigsPath            string   `json:"xdwconfigspath"`
+	FilesPath                 string   `json:"filespath"`
+	Secret                    string   `json:"secret"`
+	Token                     string   `json:"token"`
+	CertPath                  string   `json:"certpath"`
+	Certs                     string   `json:"certs"`
+	Keys                      string   `json:"keys"`
+	LogSrvc                   string   `json:"logsrvc"`
+	DBSrvc                    string   `json:"dbsrvc"`
+	BrokerSrvc                string   `json:"brokersrvc"`
+	STSSrvc                   string   `json:"stssrvc"`
+	SAMLSrvc                  string   `json:"samlsrvc"`
+	LoginSrvc                 string   `json:"loginsrvc"`
+	PDQv3Srvc                 string   `json:"pdqv3srvc"`
+	PIXmSrvc                  string   `json:"pixmsrvc"`
+	ODDSrvc                   string   `json:"oddsrvc"`
+	XDSRegSrvc                string   `json:"xdsregsrvc"`
+	XDSRepSrvc                string   `json:"xdsrepsrvc"`
+	CacheTimeout              int      `json:"cachetimeout"`
+	CacheEnabled              bool     `json:"cacheenabled"`
+	PatientSrvc               string   `json:"patientsrvc"`
+	TokenSrvc                 string   `json:"tokensrvc"`
+	ContextTimeout            int      `json:"contexttimeout"`
+	StateInterval             int      `json:"stateinterval"`
+	Timezone                  string   `json:"timezone"`
+	WorkdayStart              int      `json:"workdaystart"`
+	WorkdayEnd                int      `json:"workdayend"`
+	Holidays                  string   `json:"holidays"`
+	DuplicateWindow           int      `json:"duplicatewindow"`
+	NotificationWorkers       int      `json:"notificationworkers"`
+	NotificationRetries       int      `json:"notificationretries"`
+	SubscriptionTerm          int      `json:"subscriptionterm"`
+	ReconcileInterval         int      `json:"reconcileinterval"`
+	PatientSubscriptions      []string `json:"patientsubscriptions"`
+	FHIRSubscriptionToken     string   `json:"fhirsubscriptiontoken"`
+	FHIRSubscriptionEndpoints []string `json:"fhirsubscriptionendpoints"`
 }
 type TukEvent struct {
 	Act                 string
@@ -127,29 +141,54 @@ type TukEvent struct {
 	Gender              string
 	PatientIndependant  bool
 	Notes               string
+	DateFrom            string
+	DateTo              string
+	AuthorOrg           string
+	NHSIdPrefix         string
+	Overdue             bool
+	Escalated           bool
+	Sort                string
+	Order               string
+	Limit               int
+	Offset              int
+	Total               int
+	Cursor              string
+	SearchText          string
+	EventType           string
+	ClassCode           string
+	EventOrg            string
+	Page                Page
+	Notifications       []InboxNotification
 	Expression          string
 	Topic               string
 	Pathway             string
 	Audience            string
 	Include             string
 	BrokerRef           string
+	TerminationTime     string
 	RowId               int64
 	StateID             string
 	SAML                string
 	B64SAML             string
 	ReturnJSON          bool
 	ReturnXML           bool
+	ReturnCSV           bool
+	ReturnPDF           bool
 	ReturnCode          int
 	ContentType         string
 	XDWDocuments        []tukdbint.Workflow
 	Dashboard           tukxdw.Dashboard
 	DBSubscriptions     tukdbint.Subscriptions
+	SubscriptionStates  map[string]SubscriptionState
+	BrokerRefDetails    BrokerRefDetails
+	Reconciliation      SubscriptionReconciliation
 	DBEvents            []tukdbint.Event
 	DBEvent             tukdbint.Event
 	PDQv3Response       tukpdq.PDQv3Response
 	PatientXMLStr       string
 	PIXmResponse        tukpdq.PIXmResponse
 	HttpRequest         *http.Request
+	RequestURL          *url.URL
 	HttpResponse        http.ResponseWriter
 	HTTPMethod          string
 	Body                string
@@ -158,6 +197,8 @@ type TukEvent struct {
 	Base64EncodedFile   string
 	EventServices       EventServices
 	XDWWorkflowDocument tukxdw.WorkflowDocument
+	XDWState            tukdbint.Workflowstate
+	XDWTaskStates       []TaskState
 	XDSDocumentMeta     tukxdw.XDSDocumentMeta
 	WorkflowDefinition  tukxdw.WorkflowDefinition
 	ConfigStr           string
@@ -220,6 +261,10 @@ func InitTuki() error {
 	} else {
 		log.Printf("Set Regional OID %s from Environment Var %s", Regoid, tukcnst.ENV_REG_OID)
 	}
+	if err = initTukintTables(); err != nil {
+		log.Println(err.Error())
+	}
+	initBusinessCalendar()
 	return nil
 }
 func InitTempFiles() error {
@@ -257,6 +302,12 @@ func cacheTemplates() error {
 			return err
 		}
 	}
+	if Services.XMLTemplates.Lookup(TUK_TEMPLATE_XDS_PROVIDE_AND_REGISTER) == nil {
+		if Services.XMLTemplates, err = Services.XMLTemplates.New(TUK_TEMPLATE_XDS_PROVIDE_AND_REGISTER).Funcs(funcmap).Parse(xdsProvideAndRegisterTemplate); err != nil {
+			return err
+		}
+		Services.XMLMessages = append(Services.XMLMessages, TUK_TEMPLATE_XDS_PROVIDE_AND_REGISTER)
+	}
 	sortTemplatesResponse()
 	return nil
 }
@@ -271,6 +322,7 @@ func getTemplateFuncMap() template.FuncMap {
 		"splitexpression":  tukutil.SplitExpression,
 		"geticon":          tukutil.GetGlypicon,
 		"mappedid":         tukdbint.GetIDMapsMappedId,
+		"newxdstime":       newXDSTime,
 	}
 }
 
@@ -317,25 +369,43 @@ func (i *EventServices) loadServiceConfig(srvc string) error {
 	return err
 }
 
+// HandleBrokerNotification adds the Notify message to the notification inbox and acknowledges it. If the notification cannot be added to
+// the inbox it is processed, and the workflows with notification events updated, before it is acknowledged. If it can be neither added nor
+// processed an error is returned with a 500 status so the broker retries the notification
 func (i *TukEvent) HandleBrokerNotification() []byte {
+	if err := i.handleBrokerNotification(); err != nil {
+		i.ReturnCode = http.StatusInternalServerError
+		return []byte(err.Error())
+	}
+	log.Println("Sending Notification Message ACK to Broker")
+	return []byte(tukcnst.GO_TEMPLATE_DSUB_ACK)
+}
+
+// handleBrokerNotification claims the notification before it is added to the inbox or processed, and releases the claim if it could not be
+// handled
+func (i *TukEvent) handleBrokerNotification() error {
 	log.Println("Handling IHE DSUB Notification Message")
-	event := tukdsub.DSUBEvent{
-		BrokerURL:       i.EventServices.BrokerService.WSE,
-		PDQ_SERVER_TYPE: i.EventServices.EventService.PatientSrvc,
-		REG_OID:         Regoid,
-		EventMessage:    i.Body,
+	n, err := newBrokerNotification(i.Body)
+	if err != nil {
+		log.Println(err.Error())
 	}
-	switch event.PDQ_SERVER_TYPE {
-	case tukcnst.PDQ_SERVER_TYPE_IHE_PDQV3:
-		event.PDQ_SERVER_URL = i.EventServices.PDQv3Service.WSE
-	case tukcnst.PDQ_SERVER_TYPE_IHE_PIXM:
-		event.PDQ_SERVER_URL = i.EventServices.PIXmService.WSE
+	claimed, isDuplicate := i.claimNotification(n)
+	if isDuplicate {
+		return nil
 	}
-	if err := tukdsub.New_Transaction(&event); err != nil {
+	if err := i.enqueueBrokerNotification(); err != nil {
 		log.Println(err.Error())
+		wfs, err := i.processBrokerNotification()
+		if err != nil {
+			log.Println(err.Error())
+			n.release(claimed)
+			return err
+		}
+		if err = updateNotificationWorkflows(wfs); err != nil {
+			log.Println(err.Error())
+		}
 	}
-	log.Println("Sending Notification Message ACK to Broker")
-	return []byte(tukcnst.GO_TEMPLATE_DSUB_ACK)
+	return nil
 }
 func (i *ServiceState) setServiceWSE() {
 	if i.Id == os.Getenv(tukcnst.ENV_TUK_CONFIG_FILE) {
@@ -432,45 +502,87 @@ func (i *TukEvent) IsBrokerExpression(expression string) bool {
 func (i *TukEvent) TaskNotes(task string) string {
 	return tukxdw.GetTaskNotes(i.Pathway, i.NHSId, tukutil.GetIntFromString(task), i.Vers)
 }
+func (i *TukEvent) TaskGraph(wf tukdbint.Workflow) WorkflowGraph {
+	e, err := newWorkflowEngine(wf)
+	if err != nil {
+		return WorkflowGraph{}
+	}
+	return e.Graph()
+}
+
+// ElapsedTime returns the time since the workflow started, or the time the workflow took if it has ended, excluding any time suspended
 func (i *TukEvent) ElapsedTime() string {
-	st := tukutil.GetTimeFromString(i.XDWWorkflowDocument.EffectiveTime.Value)
-	duration := time.Since(st)
+	e := workflowEngine{Document: i.XDWWorkflowDocument}
+	duration := e.endTime().Sub(e.startTime()) - e.suspendedDuration()
 	log.Printf("Duration = %s", duration.String())
 	elapsedTime := tukutil.PrettyPrintDuration(duration)
 	log.Printf("Elapsed time for workflow %s nhs id %s version %v is %s", i.XDWWorkflowDocument.WorkflowDefinitionReference, i.XDWWorkflowDocument.Patient.Extension, i.Vers, elapsedTime)
 	return elapsedTime
 }
+
+// parsePostEvent handles a SOAP 1.1 or 1.2 DSUB Notify request. Invalid requests are returned a SOAP Fault and are not processed
 func (i *TukEvent) parsePostEvent() []byte {
-	i.HttpResponse.Header().Set(tukcnst.CONTENT_TYPE, tukcnst.SOAP_XML)
 	i.ReturnXML = true
-	i.HttpResponse.Header().Add(tukcnst.CONTENT_TYPE, tukcnst.APPLICATION_XML)
-	b, _ := io.ReadAll(i.HttpRequest.Body)
-	i.Body = string(b)
-	return i.HandleBrokerNotification()
-}
-func (i *TukEvent) newXDWHandler() []byte {
-	trans := tukxdw.Transaction{Actor: tukcnst.XDW_ACTOR_CONTENT_CONSUMER, Pathway: i.Pathway, NHS_ID: i.NHSId, XDWVersion: i.Vers}
-	if err := tukxdw.Execute(&trans); err != nil {
-		log.Println(err.Error())
-		return nil
+	var msg soapMessage
+	b, err := io.ReadAll(i.HttpRequest.Body)
+	if err != nil {
+		msg = soapMessage{Namespace: SOAP_12_NAMESPACE, Fault: &soapFault{Code: SOAP_FAULT_RECEIVER, Reason: err.Error()}}
+	} else {
+		msg = i.handleSOAPNotify(i.HttpRequest.Header.Get(tukcnst.CONTENT_TYPE), i.HttpRequest.Header.Get(tukcnst.SOAP_ACTION), b)
 	}
-	if trans.Workflows.Count == 1 {
-		if err := xml.Unmarshal([]byte(trans.Workflows.Workflows[1].XDW_Doc), &i.XDWWorkflowDocument); err != nil {
-			log.Println(err.Error())
-			return nil
-		}
-		log.Println("Unmarshalled Workflow Document")
-		if err := json.Unmarshal([]byte(trans.Workflows.Workflows[1].XDW_Def), &i.WorkflowDefinition); err != nil {
-			log.Println(err.Error())
-			return nil
+	i.HttpResponse.Header().Set(tukcnst.CONTENT_TYPE, msg.contentType())
+	if msg.Fault != nil {
+		i.HttpResponse.WriteHeader(msg.statusCode())
+	}
+	return msg.response()
+}
+
+// handleSOAPNotify validates and handles a DSUB Notify request. The returned message has a Fault if the request is not valid or the
+// notification could not be handled
+func (i *TukEvent) handleSOAPNotify(contenttype string, soapaction string, body []byte) soapMessage {
+	msg := newSOAPMessage(contenttype, soapaction, body)
+	if msg.Fault == nil {
+		i.Body = msg.Body
+		if err := i.handleBrokerNotification(); err != nil {
+			msg.Fault = &soapFault{Code: SOAP_FAULT_RECEIVER, Reason: err.Error()}
 		}
-		log.Println("Unmarshalled Workflow Definition")
 	}
+	if msg.Fault != nil {
+		log.Printf("Returning SOAP Fault %s %s. %s", msg.Fault.Code, msg.Fault.Subcode, msg.Fault.Reason)
+	}
+	return msg
+}
+
+// handleAWSSOAPNotify handles a DSUB Notify request received by API Gateway
+func (i *TukEvent) handleAWSSOAPNotify(request events.APIGatewayProxyRequest) *events.APIGatewayProxyResponse {
+	msg := i.handleSOAPNotify(request.Headers[tukcnst.CONTENT_TYPE], request.Headers[tukcnst.SOAP_ACTION], []byte(request.Body))
+	headers := i.setAwsResponseHeaders()
+	headers[tukcnst.CONTENT_TYPE] = msg.contentType()
+	return &events.APIGatewayProxyResponse{StatusCode: msg.statusCode(), Headers: headers, Body: string(msg.response())}
+}
+func (i *TukEvent) newXDWHandler() []byte {
+	wfs := getWorkflows(i.Pathway, i.NHSId, i.Vers, "")
 	type apirsp struct {
-		XDW tukxdw.WorkflowDocument
-		DEF tukxdw.WorkflowDefinition
+		XDW   tukxdw.WorkflowDocument
+		DEF   tukxdw.WorkflowDefinition
+		STATE tukdbint.Workflowstate
+		TASKS []TaskState
+		GRAPH WorkflowGraph
+		LINKS []WorkflowLink
+	}
+	a := apirsp{}
+	if wfs.Count == 1 {
+		e, err := newWorkflowEngine(wfs.Workflows[1])
+		if err != nil {
+			return nil
+		}
+		log.Println("Unmarshalled Workflow Document and Definition")
+		i.XDWWorkflowDocument = e.Document
+		i.WorkflowDefinition = e.Definition
+		i.XDWState = e.State()
+		i.XDWTaskStates = e.TaskStates()
+		a = apirsp{XDW: e.Document, DEF: e.Definition, STATE: i.XDWState, TASKS: i.XDWTaskStates, GRAPH: e.Graph(), LINKS: i.WorkflowLinks(wfs.Workflows[1].Id)}
 	}
-	a := apirsp{XDW: i.XDWWorkflowDocument, DEF: i.WorkflowDefinition}
 
 	if i.ReturnJSON {
 		if i.HttpResponse != nil {
@@ -500,33 +612,32 @@ func (i *TukEvent) newXDWHandler() []byte {
 	return i.XDWDocumentWidget()
 }
 func (i *TukEvent) newXDWSHandler() []byte {
-	status := i.Status
-	switch status {
-	case tukcnst.TUK_STATUS_MET:
-		status = tukcnst.TUK_STATUS_CLOSED
-	case tukcnst.TUK_STATUS_MISSED:
-		status = tukcnst.TUK_STATUS_CLOSED
-	case tukcnst.TUK_STATUS_ESCALATED:
-		status = tukcnst.TUK_STATUS_OPEN
-	}
-	trans := tukxdw.Transaction{Actor: tukcnst.XDW_ACTOR_CONTENT_CONSUMER, Pathway: i.Pathway, NHS_ID: i.NHSId, XDWVersion: i.Vers}
-
-	if err := tukxdw.Execute(&trans); err != nil {
+	if i.ReturnCSV {
+		return i.exportWorkflows()
+	}
+	var err error
+	if i.Page, err = i.newPage(DEFAULT_WORKFLOWS_SORT); err != nil {
+		i.ReturnCode = http.StatusBadRequest
+		return []byte(err.Error())
+	}
+	wfs, err := getFilteredWorkflows(i.workflowFilter(), &i.Page)
+	if err != nil {
 		log.Println(err.Error())
 		return nil
 	}
-	log.Printf("Total Workflow Count %v", trans.Workflows.Count)
-
-	for _, v := range trans.Workflows.Workflows {
-		if v.Id > 0 {
-			i.XDWDocuments = append(i.XDWDocuments, v)
-		}
-	}
+	log.Printf("Total Workflow Count %v", i.Page.Total)
+	i.Total = i.Page.Total
+	i.XDWDocuments = append(i.XDWDocuments, wfs...)
+	i.setLinkHeader()
 	if i.ReturnJSON {
 		if i.HttpResponse != nil {
 			i.HttpResponse.Header().Add(tukcnst.CONTENT_TYPE, tukcnst.APPLICATION_JSON)
 		}
-		b, e := json.MarshalIndent(i.XDWDocuments, "", "  ")
+		var rsp interface{} = i.XDWDocuments
+		if i.isPaged() {
+			rsp = WorkflowsPage{Workflows: i.XDWDocuments, Page: i.Page}
+		}
+		b, e := json.MarshalIndent(rsp, "", "  ")
 		if e != nil {
 			log.Println(e.Error())
 			return []byte(e.Error())
@@ -547,18 +658,50 @@ func (i *TukEvent) newXDWSHandler() []byte {
 	return i.XDWDocumentsWidget()
 }
 func (i *TukEvent) manageSubscriptions() []byte {
-	if i.Task == tukcnst.CANCEL && i.RowId != 0 {
-		sub := tukdsub.DSUBEvent{Action: tukcnst.CANCEL, BrokerURL: i.EventServices.BrokerService.WSE, RowID: int64(i.RowId)}
-		tukdsub.New_Transaction(&sub)
+	var err error
+	switch i.Task {
+	case tukcnst.CANCEL:
+		if i.RowId != 0 {
+			sub := tukdsub.DSUBEvent{Action: tukcnst.CANCEL, BrokerURL: i.EventServices.BrokerService.WSE, RowID: int64(i.RowId)}
+			tukdsub.New_Transaction(&sub)
+		}
+	case tukcnst.CREATE:
+		err = i.createSubscription()
+	case TUK_TASK_RENEW:
+		err = i.renewSubscription()
+	case TUK_TASK_PAUSE:
+		err = i.setSubscriptionDelivery(SUBSCRIPTION_STATUS_PAUSED)
+	case TUK_TASK_RESUME:
+		err = i.setSubscriptionDelivery(SUBSCRIPTION_STATUS_ACTIVE)
+	case TUK_TASK_BROKER_REF:
+		return i.BrokerRefWidget()
 	}
-	subs := tukdsub.DSUBEvent{Action: tukcnst.SELECT, Pathway: i.Pathway}
-	tukdsub.New_Transaction(&subs)
-	i.DBSubscriptions = subs.Subs
+	if err != nil {
+		log.Println(err.Error())
+		return []byte(err.Error())
+	}
+	if i.Page, err = i.newPage("id"); err != nil {
+		i.ReturnCode = http.StatusBadRequest
+		return []byte(err.Error())
+	}
+	subs, err := getSubscriptionsPage(i.Pathway, &i.Page)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	i.DBSubscriptions = tukdbint.Subscriptions{Action: tukcnst.SELECT, Count: len(subs), Subscriptions: append([]tukdbint.Subscription{{Pathway: i.Pathway}}, subs...)}
+	if i.SubscriptionStates, err = getSubscriptionStates(); err != nil {
+		log.Println(err.Error())
+	}
+	i.setLinkHeader()
 	if i.ReturnJSON {
 		if i.HttpResponse != nil {
 			i.HttpResponse.Header().Add(tukcnst.CONTENT_TYPE, tukcnst.APPLICATION_JSON)
 		}
-		jstr, err := json.Marshal(i.DBSubscriptions)
+		var rsp interface{} = i.DBSubscriptions
+		if i.isPaged() {
+			rsp = SubscriptionsPage{Subscriptions: subs, Page: i.Page}
+		}
+		jstr, err := json.Marshal(rsp)
 		if err != nil {
 			return []byte(err.Error())
 		}
@@ -571,14 +714,29 @@ func (i *TukEvent) manageEvents() []byte {
 	switch i.Task {
 	case tukcnst.CREATE:
 		return i.createEvent()
+	case TUK_TASK_ENTERED_IN_ERROR:
+		return i.enteredInError()
+	case TUK_TASK_SEARCH:
+		return i.searchEvents()
 	case tukcnst.LIST:
-		evs := tukdbint.Events{Action: tukcnst.SELECT}
 		ev := tukdbint.Event{Id: i.RowId, Pathway: i.Pathway, NhsId: i.NHSId, Version: i.Vers, TaskId: i.TaskID}
-		evs.Events = append(evs.Events, ev)
-		tukdbint.NewDBEvent(&evs)
+		if i.ReturnCSV {
+			return i.exportEvents(ev)
+		}
+		var err error
+		if i.Page, err = i.newPage("id"); err != nil {
+			i.ReturnCode = http.StatusBadRequest
+			return []byte(err.Error())
+		}
+		page, err := getEventsPage(ev, &i.Page)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		evs := tukdbint.Events{Action: tukcnst.SELECT, Count: len(page), Events: append([]tukdbint.Event{ev}, page...)}
 		i.DBEvents = evs.Events
+		i.setLinkHeader()
 		if i.ReturnJSON {
-			rsp, _ = json.MarshalIndent(evs, "", "  ")
+			rsp, _ = json.MarshalIndent(EventsPage{Events: evs, Page: i.Page}, "", "  ")
 		} else {
 			rsp = i.eventsWidget()
 		}
@@ -607,8 +765,7 @@ func (i *TukEvent) createEvent() []byte {
 	} else {
 		log.Printf("Persisted User Generated Event id %v for task %v pathway %s nhs id %v version %v", evs.LastInsertId, i.DBEvent.TaskId, i.DBEvent.Pathway, i.DBEvent.NhsId, i.Vers)
 	}
-	trans := tukxdw.Transaction{Actor: tukcnst.XDW_ACTOR_CONTENT_UPDATER, Pathway: i.Pathway, XDWVersion: i.Vers, NHS_ID: i.NHSId}
-	if err := tukxdw.Execute(&trans); err != nil {
+	if err := updateWorkflows(i.Pathway, i.NHSId, i.Vers); err != nil {
 		log.Println(err.Error())
 	}
 	i.Act = tukcnst.WIDGET
@@ -634,6 +791,8 @@ func (i *TukEvent) handleRequest() []byte {
 		rsp = i.manageEvents()
 	case tukcnst.SUBSCRIBER:
 		rsp = i.manageSubscriptions()
+	case tukcnst.WORKFLOW:
+		rsp = i.manageWorkflow()
 	case tukcnst.SERVICES:
 		rsp = i.manageServices()
 	case tukcnst.WIDGET:
@@ -650,22 +809,21 @@ func (i *TukEvent) handleRequest() []byte {
 	}
 	return rsp
 }
+
+// xdwContentConsumer returns the workflow document of the pathway, nhs id and version as xml
 func (i *TukEvent) xdwContentConsumer() []byte {
 	i.ReturnXML = true
-	trans := tukxdw.Transaction{
-		Actor:      i.Act,
-		User:       i.EventServices.EventService.User,
-		Org:        i.EventServices.EventService.Org,
-		Role:       i.EventServices.EventService.Role,
-		Pathway:    i.Pathway,
-		NHS_ID:     i.NHSId,
-		Task_ID:    -1,
-		XDWVersion: i.Vers,
-	}
-	if err := tukxdw.Execute(&trans); err != nil {
-		log.Println(err.Error())
+	doc := tukxdw.WorkflowDocument{}
+	wfs := getWorkflows(i.Pathway, i.NHSId, i.Vers, "")
+	for _, wf := range wfs.Workflows {
+		if wf.Id == 0 {
+			continue
+		}
+		if err := json.Unmarshal([]byte(wf.XDW_Doc), &doc); err != nil {
+			log.Println(err.Error())
+		}
 	}
-	bytes, _ := xml.MarshalIndent(trans.WorkflowDocument, "", "  ")
+	bytes, _ := xml.MarshalIndent(doc, "", "  ")
 	return bytes
 }
 func (i *TukEvent) xdwContentCreator() []byte {
@@ -680,6 +838,8 @@ func (i *TukEvent) xdwContentCreator() []byte {
 	}
 	if err := tukxdw.Execute(&trans); err != nil {
 		log.Println(err.Error())
+	} else {
+		newWorkflowCreated(trans.Workflows.LastInsertId, i.Pathway)
 	}
 	if bytes, err := xml.MarshalIndent(trans.WorkflowDocument, "", "  "); err == nil {
 		i.ConfigStr = string(bytes)
@@ -698,6 +858,12 @@ func (i *TukEvent) manageServices() []byte {
 	case tukcnst.TUK_TASK_RESTART:
 		InitTuki()
 		return []byte(tukcnst.OK)
+	case TUK_TASK_REPLAY:
+		return i.replayWorkflows()
+	case TUK_TASK_REPLAY_NOTIFICATION:
+		return i.replayNotifications()
+	case TUK_TASK_RECONCILE:
+		return i.reconcileSubscriptions()
 	case tukcnst.TUK_TASK_GET:
 		srvc, err = tukdbint.GetServiceState(i.Op)
 		if err == nil {
@@ -872,12 +1038,17 @@ func TukEventServer() {
 	isSecure := Services.EventService.Scheme == "https"
 	log.Printf("Event Service set to Secure Mode : %v", isSecure)
 	http.HandleFunc("/"+Services.EventService.BaseURLPath+"/"+Services.EventService.EventUrl, tukutil.WriteResponseHeaders(Handle_TUK_HTTP_Request, isSecure))
+	http.HandleFunc("/"+Services.EventService.BaseURLPath+"/"+FHIR_PATH+"/", tukutil.WriteResponseHeaders(Handle_FHIR_HTTP_Request, isSecure))
 	http.Handle("/"+Services.EventService.FilesUrl, http.StripPrefix("/"+Services.EventService.FilesUrl, http.FileServer(http.Dir(Basepath+"/"+Services.EventService.FilesPath))))
 	http.Handle(Services.EventService.BaseURLPath, http.StripPrefix(Services.EventService.BaseURLPath+Services.EventService.FilesUrl, http.FileServer(http.Dir(Basepath+"/"+Services.EventService.FilesPath))))
 	log.Println("Inialised Event Management Handler - " + Services.EventService.WSE)
+	log.Println("Inialised FHIR Handler - /" + Services.EventService.BaseURLPath + "/" + FHIR_PATH + "/")
 
 	monitorApp()
 	log.Println("Initialised Application Monitor")
+	StartWorkflowStateScheduler(time.Duration(Services.EventService.StateInterval) * time.Minute)
+	StartNotificationWorkers(Services.EventService.NotificationWorkers)
+	StartSubscriptionReconciler(time.Duration(Services.EventService.ReconcileInterval) * time.Minute)
 	startUpMessage()
 	if isSecure {
 		log.Fatal(http.ListenAndServeTLS(":"+strconv.Itoa(Services.EventService.Port), Basepath+Services.EventService.CertPath+"/"+Services.EventService.Certs, Basepath+Services.EventService.CertPath+"/"+Services.EventService.Keys, nil))
@@ -939,10 +1110,17 @@ func (i *TukEvent) setAwsResponseHeaders() map[string]string {
 	} else {
 		if i.ReturnXML {
 			awsHeaders[tukcnst.CONTENT_TYPE] = tukcnst.APPLICATION_XML
+		} else if i.ReturnCSV {
+			awsHeaders[tukcnst.CONTENT_TYPE] = TEXT_CSV + "; charset=utf-8"
+		} else if i.ReturnPDF {
+			awsHeaders[tukcnst.CONTENT_TYPE] = APPLICATION_PDF
 		} else {
 			awsHeaders[tukcnst.CONTENT_TYPE] = tukcnst.TEXT_HTML
 		}
 	}
+	if i.Page.Next != "" {
+		awsHeaders[LINK] = "<" + i.Page.Next + ">; rel=\"next\""
+	}
 	awsHeaders["Access-Control-Allow-Origin"] = "*"
 	awsHeaders["Access-Control-Allow-Headers"] = "accept, Content-Type"
 	awsHeaders["Access-Control-Allow-Methods"] = "GET, POST, OPTIONS"
@@ -952,6 +1130,9 @@ func (i *TukEvent) setAwsResponseHeaders() map[string]string {
 	return awsHeaders
 }
 
+// Handle_AWS_API_GW_Request is the Lambda entry point for API Gateway requests. Broker notifications are acknowledged once they are added to
+// the notification inbox. Lambda runs no notification workers, so the inbox is processed by Handle_AWS_Scheduled_Event and the schedule
+// interval is the delay before a notification is applied to its workflows
 func Handle_AWS_API_GW_Request(request events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
 	i := TukEvent{REGOid: Regoid, EventServices: Services}
 	i.HTTPMethod = request.HTTPMethod
@@ -959,6 +1140,12 @@ func Handle_AWS_API_GW_Request(request events.APIGatewayProxyRequest) (*events.A
 	i.Audience = "N"
 	i.ReturnCode = 200
 	log.Printf("Processing request data for request %s.\n", request.Path)
+	if isFHIRRequest(request.Path) {
+		return handleAWSFHIRRequest(request), nil
+	}
+	if request.HTTPMethod == http.MethodPost && isSOAPNotifyRequest(request.Headers[tukcnst.CONTENT_TYPE], request.Body) {
+		return i.handleAWSSOAPNotify(request), nil
+	}
 	log.Printf("Body size = %d.\n", len(request.Body))
 	log.Println("Headers:")
 	for key, value := range request.Headers {
@@ -983,8 +1170,10 @@ func Handle_AWS_API_GW_Request(request events.APIGatewayProxyRequest) (*events.A
 
 	log.Println("AWS API Query Parameters")
 	isStaticFileRequest := false
+	query := url.Values{}
 	for key, value := range request.QueryStringParameters {
 		log.Printf("    %s: %s\n", key, value)
+		query.Set(key, value)
 		switch key {
 		case tukcnst.STATICS:
 			isStaticFileRequest = true
@@ -1042,15 +1231,52 @@ func Handle_AWS_API_GW_Request(request events.APIGatewayProxyRequest) (*events.A
 			i.ConfigStr = value
 		case tukcnst.TUK_EVENT_QUERY_PARAM_DOCREF:
 			i.DocRef = value
+		case TUK_EVENT_QUERY_PARAM_DATE_FROM:
+			i.DateFrom = value
+		case TUK_EVENT_QUERY_PARAM_DATE_TO:
+			i.DateTo = value
+		case TUK_EVENT_QUERY_PARAM_AUTHOR_ORG:
+			i.AuthorOrg = value
+		case TUK_EVENT_QUERY_PARAM_NHS_PREFIX:
+			i.NHSIdPrefix = value
+		case TUK_EVENT_QUERY_PARAM_OVERDUE:
+			i.Overdue, _ = strconv.ParseBool(value)
+		case TUK_EVENT_QUERY_PARAM_ESCALATED:
+			i.Escalated, _ = strconv.ParseBool(value)
+		case TUK_EVENT_QUERY_PARAM_SORT:
+			i.Sort = value
+		case TUK_EVENT_QUERY_PARAM_ORDER:
+			i.Order = value
+		case TUK_EVENT_QUERY_PARAM_LIMIT:
+			i.Limit = tukutil.GetIntFromString(value)
+		case TUK_EVENT_QUERY_PARAM_OFFSET:
+			i.Offset = tukutil.GetIntFromString(value)
+		case TUK_EVENT_QUERY_PARAM_CURSOR:
+			i.Cursor = value
+		case TUK_EVENT_QUERY_PARAM_SEARCH_TEXT:
+			i.SearchText = value
+		case tukcnst.TUK_EVENT_QUERY_PARAM_EVENT_TYPE:
+			i.EventType = value
+		case TUK_EVENT_QUERY_PARAM_CLASS_CODE:
+			i.ClassCode = value
+		case TUK_EVENT_QUERY_PARAM_EVENT_ORG:
+			i.EventOrg = value
+		case tukcnst.QUERY_PARAM_BROKER_REF:
+			i.BrokerRef = value
+		case TUK_EVENT_QUERY_PARAM_TERMINATION_TIME:
+			i.TerminationTime = value
 		case tukcnst.TUK_EVENT_QUERY_PARAM_FORMAT:
 			switch value {
 			case tukcnst.XML:
 				i.ReturnXML = true
 			case tukcnst.JSON:
 				i.ReturnJSON = true
+			case CSV:
+				i.ReturnCSV = true
 			}
 		}
 	}
+	i.RequestURL = &url.URL{Path: request.Path, RawQuery: query.Encode()}
 	if isStaticFileRequest {
 		return &events.APIGatewayProxyResponse{
 			StatusCode: 200,
@@ -1059,6 +1285,14 @@ func Handle_AWS_API_GW_Request(request events.APIGatewayProxyRequest) (*events.A
 		}, nil
 	}
 	tukrsp := i.handleRequest()
+	if i.ReturnPDF {
+		return &events.APIGatewayProxyResponse{
+			StatusCode:      i.ReturnCode,
+			Headers:         i.setAwsResponseHeaders(),
+			Body:            base64.StdEncoding.EncodeToString(tukrsp),
+			IsBase64Encoded: true,
+		}, nil
+	}
 	return &events.APIGatewayProxyResponse{
 		StatusCode: i.ReturnCode,
 		Headers:    i.setAwsResponseHeaders(),
@@ -1067,7 +1301,7 @@ func Handle_AWS_API_GW_Request(request events.APIGatewayProxyRequest) (*events.A
 }
 func Handle_TUK_HTTP_Request(rsp http.ResponseWriter, req *http.Request) {
 	log.Printf("Received http %s request from %s. Processing New Event", req.Method, req.RemoteAddr)
-	i := TukEvent{REGOid: Regoid, EventServices: Services, HttpRequest: req, HttpResponse: rsp}
+	i := TukEvent{REGOid: Regoid, EventServices: Services, HttpRequest: req, HttpResponse: rsp, RequestURL: req.URL}
 	req.ParseForm()
 	i.EventServices.EventService.User = req.FormValue(tukcnst.TUK_EVENT_QUERY_PARAM_USER)
 	i.EventServices.EventService.Org = req.FormValue(tukcnst.TUK_EVENT_QUERY_PARAM_ORG)
@@ -1084,12 +1318,32 @@ func Handle_TUK_HTTP_Request(rsp http.ResponseWriter, req *http.Request) {
 	i.Notes = req.FormValue(tukcnst.TUK_EVENT_QUERY_PARAM_NOTES)
 	i.ConfigStr = req.FormValue(tukcnst.TUK_EVENT_QUERY_PARAM_CONFIG)
 	i.DocRef = req.FormValue(tukcnst.TUK_EVENT_QUERY_PARAM_DOCREF)
+	i.DateFrom = req.FormValue(TUK_EVENT_QUERY_PARAM_DATE_FROM)
+	i.DateTo = req.FormValue(TUK_EVENT_QUERY_PARAM_DATE_TO)
+	i.AuthorOrg = req.FormValue(TUK_EVENT_QUERY_PARAM_AUTHOR_ORG)
+	i.NHSIdPrefix = req.FormValue(TUK_EVENT_QUERY_PARAM_NHS_PREFIX)
+	i.Overdue, _ = strconv.ParseBool(req.FormValue(TUK_EVENT_QUERY_PARAM_OVERDUE))
+	i.Escalated, _ = strconv.ParseBool(req.FormValue(TUK_EVENT_QUERY_PARAM_ESCALATED))
+	i.Sort = req.FormValue(TUK_EVENT_QUERY_PARAM_SORT)
+	i.Order = req.FormValue(TUK_EVENT_QUERY_PARAM_ORDER)
+	i.Limit = tukutil.GetIntFromString(req.FormValue(TUK_EVENT_QUERY_PARAM_LIMIT))
+	i.Offset = tukutil.GetIntFromString(req.FormValue(TUK_EVENT_QUERY_PARAM_OFFSET))
+	i.Cursor = req.FormValue(TUK_EVENT_QUERY_PARAM_CURSOR)
+	i.SearchText = req.FormValue(TUK_EVENT_QUERY_PARAM_SEARCH_TEXT)
+	i.EventType = req.FormValue(tukcnst.TUK_EVENT_QUERY_PARAM_EVENT_TYPE)
+	i.ClassCode = req.FormValue(TUK_EVENT_QUERY_PARAM_CLASS_CODE)
+	i.EventOrg = req.FormValue(TUK_EVENT_QUERY_PARAM_EVENT_ORG)
+	i.BrokerRef = req.FormValue(tukcnst.QUERY_PARAM_BROKER_REF)
+	i.TerminationTime = req.FormValue(TUK_EVENT_QUERY_PARAM_TERMINATION_TIME)
 	if req.Header.Get(tukcnst.ACCEPT) == tukcnst.APPLICATION_JSON || req.FormValue(tukcnst.TUK_EVENT_QUERY_PARAM_FORMAT) == tukcnst.JSON {
 		i.ReturnJSON = true
 	}
 	if req.Header.Get(tukcnst.ACCEPT) == tukcnst.APPLICATION_XML || req.FormValue(tukcnst.TUK_EVENT_QUERY_PARAM_FORMAT) == tukcnst.XML {
 		i.ReturnXML = true
 	}
+	if req.Header.Get(tukcnst.ACCEPT) == TEXT_CSV || req.FormValue(tukcnst.TUK_EVENT_QUERY_PARAM_FORMAT) == CSV {
+		i.ReturnCSV = true
+	}
 	if i.Audience == "" {
 		i.Audience = "N"
 	}
@@ -1111,7 +1365,11 @@ func Handle_TUK_HTTP_Request(rsp http.ResponseWriter, req *http.Request) {
 	i.HTTPMethod = req.Method
 	i.printFormValues()
 
-	i.HttpResponse.Write(i.handleRequest())
+	tukrsp := i.handleRequest()
+	if i.ReturnCode > 0 && i.ReturnCode != http.StatusOK {
+		i.HttpResponse.WriteHeader(i.ReturnCode)
+	}
+	i.HttpResponse.Write(tukrsp)
 }
 func (i *TukEvent) printFormValues() {
 	if DebugMode {
@@ -1140,6 +1398,14 @@ func (i *TukEvent) GetWidget() []byte {
 		return i.newXDWSHandler()
 	case tukcnst.CONFIG:
 		return i.ConfigWidget()
+	case TUK_TASK_SLA:
+		return i.SLAWidget()
+	case TUK_TASK_ANALYTICS:
+		return i.AnalyticsWidget()
+	case TUK_TASK_PDF:
+		return i.WorkflowPDF()
+	case TUK_TASK_NOTIFICATIONS:
+		return i.NotificationsWidget()
 	}
 	return []byte("invalid widget request")
 }
@@ -1176,24 +1442,14 @@ func (i *TukEvent) WorkflowTasksWidget() []byte {
 	return b.Bytes()
 }
 func (i *TukEvent) DashboardWidget() []byte {
-	switch strings.ToUpper(i.Status) {
-	case tukcnst.OPEN:
-		i.Status = tukcnst.OPEN
-	case tukcnst.CLOSED:
-		i.Status = tukcnst.TUK_STATUS_CLOSED
-	case tukcnst.TUK_STATUS_MET:
-		i.Status = tukcnst.TUK_STATUS_CLOSED
-	case tukcnst.TUK_STATUS_MISSED:
-		i.Status = tukcnst.TUK_STATUS_CLOSED
-	case tukcnst.TUK_STATUS_ESCALATED:
-		i.Status = tukcnst.OPEN
-	}
-	trans := tukxdw.Transaction{Pathway: i.Pathway, NHS_ID: i.NHSId, XDWVersion: i.Vers}
-	if err := tukxdw.Execute(&trans); err != nil {
+	dashboard, err := getDashboard(i.workflowFilter())
+	if err != nil {
 		log.Println(err.Error())
 	}
-
-	i.Dashboard = trans.Dashboard
+	i.Dashboard = dashboard
+	if i.ReturnCSV {
+		return i.exportDashboard()
+	}
 	var tplReturn bytes.Buffer
 	if err := i.EventServices.HTMLTemplates.ExecuteTemplate(&tplReturn, tukcnst.TUK_TEMPLATE_DASHBOARD_WIDGET, i); err != nil {
 		log.Println(err.Error())
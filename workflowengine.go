@@ -0,0 +1,710 @@
+package tukint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukutil"
+	"github.com/ipthomas/tukxdw"
+)
+
+const (
+	GATEWAY_EXCLUSIVE = "exclusive"
+	GATEWAY_PARALLEL  = "parallel"
+	JOIN_ALL          = "all"
+	JOIN_ANY          = "any"
+)
+
+// WorkflowFlow holds the task dependencies, gateways and activation conditions of a workflow definition.
+// tukxdw.WorkflowDefinition does not retain these fields so they are parsed from the definition json
+type WorkflowFlow struct {
+	Ref   string      `json:"ref"`
+	Tasks []TaskFlow  `json:"tasks"`
+	SLAs  []SLATarget `json:"slas,omitempty"`
+}
+type TaskFlow struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Pathway   string   `json:"pathway,omitempty"`
+	DependsOn []string `json:"dependson,omitempty"`
+	Gateway   string   `json:"gateway,omitempty"`
+	Join      string   `json:"join,omitempty"`
+	Condition string   `json:"condition,omitempty"`
+}
+type WorkflowGraph struct {
+	Nodes []WorkflowGraphNode `json:"nodes"`
+	Edges []WorkflowGraphEdge `json:"edges"`
+}
+type WorkflowGraphNode struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Gateway string `json:"gateway"`
+	Join    string `json:"join"`
+	Active  bool   `json:"active"`
+}
+type WorkflowGraphEdge struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Condition string `json:"condition"`
+}
+
+const WORKFLOW_UPDATE_RETRIES = 5
+
+var (
+	ErrWorkflowConflict = errors.New("workflow document was updated by another transaction")
+	workflowLocks       = make(map[int64]*workflowMutex)
+	workflowLocksMu     sync.Mutex
+)
+
+// workflowMutex serialises updates to a workflow within the process. refs counts the holders and waiters so the entry can be removed once unused
+type workflowMutex struct {
+	sync.Mutex
+	refs int
+}
+
+// workflowEngine applies Event Service events to a workflow document. It has no side effects, persist() writes the result
+type workflowEngine struct {
+	Workflow      tukdbint.Workflow
+	Definition    tukxdw.WorkflowDefinition
+	Document      tukxdw.WorkflowDocument
+	Flow          WorkflowFlow
+	Filters       map[string]DSUBFilter
+	Sequence      string
+	Applied       int
+	Closed        string
+	LastEventTime string
+}
+
+func newWorkflowEngine(wf tukdbint.Workflow) (*workflowEngine, error) {
+	e, err := newDefinitionEngine(wf)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(wf.XDW_Doc), &e.Document); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	e.Sequence = e.Document.WorkflowDocumentSequenceNumber
+	return e, nil
+}
+
+// newDefinitionEngine returns a workflow engine for the workflow definition without a workflow document
+func newDefinitionEngine(wf tukdbint.Workflow) (*workflowEngine, error) {
+	e := workflowEngine{Workflow: wf}
+	if err := json.Unmarshal([]byte(wf.XDW_Def), &e.Definition); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(wf.XDW_Def), &e.Flow); err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	def, err := newDSUBDefinition(wf.XDW_Def)
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+	e.Filters = def.filters()
+	return &e, nil
+}
+
+// updateWorkflowDocument applies update to the workflow and persists the result. If the workflow document was changed by a concurrent update
+// the update is re-applied to the latest workflow document
+func updateWorkflowDocument(wf tukdbint.Workflow, update func(e *workflowEngine) (bool, error)) error {
+	unlock := lockWorkflow(wf.Id)
+	defer unlock()
+	for attempt := 1; ; attempt++ {
+		e, err := newWorkflowEngine(wf)
+		if err != nil {
+			return err
+		}
+		changed, err := update(e)
+		if err != nil || !changed {
+			return err
+		}
+		err = e.persist()
+		if err != ErrWorkflowConflict || attempt == WORKFLOW_UPDATE_RETRIES {
+			return err
+		}
+		log.Printf("%s Workflow for NHS ID %s was updated concurrently. Retrying update %v with latest Workflow Document", wf.Pathway, wf.NHSId, attempt)
+		if wf, err = getWorkflow(wf.Id); err != nil {
+			return err
+		}
+	}
+}
+
+// lockWorkflow locks the workflow and returns the func that unlocks it. The lock is removed when no other update holds or waits for it
+func lockWorkflow(workflowid int64) func() {
+	workflowLocksMu.Lock()
+	lock, ok := workflowLocks[workflowid]
+	if !ok {
+		lock = &workflowMutex{}
+		workflowLocks[workflowid] = lock
+	}
+	lock.refs++
+	workflowLocksMu.Unlock()
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		workflowLocksMu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(workflowLocks, workflowid)
+		}
+		workflowLocksMu.Unlock()
+	}
+}
+
+// updateWorkflows is the Event Service XDW Content Updater. It applies any unregistered events to the selected workflows
+func updateWorkflows(pathway string, nhsid string, vers int) error {
+	wfs := getWorkflows(pathway, nhsid, vers, "")
+	evs, err := getEvents(tukdbint.Event{Pathway: pathway, NhsId: nhsid, Version: vers, TaskId: -1})
+	if err != nil {
+		return err
+	}
+	log.Printf("Updating state of %v Workflows with %v Events", wfs.Count, evs.Count)
+	for _, wf := range wfs.Workflows {
+		if wf.Id == 0 {
+			continue
+		}
+		if uerr := updateWorkflow(wf, evs.Events); uerr != nil {
+			err = uerr
+		}
+	}
+	return err
+}
+func updateWorkflow(wf tukdbint.Workflow, evs []tukdbint.Event) error {
+	log.Printf("Updating %s Workflow Version %v for NHS ID %s", wf.Pathway, wf.Version, wf.NHSId)
+	var wfevs []tukdbint.Event
+	errs, _ := getEventErrors(wf.Pathway, wf.NHSId)
+	for _, ev := range workflowEvents(wf, evs) {
+		errored := false
+		for _, everr := range errs {
+			if everr.EventId == ev.Id {
+				errored = true
+			}
+		}
+		if !errored {
+			wfevs = append(wfevs, ev)
+		}
+	}
+	return updateWorkflowDocument(wf, func(e *workflowEngine) (bool, error) {
+		if e.Document.WorkflowStatus == WORKFLOW_STATUS_SUSPENDED {
+			log.Printf("%s Workflow for NHS ID %s is suspended. Deferring Events", wf.Pathway, wf.NHSId)
+			return false, nil
+		}
+		e.applyEvents(wfevs)
+		if e.Applied == 0 && e.Closed == "" {
+			log.Printf("No new events for %s Workflow NHS ID %s", wf.Pathway, wf.NHSId)
+			return false, nil
+		}
+		return true, nil
+	})
+}
+
+// workflowEvents returns the events belonging to the workflow in ascending event id order
+func workflowEvents(wf tukdbint.Workflow, evs []tukdbint.Event) []tukdbint.Event {
+	var wfevs []tukdbint.Event
+	for _, ev := range evs {
+		if ev.Id > 0 && ev.Pathway == wf.Pathway && ev.NhsId == wf.NHSId && ev.Version == wf.Version {
+			wfevs = append(wfevs, ev)
+		}
+	}
+	sort.Slice(wfevs, func(i, j int) bool { return wfevs[i].Id < wfevs[j].Id })
+	return wfevs
+}
+
+// applyEvents applies events to active tasks. Events for tasks that are not yet active are deferred until a task they match becomes active
+// and are returned if no matching task becomes active
+func (e *workflowEngine) applyEvents(evs []tukdbint.Event) []tukdbint.Event {
+	pending := evs
+	var deferred []tukdbint.Event
+	for {
+		e.activateTasks()
+		deferred = nil
+		applied := 0
+		for _, ev := range pending {
+			wait, ok := e.applyEvent(ev)
+			if ok {
+				applied = applied + 1
+			}
+			if wait {
+				deferred = append(deferred, ev)
+			}
+		}
+		e.Applied = e.Applied + applied
+		e.setTaskStates()
+		if applied == 0 || len(deferred) == 0 {
+			if len(deferred) > 0 {
+				log.Printf("%v Events are for tasks that are not active. Deferring Events", len(deferred))
+			}
+			break
+		}
+		pending = deferred
+	}
+	e.setWorkflowState()
+	return deferred
+}
+
+// applyEvent returns wait true if the event matches an input or output of a task that is not active and ok true if the event was applied to an active task
+func (e *workflowEngine) applyEvent(ev tukdbint.Event) (bool, bool) {
+	switch ev.EventType {
+	case XDW_TASKEVENTTYPE_SUBWORKFLOW_CLOSED:
+		return e.applySubworkflowEvent(ev)
+	case tukcnst.XDW_DOCEVENTTYPE_CREATE_WORKFLOW, tukcnst.XDW_TASKEVENTTYPE_CREATE_TASK, tukcnst.XDW_TASKEVENTTYPE_WORKFLOW_COMPLETED, XDW_TASKEVENTTYPE_SUBWORKFLOW_CREATED:
+		return false, false
+	}
+	wait := false
+	ok := false
+	for k, task := range e.Document.TaskList.XDWTask {
+		if ev.TaskId > 0 && task.TaskData.TaskDetails.ID != tukutil.GetStringFromInt(ev.TaskId) {
+			continue
+		}
+		for inp, input := range task.TaskData.Input {
+			if ev.Expression != input.Part.Name || !e.matchesFilter(task.TaskData.TaskDetails.ID, input.Part.Name, ev) {
+				continue
+			}
+			if !e.isTaskActive(k) {
+				wait = true
+				continue
+			}
+			if e.isRegistered(k, input.Part, ev) {
+				log.Printf("Task %s Input %s Event %v is registered. Skipping Event", task.TaskData.TaskDetails.ID, input.Part.Name, ev.Id)
+				continue
+			}
+			log.Printf("Updating Task %s Input %s with Event ID %v", task.TaskData.TaskDetails.ID, input.Part.Name, ev.Id)
+			e.Document.TaskList.XDWTask[k].TaskData.Input[inp].Part.AttachmentInfo = e.newAttachmentInfo(input.Part.AttachmentInfo, ev)
+			e.newTaskEvent(k, ev)
+			ok = true
+		}
+		for oup, output := range task.TaskData.Output {
+			if ev.Expression != output.Part.Name || !e.matchesFilter(task.TaskData.TaskDetails.ID, output.Part.Name, ev) {
+				continue
+			}
+			if !e.isTaskActive(k) {
+				wait = true
+				continue
+			}
+			if e.isRegistered(k, output.Part, ev) {
+				log.Printf("Task %s Output %s Event %v is registered. Skipping Event", task.TaskData.TaskDetails.ID, output.Part.Name, ev.Id)
+				continue
+			}
+			log.Printf("Updating Task %s Output %s with Event ID %v", task.TaskData.TaskDetails.ID, output.Part.Name, ev.Id)
+			e.Document.TaskList.XDWTask[k].TaskData.Output[oup].Part.AttachmentInfo = e.newAttachmentInfo(output.Part.AttachmentInfo, ev)
+			e.newTaskEvent(k, ev)
+			ok = true
+		}
+	}
+	return wait, ok
+}
+
+// matchesFilter returns true if the task part has no filter criteria or the event is not a broker notification event or the event matches
+// the filter criteria. Broker notification events are identified by their broker ref, so events must be selected with getEvents
+func (e *workflowEngine) matchesFilter(taskid string, part string, ev tukdbint.Event) bool {
+	filter, ok := e.Filters[taskid+"|"+part]
+	return !ok || ev.BrokerRef == "" || filter.matches(ev)
+}
+
+// isRegistered returns true if the event is in the task event history or the xds document is already attached to the part
+func (e *workflowEngine) isRegistered(k int, part tukxdw.Part, ev tukdbint.Event) bool {
+	for _, tev := range e.Document.TaskList.XDWTask[k].TaskEventHistory.TaskEvent {
+		if tev.ID == tukutil.GetStringFromInt(int(ev.Id)) {
+			return true
+		}
+	}
+	return strings.HasSuffix(part.AttachmentInfo.AccessType, tukcnst.XDS_REGISTERED) && part.AttachmentInfo.Identifier != "" && part.AttachmentInfo.Identifier == ev.XdsDocEntryUid
+}
+func (e *workflowEngine) newAttachmentInfo(info tukxdw.AttachmentInfo, ev tukdbint.Event) tukxdw.AttachmentInfo {
+	info.AttachedTime = ev.Creationtime
+	info.AttachedBy = ev.User + " " + ev.Org + " " + ev.Role
+	info.HomeCommunityId = Regoid
+	if strings.HasSuffix(info.AccessType, tukcnst.XDS_REGISTERED) {
+		info.Identifier = ev.XdsDocEntryUid
+	} else {
+		info.Identifier = tukutil.GetStringFromInt(int(ev.Id))
+	}
+	return info
+}
+func (e *workflowEngine) newTaskEvent(k int, ev tukdbint.Event) {
+	details := &e.Document.TaskList.XDWTask[k].TaskData.TaskDetails
+	details.LastModifiedTime = ev.Creationtime
+	e.LastEventTime = ev.Creationtime
+	details.ActualOwner = ev.User + " " + ev.Org + " " + ev.Role
+	if details.Status != tukcnst.COMPLETE {
+		details.Status = tukcnst.IN_PROGRESS
+	}
+	if details.ActivationTime == "" {
+		details.ActivationTime = ev.Creationtime
+	}
+	nte := tukxdw.TaskEvent{
+		ID:         tukutil.GetStringFromInt(int(ev.Id)),
+		EventTime:  ev.Creationtime,
+		Identifier: details.ID,
+		EventType:  details.TaskType,
+		Status:     tukcnst.COMPLETE,
+	}
+	e.Document.TaskList.XDWTask[k].TaskEventHistory.TaskEvent = append(e.Document.TaskList.XDWTask[k].TaskEventHistory.TaskEvent, nte)
+	e.incrementSequenceNumber()
+	docevent := tukxdw.DocumentEvent{
+		Author:              ev.User + " " + ev.Org + " " + ev.Role,
+		TaskEventIdentifier: details.ID,
+		EventTime:           ev.Creationtime,
+		EventType:           details.TaskType,
+		PreviousStatus:      e.latestDocumentStatus(),
+		ActualStatus:        tukcnst.IN_PROGRESS,
+	}
+	e.Document.WorkflowStatusHistory.DocumentEvent = append(e.Document.WorkflowStatusHistory.DocumentEvent, docevent)
+}
+func (e *workflowEngine) incrementSequenceNumber() {
+	seq, _ := strconv.ParseInt(e.Document.WorkflowDocumentSequenceNumber, 0, 0)
+	e.Document.WorkflowDocumentSequenceNumber = strconv.Itoa(int(seq + 1))
+}
+func (e *workflowEngine) latestDocumentStatus() string {
+	if len(e.Document.WorkflowStatusHistory.DocumentEvent) == 0 {
+		return ""
+	}
+	return e.Document.WorkflowStatusHistory.DocumentEvent[len(e.Document.WorkflowStatusHistory.DocumentEvent)-1].ActualStatus
+}
+
+// setTaskStates sets active tasks whose completion behaviour is met to COMPLETE
+func (e *workflowEngine) setTaskStates() {
+	trans := e.transaction()
+	for k, task := range e.Document.TaskList.XDWTask {
+		if task.TaskData.TaskDetails.Status == tukcnst.COMPLETE || !e.isTaskActive(k) || e.isSubworkflowTask(k) || k >= len(e.Definition.Tasks) {
+			continue
+		}
+		trans.Task_ID = k
+		if trans.IsTaskCompleteBehaviorMet() {
+			e.Document.TaskList.XDWTask[k].TaskData.TaskDetails.Status = tukcnst.COMPLETE
+			e.activateTasks()
+		}
+	}
+}
+
+// setWorkflowState closes an open workflow when the workflow completion behaviour is met
+func (e *workflowEngine) setWorkflowState() {
+	if e.Document.WorkflowStatus != tukcnst.OPEN {
+		return
+	}
+	complete, completiontask := e.transaction().IsWorkflowCompleteBehaviorMet()
+	if !complete {
+		return
+	}
+	eventtime := e.LastEventTime
+	if eventtime == "" {
+		eventtime = tukutil.Time_Now()
+	}
+	e.closeWorkflow(completiontask, eventtime)
+}
+func (e *workflowEngine) closeWorkflow(completiontask string, eventtime string) {
+	e.Document.WorkflowStatus = tukcnst.CLOSED
+	docevent := tukxdw.DocumentEvent{
+		Author:              Services.EventService.User + " " + Services.EventService.Org + " " + Services.EventService.Role,
+		TaskEventIdentifier: completiontask,
+		EventTime:           eventtime,
+		EventType:           tukcnst.XDW_DOCEVENTTYPE_COMPLETED_WORKFLOW,
+		PreviousStatus:      e.latestDocumentStatus(),
+		ActualStatus:        tukcnst.COMPLETE,
+	}
+	e.Document.WorkflowStatusHistory.DocumentEvent = append(e.Document.WorkflowStatusHistory.DocumentEvent, docevent)
+	for k := range e.Document.TaskList.XDWTask {
+		e.Document.TaskList.XDWTask[k].TaskData.TaskDetails.Status = tukcnst.COMPLETE
+	}
+	e.incrementSequenceNumber()
+	e.Closed = completiontask
+	log.Printf("Closed %s Workflow for NHS ID %s. Total Workflow Document Events %v", e.Workflow.Pathway, e.Workflow.NHSId, len(e.Document.WorkflowStatusHistory.DocumentEvent))
+}
+func (e *workflowEngine) transaction() *tukxdw.Transaction {
+	return &tukxdw.Transaction{
+		Pathway:            e.Workflow.Pathway,
+		NHS_ID:             e.Workflow.NHSId,
+		XDWVersion:         e.Workflow.Version,
+		WorkflowDefinition: e.Definition,
+		WorkflowDocument:   e.Document,
+	}
+}
+
+// Task flow
+
+func (e *workflowEngine) taskFlow(id string) TaskFlow {
+	for _, tf := range e.Flow.Tasks {
+		if tf.ID == id {
+			return tf
+		}
+	}
+	return TaskFlow{ID: id}
+}
+func (e *workflowEngine) taskIndex(id string) int {
+	for k, task := range e.Document.TaskList.XDWTask {
+		if task.TaskData.TaskDetails.ID == id {
+			return k
+		}
+	}
+	return -1
+}
+func (e *workflowEngine) taskStatus(id string) string {
+	if k := e.taskIndex(id); k >= 0 {
+		return e.Document.TaskList.XDWTask[k].TaskData.TaskDetails.Status
+	}
+	return ""
+}
+
+// activateTasks sets tasks that have become active to READY
+func (e *workflowEngine) activateTasks() {
+	for k, task := range e.Document.TaskList.XDWTask {
+		if task.TaskData.TaskDetails.Status == tukcnst.CREATED && len(e.taskFlow(task.TaskData.TaskDetails.ID).DependsOn) > 0 && e.isTaskActive(k) {
+			log.Printf("Activating %s Workflow Task %s", e.Workflow.Pathway, task.TaskData.TaskDetails.ID)
+			e.Document.TaskList.XDWTask[k].TaskData.TaskDetails.Status = tukcnst.READY
+		}
+	}
+}
+
+// isTaskActive returns true if the task has no dependencies, has been activated or its dependencies and activation condition are met
+func (e *workflowEngine) isTaskActive(k int) bool {
+	details := e.Document.TaskList.XDWTask[k].TaskData.TaskDetails
+	tf := e.taskFlow(details.ID)
+	if len(tf.DependsOn) == 0 || details.Status != tukcnst.CREATED {
+		return true
+	}
+	met := 0
+	for _, dep := range tf.DependsOn {
+		if e.taskStatus(dep) != tukcnst.COMPLETE {
+			continue
+		}
+		if e.taskFlow(dep).Gateway == GATEWAY_EXCLUSIVE {
+			if e.exclusiveSuccessor(dep) == tf.ID {
+				met = met + 1
+			}
+		} else if e.isConditionMet(tf.Condition) {
+			met = met + 1
+		}
+	}
+	if tf.Join == JOIN_ANY {
+		return met > 0
+	}
+	return met == len(tf.DependsOn)
+}
+
+// exclusiveSuccessor returns the first successor of an exclusive gateway task whose condition is met, or the first unconditional successor
+func (e *workflowEngine) exclusiveSuccessor(id string) string {
+	var dflt string
+	for _, successor := range e.successors(id) {
+		if successor.Condition == "" {
+			if dflt == "" {
+				dflt = successor.ID
+			}
+			continue
+		}
+		if e.isConditionMet(successor.Condition) {
+			return successor.ID
+		}
+	}
+	return dflt
+}
+func (e *workflowEngine) successors(id string) []TaskFlow {
+	var successors []TaskFlow
+	for _, tf := range e.Flow.Tasks {
+		for _, dep := range tf.DependsOn {
+			if dep == id {
+				successors = append(successors, tf)
+			}
+		}
+	}
+	return successors
+}
+
+// isConditionMet evaluates activation conditions using the same methods as completion conditions, task(id), input(name) and output(name), joined by ' and '
+func (e *workflowEngine) isConditionMet(condition string) bool {
+	if condition == "" {
+		return true
+	}
+	for _, cond := range strings.Split(condition, " and ") {
+		cond = strings.TrimSpace(cond)
+		negate := strings.HasPrefix(cond, "not ")
+		cond = strings.TrimSpace(strings.TrimPrefix(cond, "not "))
+		start := strings.Index(cond, "(")
+		end := strings.LastIndex(cond, ")")
+		if start < 1 || end < start+2 {
+			log.Printf("Invalid activation condition %s", cond)
+			return false
+		}
+		method := cond[0:start]
+		param := cond[start+1 : end]
+		met := false
+		switch method {
+		case "task":
+			met = e.taskStatus(param) == tukcnst.COMPLETE
+		case "input":
+			for _, task := range e.Document.TaskList.XDWTask {
+				for _, input := range task.TaskData.Input {
+					if input.Part.Name == param && input.Part.AttachmentInfo.AttachedTime != "" {
+						met = true
+					}
+				}
+			}
+		case "output":
+			for _, task := range e.Document.TaskList.XDWTask {
+				for _, output := range task.TaskData.Output {
+					if output.Part.Name == param && output.Part.AttachmentInfo.AttachedTime != "" {
+						met = true
+					}
+				}
+			}
+		default:
+			log.Printf("%s is an invalid activation condition method", method)
+		}
+		if met == negate {
+			return false
+		}
+	}
+	return true
+}
+
+// Graph returns the task dependency graph of the workflow document
+func (e *workflowEngine) Graph() WorkflowGraph {
+	graph := WorkflowGraph{}
+	for k, task := range e.Document.TaskList.XDWTask {
+		tf := e.taskFlow(task.TaskData.TaskDetails.ID)
+		node := WorkflowGraphNode{
+			ID:      task.TaskData.TaskDetails.ID,
+			Name:    task.TaskData.TaskDetails.Name,
+			Status:  task.TaskData.TaskDetails.Status,
+			Gateway: tf.Gateway,
+			Join:    tf.Join,
+			Active:  e.isTaskActive(k),
+		}
+		graph.Nodes = append(graph.Nodes, node)
+		for _, dep := range tf.DependsOn {
+			graph.Edges = append(graph.Edges, WorkflowGraphEdge{From: dep, To: tf.ID, Condition: tf.Condition})
+		}
+	}
+	return graph
+}
+
+// persist writes the workflow document if the stored document sequence number is unchanged since the document was loaded
+// and registers a workflow completed event if the workflow was closed. ErrWorkflowConflict is returned if the stored document has changed
+func (e *workflowEngine) persist() error {
+	xdwDocBytes, err := e.marshalDocument()
+	if err != nil {
+		return err
+	}
+	updated, err := setWorkflowDocument(e.Workflow.Id, string(xdwDocBytes), e.Document.WorkflowStatus, e.Sequence)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		log.Printf("%s Workflow for NHS ID %s Document Sequence Number is no longer %s", e.Workflow.Pathway, e.Workflow.NHSId, e.Sequence)
+		return ErrWorkflowConflict
+	}
+	e.persisted(xdwDocBytes)
+	return nil
+}
+
+// persisted sets the persisted workflow document and notifies subscribers, queues the cancellation of patient subscriptions, registers a
+// workflow completed event and creates or closes subworkflows as required by the change in workflow status
+func (e *workflowEngine) persisted(xdwDocBytes []byte) {
+	log.Printf("Updated Workflow State for Pathway %s NHS ID %s Version %v Status %s Sequence Number %s", e.Workflow.Pathway, e.Workflow.NHSId, e.Workflow.Version, e.Document.WorkflowStatus, e.Document.WorkflowDocumentSequenceNumber)
+	prevstatus := e.Workflow.Status
+	e.Sequence = e.Document.WorkflowDocumentSequenceNumber
+	e.Workflow.XDW_Doc = string(xdwDocBytes)
+	e.Workflow.Status = e.Document.WorkflowStatus
+	notifyWorkflowChanged(e.Workflow, prevstatus)
+	if isWorkflowEnded(e.Workflow.Status) && !isWorkflowEnded(prevstatus) {
+		queuePatientSubscriptionOp(e.Workflow, PATIENT_SUBSCRIPTION_OP_CANCEL)
+	}
+	if e.Closed != "" && prevstatus != tukcnst.CLOSED {
+		newEvent(e.workflowEvent(tukcnst.XDW_TASKEVENTTYPE_WORKFLOW_COMPLETED, ""))
+		closeSubworkflow(e.Workflow)
+	} else {
+		e.spawnSubworkflows()
+	}
+}
+
+// marshalDocument returns the workflow document json with a sequence number greater than the sequence number of the loaded document
+func (e *workflowEngine) marshalDocument() ([]byte, error) {
+	loaded, _ := strconv.Atoi(e.Sequence)
+	if seq, _ := strconv.Atoi(e.Document.WorkflowDocumentSequenceNumber); seq <= loaded {
+		e.Document.WorkflowDocumentSequenceNumber = strconv.Itoa(loaded + 1)
+	}
+	xdwDocBytes, err := json.MarshalIndent(e.Document, "", "  ")
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return xdwDocBytes, err
+}
+
+// workflowEvent returns an Event Service event recording a change to the workflow document
+func (e *workflowEngine) workflowEvent(eventtype string, comments string) tukdbint.Event {
+	return tukdbint.Event{
+		Creationtime:   tukutil.Time_Now(),
+		EventType:      eventtype,
+		Expression:     eventtype,
+		Authors:        e.Document.Author.AssignedAuthor.AssignedPerson.Name.Prefix + " " + e.Document.Author.AssignedAuthor.AssignedPerson.Name.Family,
+		XdsDocEntryUid: e.Document.ID.Extension,
+		NhsId:          e.Workflow.NHSId,
+		User:           Services.EventService.User,
+		Org:            Services.EventService.Org,
+		Role:           Services.EventService.Role,
+		Topic:          tukcnst.DSUB_TOPIC_TYPE_CODE,
+		Pathway:        e.Workflow.Pathway,
+		Comments:       comments,
+		Version:        e.Workflow.Version,
+		TaskId:         0,
+	}
+}
+func newEvent(ev tukdbint.Event) int64 {
+	evs := tukdbint.Events{Action: tukcnst.INSERT}
+	evs.Events = append(evs.Events, ev)
+	if err := tukdbint.NewDBEvent(&evs); err != nil {
+		log.Println(err.Error())
+		return 0
+	}
+	log.Printf("Created %s Event ID %v", ev.EventType, evs.LastInsertId)
+	return evs.LastInsertId
+}
+
+// newWorkflowCreated retains the definition of a new workflow, queues the subscription of the patient and creates the child workflows of its
+// active subworkflow tasks
+func newWorkflowCreated(workflowid int64, pathway string) {
+	if err := freezeWorkflowDefinition(workflowid, pathway); err != nil {
+		log.Println(err.Error())
+		return
+	}
+	wf, err := getWorkflow(workflowid)
+	if err != nil {
+		return
+	}
+	notifyWorkflowCreated(wf)
+	queuePatientSubscriptionOp(wf, PATIENT_SUBSCRIPTION_OP_SUBSCRIBE)
+	if e, err := newWorkflowEngine(wf); err == nil {
+		e.spawnSubworkflows()
+	}
+}
+
+// freezeWorkflowDefinition persists the registered definition json with a new workflow so the task flow is retained with the workflow
+func freezeWorkflowDefinition(workflowid int64, pathway string) error {
+	xdw, err := getWorkflowDefinition(pathway)
+	if err != nil {
+		return err
+	}
+	if xdw.XDW == "" {
+		return errors.New("no workflow definition registered for pathway " + pathway)
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCtx()
+	_, err = tukdbint.DBConn.ExecContext(ctx, "UPDATE workflows SET xdw_def = ? WHERE id = ?", xdw.XDW, workflowid)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return err
+}
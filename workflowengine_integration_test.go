@@ -0,0 +1,228 @@
+//go:build integration
+
+package tukint
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukutil"
+	"github.com/ipthomas/tukxdw"
+)
+
+const testPathway = "testpathway"
+
+// testDefinition has a referral task completed by a REFERRAL output and a review task completed by a REVIEW output, filtered on
+// the document class code. The workflow completes when the review task completes
+const testDefinition = `{
+  "ref": "testpathway",
+  "name": "Test Pathway",
+  "confidentialitycode": "N",
+  "completebytime": "day(30)",
+  "expirationtime": "day(60)",
+  "completionBehavior": [{"completion": {"condition": "task(2)"}}],
+  "tasks": [
+    {
+      "id": "1",
+      "tasktype": "REFERRAL",
+      "name": "Referral",
+      "actualowner": "GP",
+      "completionBehavior": [{"completion": {"condition": "output(REFERRAL)"}}],
+      "output": [{"name": "REFERRAL", "contenttype": "text/plain", "accesstype": "URL"}]
+    },
+    {
+      "id": "2",
+      "tasktype": "REVIEW",
+      "name": "Review",
+      "actualowner": "Clinician",
+      "completionBehavior": [{"completion": {"condition": "output(REVIEW)"}}],
+      "output": [{"name": "REVIEW", "contenttype": "text/xml", "accesstype": "XDSregistered", "filter": {"classcode": [{"code": "REV", "codesystem": "2.16.840.1.113883.6.1", "display": "Review"}]}}]
+    }
+  ]
+}`
+
+// newTestWorkflow registers the test definition and creates an open test workflow for the nhs id
+func newTestWorkflow(t *testing.T, nhsid string) tukdbint.Workflow {
+	t.Helper()
+	if xdw, _ := getWorkflowDefinition(testPathway); xdw.Id == 0 {
+		if _, err := tukdbint.DBConn.Exec("INSERT INTO xdws (name, isxdsmeta, xdw) VALUES (?, ?, ?)", testPathway, false, testDefinition); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wf := tukdbint.Workflow{
+		Pathway: testPathway,
+		NHSId:   nhsid,
+		Created: tukutil.Time_Now(),
+		XDW_Key: testPathway + nhsid,
+		XDW_UID: tukutil.Newid(),
+		XDW_Def: testDefinition,
+		Status:  tukcnst.OPEN,
+	}
+	e, err := newDefinitionEngine(wf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.resetDocument(nil)
+	doc, err := json.Marshal(e.Document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wf.XDW_Doc = string(doc)
+	rslt, err := tukdbint.DBConn.Exec("INSERT INTO workflows (pathway, nhsid, created, xdw_key, xdw_uid, xdw_doc, xdw_def, version, published, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		wf.Pathway, wf.NHSId, wf.Created, wf.XDW_Key, wf.XDW_UID, wf.XDW_Doc, wf.XDW_Def, wf.Version, wf.Published, wf.Status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wf.Id, _ = rslt.LastInsertId()
+	return wf
+}
+
+// newTestEvent registers an event for the workflow with the expression and returns the event with its id
+func newTestEvent(t *testing.T, wf tukdbint.Workflow, expression string) tukdbint.Event {
+	t.Helper()
+	ev := tukdbint.Event{
+		Creationtime: tukutil.Time_Now(),
+		EventType:    expression,
+		Expression:   expression,
+		Pathway:      wf.Pathway,
+		NhsId:        wf.NHSId,
+		Version:      wf.Version,
+		User:         "test",
+		Org:          "testorg",
+		Role:         "testrole",
+	}
+	if ev.Id = newEvent(ev); ev.Id == 0 {
+		t.Fatal("event was not registered")
+	}
+	return ev
+}
+func testDocument(t *testing.T, id int64) tukxdw.WorkflowDocument {
+	t.Helper()
+	wf, err := getWorkflow(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := tukxdw.WorkflowDocument{}
+	if err := json.Unmarshal([]byte(wf.XDW_Doc), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// setTestSequence sets the sequence number of the stored workflow document, as a concurrent update of the workflow does
+func setTestSequence(t *testing.T, id int64, seq int) {
+	t.Helper()
+	doc := testDocument(t, id)
+	doc.WorkflowDocumentSequenceNumber = strconv.Itoa(seq)
+	b, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tukdbint.DBConn.Exec("UPDATE workflows SET xdw_doc = ? WHERE id = ?", string(b), id); err != nil {
+		t.Fatal(err)
+	}
+}
+func testTaskEvents(doc tukxdw.WorkflowDocument, taskid string) map[string]bool {
+	evs := make(map[string]bool)
+	for _, task := range doc.TaskList.XDWTask {
+		if task.TaskData.TaskDetails.ID == taskid {
+			for _, tev := range task.TaskEventHistory.TaskEvent {
+				if tev.ID != "" {
+					evs[tev.ID] = true
+				}
+			}
+		}
+	}
+	return evs
+}
+func testTaskStatus(doc tukxdw.WorkflowDocument, taskid string) string {
+	for _, task := range doc.TaskList.XDWTask {
+		if task.TaskData.TaskDetails.ID == taskid {
+			return task.TaskData.TaskDetails.Status
+		}
+	}
+	return ""
+}
+
+func TestConcurrentWorkflowUpdates(t *testing.T) {
+	newTestDB(t)
+	wf := newTestWorkflow(t, "9999999468")
+	var evs []tukdbint.Event
+	for k := 0; k < 10; k++ {
+		evs = append(evs, newTestEvent(t, wf, "REFERRAL"))
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(evs))
+	for _, ev := range evs {
+		wg.Add(1)
+		go func(ev tukdbint.Event) {
+			defer wg.Done()
+			errs <- updateWorkflow(wf, []tukdbint.Event{ev})
+		}(ev)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	doc := testDocument(t, wf.Id)
+	registered := testTaskEvents(doc, "1")
+	for _, ev := range evs {
+		if !registered[tukutil.GetStringFromInt(int(ev.Id))] {
+			t.Errorf("event %v is not in the task 1 event history", ev.Id)
+		}
+	}
+	if status := testTaskStatus(doc, "1"); status != tukcnst.COMPLETE {
+		t.Errorf("task 1 status is %s, expected %s", status, tukcnst.COMPLETE)
+	}
+	workflowLocksMu.Lock()
+	defer workflowLocksMu.Unlock()
+	if len(workflowLocks) != 0 {
+		t.Errorf("%v workflow locks were not removed", len(workflowLocks))
+	}
+}
+
+func TestWorkflowUpdateRetry(t *testing.T) {
+	newTestDB(t)
+	wf := newTestWorkflow(t, "9999999468")
+	attempts := 0
+	err := updateWorkflowDocument(wf, func(e *workflowEngine) (bool, error) {
+		attempts++
+		if attempts == 1 {
+			setTestSequence(t, wf.Id, 100)
+		}
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("update was attempted %v times, expected 2", attempts)
+	}
+	if seq := testDocument(t, wf.Id).WorkflowDocumentSequenceNumber; seq != "101" {
+		t.Errorf("workflow document sequence number is %s, expected 101", seq)
+	}
+}
+
+func TestWorkflowUpdateRetriesExhausted(t *testing.T) {
+	newTestDB(t)
+	wf := newTestWorkflow(t, "9999999468")
+	attempts := 0
+	err := updateWorkflowDocument(wf, func(e *workflowEngine) (bool, error) {
+		attempts++
+		setTestSequence(t, wf.Id, 100*attempts)
+		return true, nil
+	})
+	if err != ErrWorkflowConflict {
+		t.Errorf("update returned %v, expected %v", err, ErrWorkflowConflict)
+	}
+	if attempts != WORKFLOW_UPDATE_RETRIES {
+		t.Errorf("update was attempted %v times, expected %v", attempts, WORKFLOW_UPDATE_RETRIES)
+	}
+}
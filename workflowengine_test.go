@@ -0,0 +1,33 @@
+package tukint
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockWorkflow(t *testing.T) {
+	unlock := lockWorkflow(1)
+	locked := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		unlock := lockWorkflow(1)
+		locked <- true
+		unlock()
+		close(done)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("workflow was locked twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+	<-done
+	unlock = lockWorkflow(2)
+	unlock()
+	workflowLocksMu.Lock()
+	defer workflowLocksMu.Unlock()
+	if len(workflowLocks) != 0 {
+		t.Errorf("%v workflow locks were not removed", len(workflowLocks))
+	}
+}
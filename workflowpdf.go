@@ -0,0 +1,250 @@
+package tukint
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukutil"
+	"github.com/ipthomas/tukxdw"
+)
+
+const (
+	TUK_TASK_PDF                          = "pdf"
+	TUK_TEMPLATE_XDS_PROVIDE_AND_REGISTER = "xdsprovideandregister"
+	PDF_OP_SUBMIT                         = "submit"
+	APPLICATION_PDF                       = "application/pdf"
+	SOAP_ACTION_PROVIDE_AND_REGISTER      = "urn:ihe:iti:2007:ProvideAndRegisterDocumentSet-b"
+	XDS_RESPONSE_STATUS_FAILURE           = "ResponseStatusType:Failure"
+	XDS_TIME_FORMAT                       = "20060102150405"
+)
+
+// xdsProvideAndRegisterTemplate is the default XDS.b provide and register document set request template used to submit workflow pdfs.
+// It is registered if there is no xdsprovideandregister xml template in the templates table, which replaces it. The document metadata
+// codes are the codes of the pathway XDS meta config
+const xdsProvideAndRegisterTemplate = `<soap:Envelope xmlns:soap="http://www.w3.org/2003/05/soap-envelope" xmlns:wsa="http://www.w3.org/2005/08/addressing">
+<soap:Header>
+<wsa:Action soap:mustUnderstand="1">urn:ihe:iti:2007:ProvideAndRegisterDocumentSet-b</wsa:Action>
+<wsa:MessageID>urn:uuid:{{newuuid}}</wsa:MessageID>
+<wsa:To soap:mustUnderstand="1">{{.EventServices.XDSRepService.WSE}}</wsa:To>
+</soap:Header>
+<soap:Body>
+<xdsb:ProvideAndRegisterDocumentSetRequest xmlns:xdsb="urn:ihe:iti:xds-b:2007" xmlns:lcm="urn:oasis:names:tc:ebxml-regrep:xsd:lcm:3.0" xmlns:rim="urn:oasis:names:tc:ebxml-regrep:xsd:rim:3.0">
+<lcm:SubmitObjectsRequest>
+<rim:RegistryObjectList>
+<rim:ExtrinsicObject id="Document01" mimeType="{{.XDSDocumentMeta.Mimetype}}" objectType="urn:uuid:7edca82f-054d-47f2-a032-9b2a5b5186c1">
+<rim:Slot name="creationTime"><rim:ValueList><rim:Value>{{newxdstime}}</rim:Value></rim:ValueList></rim:Slot>
+<rim:Slot name="languageCode"><rim:ValueList><rim:Value>{{.XDSDocumentMeta.Languagecode}}</rim:Value></rim:ValueList></rim:Slot>
+<rim:Slot name="sourcePatientId"><rim:ValueList><rim:Value>{{.XDSDocumentMeta.NhsId}}^^^&amp;2.16.840.1.113883.2.1.4.1&amp;ISO</rim:Value></rim:ValueList></rim:Slot>
+<rim:Name><rim:LocalizedString value="{{.XDSDocumentMeta.Docname}}"/></rim:Name>
+<rim:Description><rim:LocalizedString value="{{.XDSDocumentMeta.Docdesc}}"/></rim:Description>
+<rim:Classification id="Author01" classificationScheme="urn:uuid:93606bcf-9494-43ec-9b4e-a7748d1a838d" classifiedObject="Document01" nodeRepresentation="">
+<rim:Slot name="authorInstitution"><rim:ValueList><rim:Value>{{.XDSDocumentMeta.Authorinstitution}}</rim:Value></rim:ValueList></rim:Slot>
+<rim:Slot name="authorPerson"><rim:ValueList><rim:Value>{{.XDSDocumentMeta.Authorperson}}</rim:Value></rim:ValueList></rim:Slot>
+</rim:Classification>
+<rim:Classification id="ClassCode01" classificationScheme="urn:uuid:41a5887f-8865-4c09-adf7-e362475b143a" classifiedObject="Document01" nodeRepresentation="{{.XDSDocumentMeta.Classcode}}">
+<rim:Slot name="codingScheme"><rim:ValueList><rim:Value>{{.XDSDocumentMeta.Classcodescheme}}</rim:Value></rim:ValueList></rim:Slot>
+<rim:Name><rim:LocalizedString value="{{.XDSDocumentMeta.Classcodevalue}}"/></rim:Name>
+</rim:Classification>
+<rim:Classification id="ConfCode01" classificationScheme="urn:uuid:f4f85eac-e6cb-4883-b524-f2705394840f" classifiedObject="Document01" nodeRepresentation="{{.XDSDocumentMeta.Confcode}}">
+<rim:Slot name="codingScheme"><rim:ValueList><rim:Value>{{.XDSDocumentMeta.Confcodescheme}}</rim:Value></rim:ValueList></rim:Slot>
+<rim:Name><rim:LocalizedString value="{{.XDSDocumentMeta.Confcodevalue}}"/></rim:Name>
+</rim:Classification>
+<rim:Classification id="FormatCode01" classificationScheme="urn:uuid:a09d5840-386c-46f2-b5ad-9c3699a4309d" classifiedObject="Document01" nodeRepresentation="{{.XDSDocumentMeta.Formatcode}}">
+<rim:Slot name="codingScheme"><rim:ValueList><rim:Value>{{.XDSDocumentMeta.Formatcodescheme}}</rim:Value></rim:ValueList></rim:Slot>
+<rim:Name><rim:LocalizedString value="{{.XDSDocumentMeta.Formatcodevalue}}"/></rim:Name>
+</rim:Classification>
+<rim:Classification id="FacilityCode01" classificationScheme="urn:uuid:f33fb8ac-18af-42cc-ae0e-ed0b0bdb91e1" classifiedObject="Document01" nodeRepresentation="{{.XDSDocumentMeta.Facilitycode}}">
+<rim:Slot name="codingScheme"><rim:ValueList><rim:Value>{{.XDSDocumentMeta.Facilitycodescheme}}</rim:Value></rim:ValueList></rim:Slot>
+<rim:Name><rim:LocalizedString value="{{.XDSDocumentMeta.Facilitycodevalue}}"/></rim:Name>
+</rim:Classification>
+<rim:Classification id="PracticeCode01" classificationScheme="urn:uuid:cccf5598-8b07-4b77-a05e-ae952c785ead" classifiedObject="Document01" nodeRepresentation="{{.XDSDocumentMeta.Practicesettingcode}}">
+<rim:Slot name="codingScheme"><rim:ValueList><rim:Value>{{.XDSDocumentMeta.Practicesettingscheme}}</rim:Value></rim:ValueList></rim:Slot>
+<rim:Name><rim:LocalizedString value="{{.XDSDocumentMeta.Practicesettingvalue}}"/></rim:Name>
+</rim:Classification>
+<rim:Classification id="TypeCode01" classificationScheme="urn:uuid:f0306f51-975f-434e-a61c-c59651d33983" classifiedObject="Document01" nodeRepresentation="{{.XDSDocumentMeta.Typecode}}">
+<rim:Slot name="codingScheme"><rim:ValueList><rim:Value>{{.XDSDocumentMeta.Typecodescheme}}</rim:Value></rim:ValueList></rim:Slot>
+<rim:Name><rim:LocalizedString value="{{.XDSDocumentMeta.Typecodevalue}}"/></rim:Name>
+</rim:Classification>
+<rim:ExternalIdentifier id="PatientId01" identificationScheme="urn:uuid:58a6f841-87b3-4a3e-92fd-a8ffeff98427" registryObject="Document01" value="{{.XDSDocumentMeta.NhsId}}^^^&amp;2.16.840.1.113883.2.1.4.1&amp;ISO">
+<rim:Name><rim:LocalizedString value="XDSDocumentEntry.patientId"/></rim:Name>
+</rim:ExternalIdentifier>
+<rim:ExternalIdentifier id="UniqueId01" identificationScheme="urn:uuid:2e82c1f6-a085-4c72-9da3-8640a32e42ab" registryObject="Document01" value="{{.XDSDocumentMeta.DocID}}">
+<rim:Name><rim:LocalizedString value="XDSDocumentEntry.uniqueId"/></rim:Name>
+</rim:ExternalIdentifier>
+</rim:ExtrinsicObject>
+<rim:RegistryPackage id="SubmissionSet01">
+<rim:Slot name="submissionTime"><rim:ValueList><rim:Value>{{newxdstime}}</rim:Value></rim:ValueList></rim:Slot>
+<rim:Name><rim:LocalizedString value="{{.XDSDocumentMeta.Docdesc}}"/></rim:Name>
+<rim:Classification id="SubmissionSetAuthor01" classificationScheme="urn:uuid:a7058bb9-b4e4-4307-ba5b-e3f0ab85e12d" classifiedObject="SubmissionSet01" nodeRepresentation="">
+<rim:Slot name="authorInstitution"><rim:ValueList><rim:Value>{{.XDSDocumentMeta.Authorinstitution}}</rim:Value></rim:ValueList></rim:Slot>
+</rim:Classification>
+<rim:Classification id="ContentType01" classificationScheme="urn:uuid:aa543740-bdda-424e-8c96-df4873be8500" classifiedObject="SubmissionSet01" nodeRepresentation="{{.XDSDocumentMeta.Classcode}}">
+<rim:Slot name="codingScheme"><rim:ValueList><rim:Value>{{.XDSDocumentMeta.Classcodescheme}}</rim:Value></rim:ValueList></rim:Slot>
+<rim:Name><rim:LocalizedString value="{{.XDSDocumentMeta.Classcodevalue}}"/></rim:Name>
+</rim:Classification>
+<rim:ExternalIdentifier id="SubmissionSetUniqueId01" identificationScheme="urn:uuid:96fdda7c-d067-4183-912e-bf5ee74998a8" registryObject="SubmissionSet01" value="{{.XDSDocumentMeta.ID}}">
+<rim:Name><rim:LocalizedString value="XDSSubmissionSet.uniqueId"/></rim:Name>
+</rim:ExternalIdentifier>
+<rim:ExternalIdentifier id="SubmissionSetSourceId01" identificationScheme="urn:uuid:554ac39e-e3fe-47fe-b233-965d2a147832" registryObject="SubmissionSet01" value="{{.REGOid}}">
+<rim:Name><rim:LocalizedString value="XDSSubmissionSet.sourceId"/></rim:Name>
+</rim:ExternalIdentifier>
+<rim:ExternalIdentifier id="SubmissionSetPatientId01" identificationScheme="urn:uuid:6b5aea1a-874d-4603-a4bc-96a0a7b38446" registryObject="SubmissionSet01" value="{{.XDSDocumentMeta.NhsId}}^^^&amp;2.16.840.1.113883.2.1.4.1&amp;ISO">
+<rim:Name><rim:LocalizedString value="XDSSubmissionSet.patientId"/></rim:Name>
+</rim:ExternalIdentifier>
+</rim:RegistryPackage>
+<rim:Classification id="SubmissionSetClassification01" classifiedObject="SubmissionSet01" classificationNode="urn:uuid:a54d6aa5-d40d-43f9-88c5-b4633d873bdd"/>
+<rim:Association id="Association01" associationType="urn:oasis:names:tc:ebxml-regrep:AssociationType:HasMember" sourceObject="SubmissionSet01" targetObject="Document01">
+<rim:Slot name="SubmissionSetStatus"><rim:ValueList><rim:Value>Original</rim:Value></rim:ValueList></rim:Slot>
+</rim:Association>
+</rim:RegistryObjectList>
+</lcm:SubmitObjectsRequest>
+<xdsb:Document id="Document01">{{.Base64EncodedFile}}</xdsb:Document>
+</xdsb:ProvideAndRegisterDocumentSetRequest>
+</soap:Body>
+</soap:Envelope>`
+
+// newXDSTime returns the current UTC time in the XDS metadata time format
+func newXDSTime() string {
+	return time.Now().UTC().Format(XDS_TIME_FORMAT)
+}
+
+// WorkflowPDF returns the workflow document of the pathway, nhs id and version as a pdf timeline of the workflow tasks, attachments, task notes
+// and status history. If op is submit the pdf is also submitted to the XDS repository as a new document entry
+func (i *TukEvent) WorkflowPDF() []byte {
+	wf, err := getCurrentWorkflow(i.Pathway, i.NHSId, i.Vers)
+	if err != nil {
+		log.Println(err.Error())
+		i.ReturnCode = http.StatusBadRequest
+		return []byte(err.Error())
+	}
+	if err = json.Unmarshal([]byte(wf.XDW_Doc), &i.XDWWorkflowDocument); err != nil {
+		log.Println(err.Error())
+		i.ReturnCode = http.StatusInternalServerError
+		return []byte(err.Error())
+	}
+	pdf := newWorkflowPDF(wf, i.XDWWorkflowDocument)
+	filename := wf.Pathway + "_" + wf.NHSId + "_" + strconv.Itoa(wf.Version) + ".pdf"
+	if i.Op == PDF_OP_SUBMIT {
+		if err = i.submitPDF(wf, filename, pdf); err != nil {
+			log.Println(err.Error())
+			i.ReturnCode = http.StatusBadGateway
+			return []byte(err.Error())
+		}
+		log.Printf("Submitted %s to XDS Repository %s", filename, i.EventServices.XDSRepService.WSE)
+	}
+	i.ReturnPDF = true
+	if i.HttpResponse != nil {
+		i.HttpResponse.Header().Set(tukcnst.CONTENT_TYPE, APPLICATION_PDF)
+		i.HttpResponse.Header().Set(CONTENT_DISPOSITION, "inline; filename=\""+filename+"\"")
+	}
+	return pdf
+}
+
+// newWorkflowPDF renders the workflow document
+func newWorkflowPDF(wf tukdbint.Workflow, doc tukxdw.WorkflowDocument) []byte {
+	pdf := newPDFDocument()
+	pdf.text(PDF_FONT_BOLD, 16, 0, "Workflow "+wf.Pathway)
+	pdf.line()
+	pdf.space(4)
+	author := doc.Author.AssignedAuthor
+	for _, field := range [][2]string{
+		{"NHS ID", wf.NHSId},
+		{"Version", strconv.Itoa(wf.Version)},
+		{"Status", doc.WorkflowStatus},
+		{"Created", wf.Created},
+		{"Created By", author.AssignedPerson.Name.Prefix + " " + author.AssignedPerson.Name.Family},
+		{"Organisation", author.ID.Extension},
+		{"Sequence Number", doc.WorkflowDocumentSequenceNumber},
+		{"Printed", tukutil.Pretty_Time_Now()},
+	} {
+		pdf.text(PDF_FONT_REGULAR, 10, 0, field[0]+": "+field[1])
+	}
+	pdf.heading("Tasks")
+	for _, task := range doc.TaskList.XDWTask {
+		details := task.TaskData.TaskDetails
+		pdf.space(4)
+		pdf.text(PDF_FONT_BOLD, 11, 0, "Task "+details.ID+" - "+details.Name)
+		pdf.text(PDF_FONT_REGULAR, 9, 10, "Status: "+details.Status+"   Owner: "+details.ActualOwner)
+		pdf.text(PDF_FONT_REGULAR, 9, 10, "Activated: "+details.ActivationTime+"   Last Modified: "+details.LastModifiedTime)
+		for _, in := range task.TaskData.Input {
+			if in.Part.AttachmentInfo.Identifier != "" {
+				pdf.text(PDF_FONT_REGULAR, 9, 10, "Input "+in.Part.Name+": "+in.Part.AttachmentInfo.Identifier+" attached "+in.Part.AttachmentInfo.AttachedTime+" by "+in.Part.AttachmentInfo.AttachedBy)
+			}
+		}
+		for _, out := range task.TaskData.Output {
+			if out.Part.AttachmentInfo.Identifier != "" {
+				pdf.text(PDF_FONT_REGULAR, 9, 10, "Output "+out.Part.Name+": "+out.Part.AttachmentInfo.Identifier+" attached "+out.Part.AttachmentInfo.AttachedTime+" by "+out.Part.AttachmentInfo.AttachedBy)
+			}
+		}
+		if notes := tukxdw.GetTaskNotes(wf.Pathway, wf.NHSId, tukutil.GetIntFromString(details.ID), wf.Version); notes != "" {
+			pdf.text(PDF_FONT_BOLD, 9, 10, "Notes")
+			pdf.text(PDF_FONT_REGULAR, 9, 20, notes)
+		}
+	}
+	pdf.heading("Status History")
+	for _, ev := range doc.WorkflowStatusHistory.DocumentEvent {
+		pdf.text(PDF_FONT_REGULAR, 9, 0, ev.EventTime+"  "+ev.EventType+"  Task "+ev.TaskEventIdentifier+"  "+ev.PreviousStatus+" -> "+ev.ActualStatus+"  "+ev.Author)
+	}
+	return pdf.bytes()
+}
+
+// submitPDF sends an XDS provide and register document set request for the pdf to the XDS repository. The document metadata is the
+// pathway XDS meta config with the pdf specific values set
+func (i *TukEvent) submitPDF(wf tukdbint.Workflow, filename string, pdf []byte) error {
+	if i.EventServices.XDSRepService.WSE == "" {
+		return errors.New("no xds repository service is configured")
+	}
+	xdsmeta, err := tukdbint.GetWorkflowXDSMeta(wf.Pathway)
+	if err != nil {
+		return err
+	}
+	if xdsmeta.XDW != "" {
+		if err = json.Unmarshal([]byte(xdsmeta.XDW), &i.XDSDocumentMeta); err != nil {
+			return err
+		}
+	}
+	i.XDSDocumentMeta.ID = tukutil.NewUuid()
+	i.XDSDocumentMeta.DocID = tukutil.NewUuid()
+	i.XDSDocumentMeta.DateUtc = tukutil.DT_Zulu()
+	i.XDSDocumentMeta.NhsId = wf.NHSId
+	i.XDSDocumentMeta.Docname = filename
+	i.XDSDocumentMeta.Docdesc = "Workflow " + wf.Pathway + " version " + strconv.Itoa(wf.Version)
+	i.XDSDocumentMeta.Mimetype = APPLICATION_PDF
+	i.Base64EncodedFile = base64.StdEncoding.EncodeToString(pdf)
+	var b bytes.Buffer
+	if err = i.EventServices.XMLTemplates.ExecuteTemplate(&b, TUK_TEMPLATE_XDS_PROVIDE_AND_REGISTER, i); err != nil {
+		return err
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelCtx()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.EventServices.XDSRepService.WSE, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(tukcnst.CONTENT_TYPE, tukcnst.SOAP_XML+"; action=\""+SOAP_ACTION_PROVIDE_AND_REGISTER+"\"")
+	req.Header.Set(tukcnst.SOAP_ACTION, SOAP_ACTION_PROVIDE_AND_REGISTER)
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode != http.StatusOK || tukutil.ContainsError(string(body)) || strings.Contains(string(body), XDS_RESPONSE_STATUS_FAILURE) {
+		return errors.New("xds repository rejected the document. " + tukutil.GetErrorMessage(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package tukint
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukxdw"
+)
+
+const (
+	TUK_EVENT_QUERY_PARAM_NHS_PREFIX = "nhsprefix"
+	TUK_EVENT_QUERY_PARAM_OVERDUE    = "overdue"
+	TUK_EVENT_QUERY_PARAM_ESCALATED  = "escalated"
+	TUK_EVENT_QUERY_PARAM_SORT       = "sort"
+	TUK_EVENT_QUERY_PARAM_ORDER      = "order"
+	TUK_EVENT_QUERY_PARAM_LIMIT      = "limit"
+	TUK_EVENT_QUERY_PARAM_OFFSET     = "offset"
+	SORT_ORDER_ASC                   = "asc"
+	SORT_ORDER_DESC                  = "desc"
+	DEFAULT_WORKFLOWS_SORT           = "created"
+	MAX_QUERY_LIMIT                  = 1000
+)
+
+var workflowSortColumns = map[string]string{
+	"id":         "w.id",
+	"pathway":    "w.pathway",
+	"nhsid":      "w.nhsid",
+	"created":    "w.created",
+	"version":    "w.version",
+	"status":     "w.status",
+	"completeby": "s.completeby",
+	"lastupdate": "s.lastupdate",
+}
+
+// WorkflowFilter selects workflows. Empty or zero value filters are ignored. Status accepts the dashboard statuses met, missed and escalated.
+// Overdue, escalated and target met are taken from the persisted workflowstate. Workflows with no persisted state, and open workflows if the
+// workflow state scheduler is not running, are evaluated before the persisted state is queried. Unevaluated selects those workflows.
+// Limit, if greater than 0, is the maximum number of workflows selected by selectWorkflows
+type WorkflowFilter struct {
+	Pathway     string
+	NHSId       string
+	NHSIdPrefix string
+	Version     int
+	Status      string
+	CreatedFrom string
+	CreatedTo   string
+	AuthorOrg   string
+	Overdue     bool
+	Escalated   bool
+	Unevaluated bool
+	Limit       int
+}
+
+func (i *TukEvent) workflowFilter() WorkflowFilter {
+	return WorkflowFilter{
+		Pathway:     i.Pathway,
+		NHSId:       i.NHSId,
+		NHSIdPrefix: i.NHSIdPrefix,
+		Version:     i.Vers,
+		Status:      i.Status,
+		CreatedFrom: i.DateFrom,
+		CreatedTo:   i.DateTo,
+		AuthorOrg:   i.AuthorOrg,
+		Overdue:     i.Overdue,
+		Escalated:   i.Escalated,
+	}
+}
+
+// where returns the sql where clause and params of the filter
+func (f WorkflowFilter) where() (string, []interface{}) {
+	var conds []string
+	var params []interface{}
+	add := func(cond string, param interface{}) {
+		conds = append(conds, cond)
+		if param != nil {
+			params = append(params, param)
+		}
+	}
+	if f.Pathway != "" {
+		add("w.pathway = ?", f.Pathway)
+	}
+	if f.NHSId != "" {
+		add("w.nhsid = ?", f.NHSId)
+	}
+	if f.NHSIdPrefix != "" {
+		add("w.nhsid LIKE ?", strings.NewReplacer("%", "\\%", "_", "\\_").Replace(f.NHSIdPrefix)+"%")
+	}
+	if f.Version > -1 {
+		add("w.version = ?", f.Version)
+	}
+	switch strings.ToLower(f.Status) {
+	case "":
+	case tukcnst.TUK_STATUS_MET:
+		add("w.status = ?", tukcnst.CLOSED)
+		add("COALESCE(s.overdue, 'FALSE') != 'TRUE'", nil)
+	case tukcnst.TUK_STATUS_MISSED:
+		add("s.overdue = 'TRUE'", nil)
+	case tukcnst.TUK_STATUS_ESCALATED:
+		add("w.status = ?", tukcnst.OPEN)
+		add("s.escalated = 'TRUE'", nil)
+	default:
+		add("w.status = ?", strings.ToUpper(f.Status))
+	}
+	if f.CreatedFrom != "" {
+		add("DATE(w.created) >= ?", f.CreatedFrom)
+	}
+	if f.CreatedTo != "" {
+		add("DATE(w.created) <= ?", f.CreatedTo)
+	}
+	if f.AuthorOrg != "" {
+		add("JSON_UNQUOTE(JSON_EXTRACT(w.xdw_doc, '$.Author.AssignedAuthor.ID.Extension')) = ?", f.AuthorOrg)
+	}
+	if f.Overdue {
+		add("s.overdue = 'TRUE'", nil)
+	}
+	if f.Escalated {
+		add("s.escalated = 'TRUE'", nil)
+	}
+	if f.Unevaluated {
+		if isWorkflowStateSchedulerRunning() {
+			add("s.id IS NULL", nil)
+		} else {
+			add("(s.id IS NULL OR w.status = ?)", tukcnst.OPEN)
+		}
+	}
+	if len(conds) == 0 {
+		return "", params
+	}
+	return " WHERE " + strings.Join(conds, " AND "), params
+}
+
+// usesState returns true if the filter or sort column is a persisted workflow state value
+func (f WorkflowFilter) usesState(sort string) bool {
+	switch strings.ToLower(f.Status) {
+	case tukcnst.TUK_STATUS_MET, tukcnst.TUK_STATUS_MISSED, tukcnst.TUK_STATUS_ESCALATED:
+		return true
+	}
+	return f.Overdue || f.Escalated || strings.HasPrefix(workflowSortColumns[sort], "s.")
+}
+
+// evaluateWorkflowStates evaluates and persists the state of the workflows selected by the filter that have no persisted state or, if the
+// workflow state scheduler is not running, are open
+func (f WorkflowFilter) evaluateWorkflowStates() {
+	f.Overdue = false
+	f.Escalated = false
+	f.Unevaluated = true
+	switch strings.ToLower(f.Status) {
+	case tukcnst.TUK_STATUS_MET, tukcnst.TUK_STATUS_MISSED, tukcnst.TUK_STATUS_ESCALATED:
+		f.Status = ""
+	}
+	wfs := selectWorkflows(f)
+	for _, wf := range wfs.Workflows {
+		if wf.Id > 0 {
+			evaluateWorkflowState(wf)
+		}
+	}
+	if wfs.Count > 0 {
+		log.Printf("Evaluated %v Workflow States", wfs.Count)
+	}
+}
+
+// getFilteredWorkflows returns a page of the workflows selected by the filter and sets the page total and next cursor
+func getFilteredWorkflows(f WorkflowFilter, p *Page) ([]tukdbint.Workflow, error) {
+	var wfs []tukdbint.Workflow
+	if f.usesState(p.Sort) {
+		f.evaluateWorkflowStates()
+	}
+	where, params := f.where()
+	from := " FROM workflows w LEFT JOIN workflowstate s ON s.workflowid = w.id"
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	if err := tukdbint.DBConn.QueryRowContext(ctx, "SELECT COUNT(*)"+from+where, params...).Scan(&p.Total); err != nil {
+		log.Println(err.Error())
+		return wfs, err
+	}
+	sortcol := sortColumn(workflowSortColumns, p.Sort, DEFAULT_WORKFLOWS_SORT)
+	where, params = p.where(where, params, sortcol, "w.id")
+	stmnt := "SELECT w.id, w.pathway, w.nhsid, w.created, w.xdw_key, w.xdw_uid, w.xdw_doc, w.xdw_def, w.version, w.published, w.status, COALESCE(CAST(" + sortcol + " AS CHAR), '')" + from + where
+	rows, err := tukdbint.DBConn.QueryContext(ctx, stmnt, params...)
+	if err != nil {
+		log.Println(err.Error())
+		return wfs, err
+	}
+	defer rows.Close()
+	var keys []string
+	var ids []int64
+	for rows.Next() {
+		var key string
+		wf := tukdbint.Workflow{}
+		if err = rows.Scan(&wf.Id, &wf.Pathway, &wf.NHSId, &wf.Created, &wf.XDW_Key, &wf.XDW_UID, &wf.XDW_Doc, &wf.XDW_Def, &wf.Version, &wf.Published, &wf.Status, &key); err != nil {
+			log.Println(err.Error())
+			return wfs, err
+		}
+		wfs = append(wfs, wf)
+		keys = append(keys, key)
+		ids = append(ids, wf.Id)
+	}
+	wfs = wfs[:p.setNext(keys, ids)]
+	log.Printf("Selected %v of %v Workflows", len(wfs), p.Total)
+	return wfs, rows.Err()
+}
+
+// getWorkflows returns the workflows for the pathway, nhs id, version and status in id order. Empty values and a version of -1 are ignored.
+// As with tukdbint selects the selection is the first workflow. tukdbint workflow selects are not used as tukdbint cannot reflect the
+// workflow published field
+func getWorkflows(pathway string, nhsid string, vers int, status string) tukdbint.Workflows {
+	return selectWorkflows(WorkflowFilter{Pathway: pathway, NHSId: nhsid, Version: vers, Status: status})
+}
+
+// selectWorkflows returns the workflows selected by the filter in id order, up to the filter limit if set
+func selectWorkflows(f WorkflowFilter) tukdbint.Workflows {
+	wf := tukdbint.Workflow{Pathway: f.Pathway, NHSId: f.NHSId, Version: f.Version, Status: f.Status}
+	wfs := tukdbint.Workflows{Action: tukcnst.SELECT, Workflows: []tukdbint.Workflow{wf}}
+	where, params := f.where()
+	where = where + " ORDER BY w.id"
+	if f.Limit > 0 {
+		where = where + " LIMIT ?"
+		params = append(params, f.Limit)
+	}
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	rows, err := tukdbint.DBConn.QueryContext(ctx, "SELECT w.id, w.pathway, w.nhsid, w.created, w.xdw_key, w.xdw_uid, w.xdw_doc, w.xdw_def, w.version, w.published, w.status FROM workflows w LEFT JOIN workflowstate s ON s.workflowid = w.id"+where, params...)
+	if err != nil {
+		log.Println(err.Error())
+		return wfs
+	}
+	defer rows.Close()
+	for rows.Next() {
+		wf, err := scanWorkflow(rows)
+		if err != nil {
+			log.Println(err.Error())
+			return wfs
+		}
+		wfs.Workflows = append(wfs.Workflows, wf)
+		wfs.Count = wfs.Count + 1
+	}
+	return wfs
+}
+
+// getDashboard returns the dashboard counts of the workflows selected by the filter. The counts are read from the persisted workflow states.
+// Workflow states are only evaluated if the workflow state scheduler is not running, so a dashboard request does not update workflow
+// states the scheduler maintains
+func getDashboard(f WorkflowFilter) (tukxdw.Dashboard, error) {
+	dashboard := tukxdw.Dashboard{}
+	if !isWorkflowStateSchedulerRunning() {
+		f.evaluateWorkflowStates()
+	}
+	where, params := f.where()
+	ctx, cancelCtx := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCtx()
+	stmnt := "SELECT COUNT(*)," +
+		" COALESCE(SUM(w.status = 'OPEN'), 0)," +
+		" COALESCE(SUM(w.status = 'CLOSED' AND COALESCE(s.overdue, 'FALSE') != 'TRUE'), 0)," +
+		" COALESCE(SUM(s.overdue = 'TRUE'), 0)," +
+		" COALESCE(SUM(w.status = 'OPEN' AND s.escalated = 'TRUE'), 0)," +
+		" COALESCE(SUM(w.status = 'CLOSED'), 0)" +
+		" FROM workflows w LEFT JOIN workflowstate s ON s.workflowid = w.id" + where
+	err := tukdbint.DBConn.QueryRowContext(ctx, stmnt, params...).Scan(&dashboard.Total, &dashboard.InProgress, &dashboard.TargetMet, &dashboard.TargetMissed, &dashboard.Escalated, &dashboard.Complete)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	return dashboard, err
+}
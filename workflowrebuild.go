@@ -0,0 +1,438 @@
+package tukint
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukutil"
+	"github.com/ipthomas/tukxdw"
+)
+
+const (
+	TUK_TASK_ENTERED_IN_ERROR         = "enteredinerror"
+	TUK_OP_REOPEN                     = "reopen"
+	XDW_DOCEVENTTYPE_ENTERED_IN_ERROR = "ENTERED_IN_ERROR"
+)
+
+// EventError records an Event Service event that was entered in error
+type EventError struct {
+	Id      int64  `json:"id"`
+	Created string `json:"created"`
+	EventId int64  `json:"eventid"`
+	Pathway string `json:"pathway"`
+	NHSId   string `json:"nhsid"`
+	User    string `json:"user"`
+	Org     string `json:"org"`
+	Role    string `json:"role"`
+	Reason  string `json:"reason"`
+}
+
+// enteredInError marks the event RowId as entered in error and rebuilds the workflow without it. Op 'reopen' reopens a closed workflow
+func (i *TukEvent) enteredInError() []byte {
+	err := setEventEnteredInError(i.RowId, i.Notes, i.Op == TUK_OP_REOPEN, i.EventServices.EventService.User, i.EventServices.EventService.Org, i.EventServices.EventService.Role)
+	if err != nil {
+		log.Println(err.Error())
+		i.ReturnCode = http.StatusBadRequest
+		if i.ReturnJSON {
+			return []byte(err.Error())
+		}
+	}
+	if i.ReturnJSON {
+		if i.HttpResponse != nil {
+			i.HttpResponse.Header().Add(tukcnst.CONTENT_TYPE, tukcnst.APPLICATION_JSON)
+		}
+		errs, _ := getEventErrors(i.Pathway, i.NHSId)
+		b, _ := json.MarshalIndent(errs, "", "  ")
+		return b
+	}
+	i.Act = tukcnst.WIDGET
+	i.Task = tukcnst.XDW
+	return i.handleRequest()
+}
+func setEventEnteredInError(eventid int64, reason string, reopen bool, user string, org string, role string) error {
+	evs, err := getEvents(tukdbint.Event{Id: eventid, Version: -1, TaskId: -1})
+	if err != nil {
+		return err
+	}
+	if evs.Count != 1 {
+		return errors.New("no event found with id " + tukutil.GetStringFromInt(int(eventid)))
+	}
+	ev := evs.Events[1]
+	errs, err := getEventErrors(ev.Pathway, ev.NhsId)
+	if err != nil {
+		return err
+	}
+	for _, everr := range errs {
+		if everr.EventId == eventid {
+			return errors.New("event " + tukutil.GetStringFromInt(int(eventid)) + " is already entered in error")
+		}
+	}
+	wf, err := getCurrentWorkflow(ev.Pathway, ev.NhsId, ev.Version)
+	if err != nil {
+		return err
+	}
+	log.Printf("Marking Event %v for %s Workflow NHS ID %s as entered in error", eventid, ev.Pathway, ev.NhsId)
+	everr := EventError{Created: tukutil.Time_Now(), EventId: eventid, Pathway: ev.Pathway, NHSId: ev.NhsId, User: user, Org: org, Role: role, Reason: reason}
+	everrs := []EventError{everr}
+	if reopen {
+		closures, err := getEvents(tukdbint.Event{Pathway: wf.Pathway, NhsId: wf.NHSId, Version: wf.Version, TaskId: -1})
+		if err != nil {
+			return err
+		}
+		for _, closure := range closures.Events {
+			if closure.Id > 0 && (closure.EventType == tukcnst.XDW_TASKEVENTTYPE_WORKFLOW_COMPLETED || closure.EventType == XDW_DOCEVENTTYPE_CANCEL_WORKFLOW) {
+				log.Printf("Reopening %s Workflow for NHS ID %s. Marking closure Event %v as entered in error", wf.Pathway, wf.NHSId, closure.Id)
+				everrs = append(everrs, EventError{Created: everr.Created, EventId: closure.Id, Pathway: ev.Pathway, NHSId: ev.NhsId, User: user, Org: org, Role: role, Reason: "Reopened. " + reason})
+			}
+		}
+	}
+	correction := tukdbint.Event{
+		Creationtime: everr.Created,
+		EventType:    XDW_DOCEVENTTYPE_ENTERED_IN_ERROR,
+		Expression:   XDW_DOCEVENTTYPE_ENTERED_IN_ERROR,
+		Authors:      user + " " + org + " " + role,
+		NhsId:        ev.NhsId,
+		User:         user,
+		Org:          org,
+		Role:         role,
+		Pathway:      ev.Pathway,
+		Comments:     "Event " + tukutil.GetStringFromInt(int(eventid)) + " entered in error. " + reason,
+		Version:      ev.Version,
+		TaskId:       ev.TaskId,
+	}
+	var correctionid int64
+	ids, err := setEventErrors(everrs)
+	if err == nil {
+		if correctionid = newEvent(correction); correctionid == 0 {
+			err = errors.New("failed to create entered in error event for event " + tukutil.GetStringFromInt(int(eventid)))
+		}
+	}
+	if err == nil {
+		err = updateWorkflowDocument(wf, func(e *workflowEngine) (bool, error) {
+			return true, e.rebuildFromEvents()
+		})
+	}
+	if err != nil {
+		// the rows are removed so the event is not refused as already entered in error when the request is retried
+		log.Printf("Failed to rebuild %s Workflow for NHS ID %s. Removing entered in error records of Event %v", wf.Pathway, wf.NHSId, eventid)
+		deleteEventErrors(ids)
+		if correctionid > 0 {
+			deleteEvent(correctionid)
+		}
+	}
+	return err
+}
+
+// setEventErrors persists the event errors and returns the ids of the persisted event errors
+func setEventErrors(everrs []EventError) ([]int64, error) {
+	var ids []int64
+	for _, everr := range everrs {
+		if err := setEventError(&everr); err != nil {
+			return ids, err
+		}
+		ids = append(ids, everr.Id)
+	}
+	return ids, nil
+}
+
+// rebuildWorkflow returns a workflow engine holding the workflow document rebuilt from the frozen workflow definition and events.
+// The stored workflow document is not read so a document that is not valid can be rebuilt
+func rebuildWorkflow(wf tukdbint.Workflow) (*workflowEngine, error) {
+	e, err := newDefinitionEngine(wf)
+	if err != nil {
+		return nil, err
+	}
+	return e, e.rebuildFromEvents()
+}
+func (e *workflowEngine) rebuildFromEvents() error {
+	errs, err := getEventErrors(e.Workflow.Pathway, e.Workflow.NHSId)
+	if err != nil {
+		return err
+	}
+	errored := make(map[int64]bool)
+	for _, everr := range errs {
+		errored[everr.EventId] = true
+	}
+	evs, err := getEvents(tukdbint.Event{Pathway: e.Workflow.Pathway, NhsId: e.Workflow.NHSId, Version: e.Workflow.Version, TaskId: -1})
+	if err != nil {
+		return err
+	}
+	e.rebuild(workflowEvents(e.Workflow, evs.Events), errored)
+	return nil
+}
+
+// rebuild resets the workflow document to its created state and re-applies the events in order, excluding events entered in error
+func (e *workflowEngine) rebuild(evs []tukdbint.Event, errored map[int64]bool) {
+	log.Printf("Rebuilding %s Workflow for NHS ID %s from %v Events", e.Workflow.Pathway, e.Workflow.NHSId, len(evs))
+	e.resetDocument(evs)
+	var pending []tukdbint.Event
+	for _, ev := range evs {
+		if errored[ev.Id] {
+			log.Printf("Event %v is entered in error. Skipping Event", ev.Id)
+			continue
+		}
+		switch ev.EventType {
+		case tukcnst.XDW_DOCEVENTTYPE_CREATE_WORKFLOW, tukcnst.XDW_TASKEVENTTYPE_CREATE_TASK, XDW_TASKEVENTTYPE_SUBWORKFLOW_CREATED:
+			continue
+		case XDW_DOCEVENTTYPE_CANCEL_WORKFLOW, XDW_DOCEVENTTYPE_SUSPEND_WORKFLOW, XDW_DOCEVENTTYPE_RESUME_WORKFLOW:
+			if err := e.applyStatusOperation(statusOperation(ev.EventType), ev); err != nil {
+				log.Println(err.Error())
+			}
+		case XDW_DOCEVENTTYPE_ENTERED_IN_ERROR:
+			e.newStatusEvent(ev, e.latestDocumentStatus())
+		case tukcnst.XDW_TASKEVENTTYPE_WORKFLOW_COMPLETED:
+			if e.Document.WorkflowStatus == tukcnst.OPEN {
+				e.closeWorkflow("", ev.Creationtime)
+			}
+		default:
+			pending = append(pending, ev)
+		}
+		if e.Document.WorkflowStatus != WORKFLOW_STATUS_SUSPENDED && len(pending) > 0 {
+			pending = e.applyEvents(pending)
+		}
+	}
+}
+
+// resetDocument sets the workflow document to its state when the workflow was created. The document is built from the workflow,
+// the workflow definition and the create workflow event
+func (e *workflowEngine) resetDocument(evs []tukdbint.Event) {
+	created := tukdbint.Event{Creationtime: e.Workflow.Created}
+	for _, ev := range evs {
+		if ev.EventType == tukcnst.XDW_DOCEVENTTYPE_CREATE_WORKFLOW {
+			created = ev
+			break
+		}
+	}
+	authoid := tukdbint.GetIDMapsLocalId("", created.Org)
+	e.Document = tukxdw.WorkflowDocument{}
+	e.Document.Xdw = tukcnst.XDWNameSpace
+	e.Document.Hl7 = tukcnst.HL7NameSpace
+	e.Document.WsHt = tukcnst.WHTNameSpace
+	e.Document.Xsi = tukcnst.XMLNS_XSI
+	e.Document.XMLName.Local = tukcnst.XDWNameLocal
+	e.Document.SchemaLocation = tukcnst.WorkflowDocumentSchemaLocation
+	e.Document.ID.Root = strings.ReplaceAll(tukcnst.WorkflowInstanceId, "^", "")
+	e.Document.ID.Extension = e.Workflow.XDW_UID
+	e.Document.ID.AssigningAuthorityName = strings.ToUpper(created.Org)
+	e.Document.EffectiveTime.Value = created.Creationtime
+	e.Document.ConfidentialityCode.Code = e.Definition.Confidentialitycode
+	e.Document.Patient.Root = tukcnst.NHS_OID_DEFAULT
+	e.Document.Patient.Extension = e.Workflow.NHSId
+	e.Document.Patient.AssigningAuthorityName = "NHS"
+	e.Document.Author.AssignedAuthor.ID.Root = authoid
+	e.Document.Author.AssignedAuthor.ID.Extension = strings.ToUpper(created.Org)
+	e.Document.Author.AssignedAuthor.ID.AssigningAuthorityName = authoid
+	e.Document.Author.AssignedAuthor.AssignedPerson.Name.Family = created.User
+	e.Document.Author.AssignedAuthor.AssignedPerson.Name.Prefix = created.Role
+	e.Document.WorkflowInstanceId = e.Workflow.XDW_UID + tukcnst.WorkflowInstanceId
+	e.Document.WorkflowDocumentSequenceNumber = "1"
+	e.Document.WorkflowStatus = tukcnst.OPEN
+	e.Document.WorkflowDefinitionReference = strings.ToUpper(e.Workflow.Pathway)
+	e.Document.WorkflowStatusHistory.DocumentEvent = []tukxdw.DocumentEvent{{
+		Author:              created.User + " " + created.Org + " " + created.Role,
+		TaskEventIdentifier: "0",
+		EventTime:           created.Creationtime,
+		EventType:           tukcnst.XDW_DOCEVENTTYPE_CREATE_WORKFLOW,
+		ActualStatus:        tukcnst.OPEN,
+	}}
+	e.Applied = 0
+	e.Closed = ""
+	e.LastEventTime = ""
+	for _, t := range e.Definition.Tasks {
+		task := tukxdw.XDWTask{}
+		task.TaskData.TaskDetails.ID = t.ID
+		task.TaskData.TaskDetails.TaskType = t.Tasktype
+		task.TaskData.TaskDetails.Name = t.Name
+		task.TaskData.TaskDetails.ActualOwner = t.ActualOwner
+		task.TaskData.TaskDetails.CreatedBy = e.Document.Author.AssignedAuthor.AssignedPerson.Name.Prefix + " " + e.Document.Author.AssignedAuthor.AssignedPerson.Name.Family
+		task.TaskData.TaskDetails.CreatedTime = e.Document.EffectiveTime.Value
+		task.TaskData.TaskDetails.RenderingMethodExists = "false"
+		task.TaskData.TaskDetails.LastModifiedTime = e.Document.EffectiveTime.Value
+		task.TaskData.TaskDetails.Status = tukcnst.CREATED
+		task.TaskData.Description = t.Description
+		for _, inp := range t.Input {
+			docinput := tukxdw.Input{}
+			docinput.Part.Name = inp.Name
+			docinput.Part.AttachmentInfo.Name = inp.Name
+			docinput.Part.AttachmentInfo.AccessType = inp.AccessType
+			docinput.Part.AttachmentInfo.ContentType = inp.Contenttype
+			docinput.Part.AttachmentInfo.ContentCategory = tukcnst.MEDIA_TYPES
+			task.TaskData.Input = append(task.TaskData.Input, docinput)
+		}
+		for _, outp := range t.Output {
+			docoutput := tukxdw.Output{}
+			docoutput.Part.Name = outp.Name
+			docoutput.Part.AttachmentInfo.Name = outp.Name
+			docoutput.Part.AttachmentInfo.AccessType = outp.AccessType
+			docoutput.Part.AttachmentInfo.ContentType = outp.Contenttype
+			docoutput.Part.AttachmentInfo.ContentCategory = tukcnst.MEDIA_TYPES
+			task.TaskData.Output = append(task.TaskData.Output, docoutput)
+		}
+		tev := tukxdw.TaskEvent{
+			EventTime:  e.Document.EffectiveTime.Value,
+			Identifier: t.ID,
+			EventType:  tukcnst.XDW_TASKEVENTTYPE_CREATED,
+			Status:     tukcnst.XDW_TASKEVENTTYPE_COMPLETE,
+		}
+		for _, ev := range evs {
+			if ev.EventType == tukcnst.XDW_TASKEVENTTYPE_CREATE_TASK && tukutil.GetStringFromInt(ev.TaskId) == t.ID {
+				tev.ID = tukutil.GetStringFromInt(int(ev.Id))
+			}
+		}
+		task.TaskEventHistory.TaskEvent = append(task.TaskEventHistory.TaskEvent, tev)
+		e.Document.TaskList.XDWTask = append(e.Document.TaskList.XDWTask, task)
+	}
+}
+
+// Workflow replay
+
+const (
+	TUK_TASK_REPLAY = "replay"
+	TUK_OP_WRITE    = "write"
+)
+
+type ReplayResult struct {
+	WorkflowId  int64    `json:"workflowid"`
+	Pathway     string   `json:"pathway"`
+	NHSId       string   `json:"nhsid"`
+	Version     int      `json:"version"`
+	Match       bool     `json:"match"`
+	Differences []string `json:"differences"`
+	Written     bool     `json:"written"`
+	Error       string   `json:"error"`
+}
+
+// replayWorkflows rebuilds the selected workflows from their event logs and compares the rebuilt documents with the stored documents.
+// A pathway is required and an empty nhs id replays every workflow for the pathway. Op 'write' persists rebuilt documents that differ
+// from the stored document
+func (i *TukEvent) replayWorkflows() []byte {
+	var results []ReplayResult
+	if i.Pathway == "" {
+		i.ReturnCode = http.StatusBadRequest
+		return []byte("pathway is required to replay workflows")
+	}
+	wfs := getWorkflows(i.Pathway, i.NHSId, i.Vers, "")
+	log.Printf("Replaying %v Workflows", wfs.Count)
+	for _, wf := range wfs.Workflows {
+		if wf.Id > 0 {
+			results = append(results, replayWorkflow(wf, i.Op == TUK_OP_WRITE))
+		}
+	}
+	b, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		log.Println(err.Error())
+		return []byte(err.Error())
+	}
+	if i.ReturnJSON {
+		if i.HttpResponse != nil {
+			i.HttpResponse.Header().Add(tukcnst.CONTENT_TYPE, tukcnst.APPLICATION_JSON)
+		}
+		return b
+	}
+	i.ConfigStr = string(b)
+	return i.ConfigWidget()
+}
+func replayWorkflow(wf tukdbint.Workflow, write bool) ReplayResult {
+	result := ReplayResult{WorkflowId: wf.Id, Pathway: wf.Pathway, NHSId: wf.NHSId, Version: wf.Version}
+	e, err := rebuildWorkflow(wf)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	stored := tukxdw.WorkflowDocument{}
+	if err := json.Unmarshal([]byte(wf.XDW_Doc), &stored); err != nil {
+		log.Println(err.Error())
+		result.Differences = append(result.Differences, "stored document is invalid. "+err.Error())
+	} else {
+		e.Sequence = stored.WorkflowDocumentSequenceNumber
+		result.Differences = append(result.Differences, compareWorkflowDocuments(stored, e.Document)...)
+	}
+	result.Match = len(result.Differences) == 0
+	log.Printf("Replayed %s Workflow for NHS ID %s Version %v. Rebuilt document matches stored document = %v", wf.Pathway, wf.NHSId, wf.Version, result.Match)
+	if write && !result.Match {
+		if err := e.overwrite(); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Written = true
+		}
+	}
+	return result
+}
+
+// overwrite replaces the stored workflow document, which need not be a valid document, if it is unchanged since the workflow was loaded.
+// ErrWorkflowConflict is returned if the stored document has changed. The rebuilt document records the effects of the events, so
+// subscribers are not notified and no events, subscription changes or subworkflows are created as when an update is persisted
+func (e *workflowEngine) overwrite() error {
+	xdwDocBytes, err := e.marshalDocument()
+	if err != nil {
+		return err
+	}
+	updated, err := replaceWorkflowDocument(e.Workflow.Id, string(xdwDocBytes), e.Document.WorkflowStatus, e.Workflow.XDW_Doc)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		log.Printf("%s Workflow for NHS ID %s Document has changed since it was replayed", e.Workflow.Pathway, e.Workflow.NHSId)
+		return ErrWorkflowConflict
+	}
+	log.Printf("Overwrote %s Workflow for NHS ID %s Version %v Document. Status %s Sequence Number %s", e.Workflow.Pathway, e.Workflow.NHSId, e.Workflow.Version, e.Document.WorkflowStatus, e.Document.WorkflowDocumentSequenceNumber)
+	e.Sequence = e.Document.WorkflowDocumentSequenceNumber
+	e.Workflow.XDW_Doc = string(xdwDocBytes)
+	e.Workflow.Status = e.Document.WorkflowStatus
+	return nil
+}
+
+// compareWorkflowDocuments returns the differences in workflow and task state between two workflow documents
+func compareWorkflowDocuments(stored tukxdw.WorkflowDocument, rebuilt tukxdw.WorkflowDocument) []string {
+	var diffs []string
+	if stored.WorkflowStatus != rebuilt.WorkflowStatus {
+		diffs = append(diffs, "workflow status "+stored.WorkflowStatus+" rebuilt "+rebuilt.WorkflowStatus)
+	}
+	if len(stored.WorkflowStatusHistory.DocumentEvent) != len(rebuilt.WorkflowStatusHistory.DocumentEvent) {
+		diffs = append(diffs, "workflow status history events "+tukutil.GetStringFromInt(len(stored.WorkflowStatusHistory.DocumentEvent))+" rebuilt "+tukutil.GetStringFromInt(len(rebuilt.WorkflowStatusHistory.DocumentEvent)))
+	} else {
+		for k, docevent := range stored.WorkflowStatusHistory.DocumentEvent {
+			rdocevent := rebuilt.WorkflowStatusHistory.DocumentEvent[k]
+			if docevent.EventType != rdocevent.EventType || docevent.TaskEventIdentifier != rdocevent.TaskEventIdentifier || docevent.ActualStatus != rdocevent.ActualStatus {
+				diffs = append(diffs, "workflow status history event "+tukutil.GetStringFromInt(k+1)+" "+docevent.EventType+" task "+docevent.TaskEventIdentifier+" "+docevent.ActualStatus+" rebuilt "+rdocevent.EventType+" task "+rdocevent.TaskEventIdentifier+" "+rdocevent.ActualStatus)
+			}
+		}
+	}
+	if len(stored.TaskList.XDWTask) != len(rebuilt.TaskList.XDWTask) {
+		diffs = append(diffs, "task count "+tukutil.GetStringFromInt(len(stored.TaskList.XDWTask))+" rebuilt "+tukutil.GetStringFromInt(len(rebuilt.TaskList.XDWTask)))
+		return diffs
+	}
+	for k, task := range stored.TaskList.XDWTask {
+		rtask := rebuilt.TaskList.XDWTask[k]
+		id := task.TaskData.TaskDetails.ID
+		if task.TaskData.TaskDetails.Status != rtask.TaskData.TaskDetails.Status {
+			diffs = append(diffs, "task "+id+" status "+task.TaskData.TaskDetails.Status+" rebuilt "+rtask.TaskData.TaskDetails.Status)
+		}
+		if len(task.TaskEventHistory.TaskEvent) != len(rtask.TaskEventHistory.TaskEvent) {
+			diffs = append(diffs, "task "+id+" events "+tukutil.GetStringFromInt(len(task.TaskEventHistory.TaskEvent))+" rebuilt "+tukutil.GetStringFromInt(len(rtask.TaskEventHistory.TaskEvent)))
+		} else {
+			for t, tev := range task.TaskEventHistory.TaskEvent {
+				rtev := rtask.TaskEventHistory.TaskEvent[t]
+				if tev.ID != rtev.ID || tev.EventType != rtev.EventType || tev.Status != rtev.Status {
+					diffs = append(diffs, "task "+id+" event "+tukutil.GetStringFromInt(t+1)+" id "+tev.ID+" "+tev.EventType+" "+tev.Status+" rebuilt id "+rtev.ID+" "+rtev.EventType+" "+rtev.Status)
+				}
+			}
+		}
+		for inp, input := range task.TaskData.Input {
+			if inp < len(rtask.TaskData.Input) && input.Part.AttachmentInfo.Identifier != rtask.TaskData.Input[inp].Part.AttachmentInfo.Identifier {
+				diffs = append(diffs, "task "+id+" input "+input.Part.Name+" attachment "+input.Part.AttachmentInfo.Identifier+" rebuilt "+rtask.TaskData.Input[inp].Part.AttachmentInfo.Identifier)
+			}
+		}
+		for oup, output := range task.TaskData.Output {
+			if oup < len(rtask.TaskData.Output) && output.Part.AttachmentInfo.Identifier != rtask.TaskData.Output[oup].Part.AttachmentInfo.Identifier {
+				diffs = append(diffs, "task "+id+" output "+output.Part.Name+" attachment "+output.Part.AttachmentInfo.Identifier+" rebuilt "+rtask.TaskData.Output[oup].Part.AttachmentInfo.Identifier)
+			}
+		}
+	}
+	return diffs
+}
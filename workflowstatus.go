@@ -0,0 +1,377 @@
+package tukint
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipthomas/tukcnst"
+	"github.com/ipthomas/tukdbint"
+	"github.com/ipthomas/tukutil"
+	"github.com/ipthomas/tukxdw"
+)
+
+const (
+	TUK_TASK_SUSPEND                  = "suspend"
+	TUK_TASK_RESUME                   = "resume"
+	WORKFLOW_STATUS_SUSPENDED         = "SUSPENDED"
+	WORKFLOW_STATUS_CANCELLED         = "CANCELLED"
+	XDW_DOCEVENTTYPE_CANCEL_WORKFLOW  = "CANCEL_WORKFLOW"
+	XDW_DOCEVENTTYPE_SUSPEND_WORKFLOW = "SUSPEND_WORKFLOW"
+	XDW_DOCEVENTTYPE_RESUME_WORKFLOW  = "RESUME_WORKFLOW"
+)
+
+// TaskState is the deadline state of a workflow task. Task deadlines are calculated from the workflow start using the business calendar
+type TaskState struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Status        string `json:"status"`
+	CompleteBy    string `json:"completeby"`
+	Overdue       bool   `json:"overdue"`
+	TimeRemaining string `json:"timeremaining"`
+}
+
+// manageWorkflow cancels, suspends or resumes the workflow for the pathway and nhs id. The Notes param provides the reason
+func (i *TukEvent) manageWorkflow() []byte {
+	wf, err := getCurrentWorkflow(i.Pathway, i.NHSId, i.Vers)
+	if err == nil {
+		err = setWorkflowStatus(wf, i.Task, i.Notes, i.EventServices.EventService.User, i.EventServices.EventService.Org, i.EventServices.EventService.Role)
+	}
+	if err != nil {
+		log.Println(err.Error())
+		i.ReturnCode = http.StatusBadRequest
+		if i.ReturnJSON {
+			return []byte(err.Error())
+		}
+	}
+	if i.ReturnJSON {
+		if i.HttpResponse != nil {
+			i.HttpResponse.Header().Add(tukcnst.CONTENT_TYPE, tukcnst.APPLICATION_JSON)
+		}
+		wf, _ = getCurrentWorkflow(i.Pathway, i.NHSId, i.Vers)
+		b, _ := json.MarshalIndent(wf, "", "  ")
+		return b
+	}
+	i.Act = tukcnst.WIDGET
+	i.Task = tukcnst.XDW
+	return i.handleRequest()
+}
+func getCurrentWorkflow(pathway string, nhsid string, vers int) (tukdbint.Workflow, error) {
+	if vers < 0 {
+		vers = 0
+	}
+	wfs := getWorkflows(pathway, nhsid, vers, "")
+	if wfs.Count != 1 {
+		return wfs.Workflows[0], errors.New("no " + pathway + " workflow found for nhs id " + nhsid)
+	}
+	return wfs.Workflows[1], nil
+}
+
+// setWorkflowStatus applies a cancel, suspend or resume operation to a workflow and registers an event recording the operation
+func setWorkflowStatus(wf tukdbint.Workflow, op string, reason string, user string, org string, role string) error {
+	var ev tukdbint.Event
+	err := updateWorkflowDocument(wf, func(e *workflowEngine) (bool, error) {
+		ev = e.workflowEvent(statusEventType(op), reason)
+		ev.User = user
+		ev.Org = org
+		ev.Role = role
+		status := e.Document.WorkflowStatus
+		if err := e.applyStatusOperation(op, ev); err != nil {
+			return false, err
+		}
+		log.Printf("Setting %s Workflow for NHS ID %s status from %s to %s", wf.Pathway, wf.NHSId, status, e.Document.WorkflowStatus)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	newEvent(ev)
+	if op == TUK_TASK_RESUME {
+		return updateWorkflows(wf.Pathway, wf.NHSId, wf.Version)
+	}
+	return nil
+}
+func statusEventType(op string) string {
+	switch op {
+	case tukcnst.CANCEL:
+		return XDW_DOCEVENTTYPE_CANCEL_WORKFLOW
+	case TUK_TASK_SUSPEND:
+		return XDW_DOCEVENTTYPE_SUSPEND_WORKFLOW
+	case TUK_TASK_RESUME:
+		return XDW_DOCEVENTTYPE_RESUME_WORKFLOW
+	}
+	return ""
+}
+func statusOperation(eventtype string) string {
+	for _, op := range []string{tukcnst.CANCEL, TUK_TASK_SUSPEND, TUK_TASK_RESUME} {
+		if statusEventType(op) == eventtype {
+			return op
+		}
+	}
+	return ""
+}
+
+// applyStatusOperation sets the workflow status and records the transition in the workflow status history
+func (e *workflowEngine) applyStatusOperation(op string, ev tukdbint.Event) error {
+	status := e.Document.WorkflowStatus
+	var actual string
+	switch op {
+	case tukcnst.CANCEL:
+		if isWorkflowEnded(status) {
+			return errors.New("workflow is " + strings.ToLower(status) + " and cannot be cancelled")
+		}
+		actual = WORKFLOW_STATUS_CANCELLED
+		e.Document.WorkflowStatus = WORKFLOW_STATUS_CANCELLED
+	case TUK_TASK_SUSPEND:
+		if status != tukcnst.OPEN {
+			return errors.New("only open workflows can be suspended. workflow status is " + status)
+		}
+		actual = WORKFLOW_STATUS_SUSPENDED
+		e.Document.WorkflowStatus = WORKFLOW_STATUS_SUSPENDED
+	case TUK_TASK_RESUME:
+		if status != WORKFLOW_STATUS_SUSPENDED {
+			return errors.New("only suspended workflows can be resumed. workflow status is " + status)
+		}
+		actual = e.statusBeforeSuspension()
+		e.Document.WorkflowStatus = tukcnst.OPEN
+	default:
+		return errors.New("invalid workflow operation " + op)
+	}
+	e.newStatusEvent(ev, actual)
+	return nil
+}
+func (e *workflowEngine) newStatusEvent(ev tukdbint.Event, status string) {
+	docevent := tukxdw.DocumentEvent{
+		Author:              ev.User + " " + ev.Org + " " + ev.Role,
+		TaskEventIdentifier: tukutil.GetStringFromInt(ev.TaskId),
+		EventTime:           ev.Creationtime,
+		EventType:           ev.EventType,
+		PreviousStatus:      e.latestDocumentStatus(),
+		ActualStatus:        status,
+	}
+	e.Document.WorkflowStatusHistory.DocumentEvent = append(e.Document.WorkflowStatusHistory.DocumentEvent, docevent)
+	e.incrementSequenceNumber()
+}
+
+// isWorkflowEnded returns true if the workflow status is closed or cancelled. Cancelled workflows are ended but are not complete
+func isWorkflowEnded(status string) bool {
+	return status == tukcnst.CLOSED || status == WORKFLOW_STATUS_CANCELLED
+}
+
+// statusBeforeSuspension returns the document status recorded prior to the latest suspension
+func (e *workflowEngine) statusBeforeSuspension() string {
+	for k := len(e.Document.WorkflowStatusHistory.DocumentEvent) - 1; k >= 0; k-- {
+		docevent := e.Document.WorkflowStatusHistory.DocumentEvent[k]
+		if docevent.EventType == XDW_DOCEVENTTYPE_SUSPEND_WORKFLOW {
+			return docevent.PreviousStatus
+		}
+	}
+	return tukcnst.OPEN
+}
+
+// suspension is a period the workflow was suspended
+type suspension struct {
+	start time.Time
+	end   time.Time
+}
+
+// suspensions returns the periods the workflow has been suspended. A current suspension ends now
+func (e *workflowEngine) suspensions() []suspension {
+	var suspensions []suspension
+	var start time.Time
+	for _, docevent := range e.Document.WorkflowStatusHistory.DocumentEvent {
+		switch docevent.EventType {
+		case XDW_DOCEVENTTYPE_SUSPEND_WORKFLOW:
+			start = tukutil.GetTimeFromString(docevent.EventTime)
+		case XDW_DOCEVENTTYPE_RESUME_WORKFLOW:
+			if !start.IsZero() {
+				suspensions = append(suspensions, suspension{start: start, end: tukutil.GetTimeFromString(docevent.EventTime)})
+				start = time.Time{}
+			}
+		}
+	}
+	if !start.IsZero() {
+		suspensions = append(suspensions, suspension{start: start, end: time.Now()})
+	}
+	return suspensions
+}
+
+// suspendedDuration returns the total time the workflow has been suspended, including any current suspension
+func (e *workflowEngine) suspendedDuration() time.Duration {
+	var suspended time.Duration
+	for _, s := range e.suspensions() {
+		suspended = suspended + s.end.Sub(s.start)
+	}
+	return suspended
+}
+
+// deadline returns the date of the period from start, extended by the time the workflow has been suspended. Workday and workhour
+// periods are extended by the working time the workflow has been suspended, so time suspended outside working hours is not added
+func (e *workflowEngine) deadline(start time.Time, period string) time.Time {
+	cal := Calendar()
+	due := cal.FutureDate(start, period)
+	unit := strings.Split(period, "(")[0]
+	switch unit {
+	case "workday", "workhour":
+		var suspended time.Duration
+		for _, s := range e.suspensions() {
+			suspended = suspended + cal.workingTime(s.start, s.end)
+		}
+		if unit == "workday" {
+			days := int(suspended / cal.workdayLength())
+			due = cal.addWorkdays(due, days)
+			suspended = suspended - time.Duration(days)*cal.workdayLength()
+		}
+		return cal.addWorkingTime(due, suspended)
+	}
+	return due.Add(e.suspendedDuration())
+}
+
+// Workflow state. Deadlines are offset by the time the workflow has been suspended
+
+func (e *workflowEngine) startTime() time.Time {
+	return tukutil.GetTimeFromString(e.Document.EffectiveTime.Value)
+}
+func (e *workflowEngine) endTime() time.Time {
+	if isWorkflowEnded(e.Document.WorkflowStatus) {
+		return e.transaction().GetLatestWorkflowEventTime()
+	}
+	return time.Now()
+}
+func (e *workflowEngine) completeByDate() time.Time {
+	return e.deadline(e.startTime(), e.Definition.CompleteByTime)
+}
+func (e *workflowEngine) escalateDate() time.Time {
+	return e.deadline(e.startTime(), e.Definition.ExpirationTime)
+}
+func (e *workflowEngine) isOverdue() bool {
+	if e.Definition.CompleteByTime == "" || e.Document.WorkflowStatus == WORKFLOW_STATUS_CANCELLED {
+		return false
+	}
+	completeby := e.completeByDate()
+	if time.Now().Before(completeby) {
+		return false
+	}
+	if e.Document.WorkflowStatus == tukcnst.CLOSED {
+		return e.transaction().GetLatestWorkflowEventTime().After(completeby)
+	}
+	return true
+}
+func (e *workflowEngine) isEscalated() bool {
+	if e.Definition.ExpirationTime == "" || e.Document.WorkflowStatus != tukcnst.OPEN {
+		return false
+	}
+	return time.Now().After(e.escalateDate())
+}
+func (e *workflowEngine) timeRemaining() string {
+	if e.Definition.CompleteByTime == "" {
+		return "Non Specified"
+	}
+	completeby := e.completeByDate()
+	if time.Now().After(completeby) {
+		return "0"
+	}
+	return tukutil.PrettyPrintDuration(time.Until(completeby))
+}
+func (e *workflowEngine) duration() string {
+	return tukutil.GetDuration(e.endTime().Sub(e.startTime()) - e.suspendedDuration())
+}
+
+// State returns the workflowstate of the workflow
+func (e *workflowEngine) State() tukdbint.Workflowstate {
+	state := tukdbint.Workflowstate{
+		WorkflowId: e.Workflow.Id,
+		Pathway:    e.Workflow.Pathway,
+		NHSId:      e.Workflow.NHSId,
+		Version:    e.Workflow.Version,
+		Published:  e.Workflow.Published,
+		Created:    e.Workflow.Created,
+		CreatedBy:  e.Document.Author.AssignedAuthor.AssignedPerson.Name.Family + " " + e.Document.Author.AssignedAuthor.AssignedPerson.Name.Prefix,
+		Status:     e.Workflow.Status,
+		CompleteBy: "Non Specified",
+		LastUpdate: e.transaction().GetLatestWorkflowEventTime().String(),
+		Overdue:    "FALSE",
+		Escalated:  "FALSE",
+		TargetMet:  "TRUE",
+		InProgress: "TRUE",
+		Duration:   e.duration(),
+	}
+	if e.Definition.CompleteByTime != "" {
+		state.CompleteBy = strings.Split(e.completeByDate().In(Calendar().Location).String(), " +")[0]
+	}
+	if isWorkflowEnded(e.Document.WorkflowStatus) {
+		state.TimeRemaining = "0"
+		state.InProgress = "FALSE"
+	} else {
+		state.TimeRemaining = e.timeRemaining()
+	}
+	if e.isOverdue() {
+		state.Overdue = "TRUE"
+		state.TargetMet = "FALSE"
+	}
+	if e.isEscalated() {
+		state.Escalated = "TRUE"
+	}
+	if e.Document.WorkflowStatus == WORKFLOW_STATUS_CANCELLED {
+		state.TargetMet = "FALSE"
+	}
+	return state
+}
+
+// Task state. Task deadlines are offset by the time the workflow has been suspended
+
+func (e *workflowEngine) taskCompleteByTime(id string) string {
+	for _, t := range e.Definition.Tasks {
+		if t.ID == id {
+			return t.CompleteByTime
+		}
+	}
+	return ""
+}
+func (e *workflowEngine) taskCompleteByDate(id string) time.Time {
+	return e.deadline(e.startTime(), e.taskCompleteByTime(id))
+}
+func (e *workflowEngine) isTaskOverdue(id string) bool {
+	if e.taskCompleteByTime(id) == "" || e.Document.WorkflowStatus == WORKFLOW_STATUS_CANCELLED {
+		return false
+	}
+	completeby := e.taskCompleteByDate(id)
+	if completed := e.taskCompletionTime(id); !completed.IsZero() {
+		return completed.After(completeby)
+	}
+	return time.Now().After(completeby)
+}
+func (e *workflowEngine) taskTimeRemaining(id string) string {
+	if e.taskCompleteByTime(id) == "" {
+		return "Non Specified"
+	}
+	completeby := e.taskCompleteByDate(id)
+	if e.taskStatus(id) == tukcnst.COMPLETE || isWorkflowEnded(e.Document.WorkflowStatus) || time.Now().After(completeby) {
+		return "0"
+	}
+	return tukutil.PrettyPrintDuration(time.Until(completeby))
+}
+
+// TaskStates returns the deadline state of each workflow task
+func (e *workflowEngine) TaskStates() []TaskState {
+	var states []TaskState
+	for _, task := range e.Document.TaskList.XDWTask {
+		id := task.TaskData.TaskDetails.ID
+		state := TaskState{
+			ID:            id,
+			Name:          task.TaskData.TaskDetails.Name,
+			Status:        task.TaskData.TaskDetails.Status,
+			CompleteBy:    "Non Specified",
+			Overdue:       e.isTaskOverdue(id),
+			TimeRemaining: e.taskTimeRemaining(id),
+		}
+		if e.taskCompleteByTime(id) != "" {
+			state.CompleteBy = strings.Split(e.taskCompleteByDate(id).In(Calendar().Location).String(), " +")[0]
+		}
+		states = append(states, state)
+	}
+	return states
+}